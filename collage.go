@@ -0,0 +1,115 @@
+package imageflow
+
+import (
+	"fmt"
+	"math"
+)
+
+// CollageLayout describes the grid of a contact sheet
+// Columns The number of columns, 0 picks a square-ish grid
+// CellWidth and CellHeight The size every image is fitted into
+// Gutter The space between cells and around the sheet, in pixels
+// Background See Color. The sheet and padding color, nil is transparent.
+// Fit How images are fitted into their cell, one of ModeFitCrop (default), ModeFitPad, ModeWithinPad or ModeDistort.
+// Hint Resampling hints for fitting the images.
+type CollageLayout struct {
+	Columns    int
+	CellWidth  int
+	CellHeight int
+	Gutter     int
+	Background Color
+	Fit        ConstraintMode
+	Hint       ConstraintHint
+}
+
+// collageModes are the modes producing images of exactly the cell size
+var collageModes = []ConstraintMode{ModeFitCrop, ModeFitPad, ModeWithinPad, ModeDistort}
+
+// validate rejects empty cells and modes which don't fill the cell exactly
+func (layout CollageLayout) validate() error {
+	if layout.CellWidth <= 0 || layout.CellHeight <= 0 {
+		return fmt.Errorf("imageflow: invalid collage cell size %dx%d", layout.CellWidth, layout.CellHeight)
+	}
+	if layout.Columns < 0 || layout.Gutter < 0 {
+		return fmt.Errorf("imageflow: invalid collage columns %d or gutter %d", layout.Columns, layout.Gutter)
+	}
+	if layout.Fit != "" {
+		valid := false
+		for _, mode := range collageModes {
+			valid = valid || layout.Fit == mode
+		}
+		if !valid {
+			return fmt.Errorf("imageflow: collage cells cannot use mode %q, use fit_crop, fit_pad, within_pad or distort", layout.Fit)
+		}
+	}
+	return layout.Hint.validate()
+}
+
+// columns returns the number of columns for n images
+func (layout CollageLayout) columns(n int) int {
+	if layout.Columns > 0 {
+		return layout.Columns
+	}
+	return int(math.Ceil(math.Sqrt(float64(n))))
+}
+
+// Size returns the size of a sheet holding n images, 0x0 when there are none
+func (layout CollageLayout) Size(n int) (int, int) {
+	if n <= 0 {
+		return 0, 0
+	}
+	columns := layout.columns(n)
+	if n < columns {
+		columns = n
+	}
+	rows := (n + columns - 1) / columns
+	return columns*(layout.CellWidth+layout.Gutter) + layout.Gutter, rows*(layout.CellHeight+layout.Gutter) + layout.Gutter
+}
+
+// Cell returns the position of the top left corner of image i in a sheet of n images, 0,0 when there are none
+func (layout CollageLayout) Cell(i int, n int) (int, int) {
+	if n <= 0 {
+		return 0, 0
+	}
+	columns := layout.columns(n)
+	return layout.Gutter + (i%columns)*(layout.CellWidth+layout.Gutter),
+		layout.Gutter + (i/columns)*(layout.CellHeight+layout.Gutter)
+}
+
+// Collage builds a contact sheet of sources laid out in a grid and encodes it to sink
+// The sheet is a single graph: one canvas, a decode and constrain per source and a draw onto the canvas.
+// Errors are reported by Execute.
+func Collage(sources []IO, layout CollageLayout, sink ioOperation, preset presetInterface) Steps {
+	step := NewStep()
+	if len(sources) == 0 {
+		step.fail(fmt.Errorf("imageflow: a collage needs at least one source"))
+		return step
+	}
+	if err := layout.validate(); err != nil {
+		step.fail(err)
+		return step
+	}
+	mode := layout.Fit
+	if mode == "" {
+		mode = ModeFitCrop
+	}
+	constraint := Constrain{Mode: mode, W: float64(layout.CellWidth), H: float64(layout.CellHeight), Hint: layout.Hint}
+	if layout.Background != nil {
+		constraint.CanvasColor = layout.Background
+	}
+
+	w, h := layout.Size(len(sources))
+	step.CreateCanvas(w, h, PixelBGRA32, layout.Background)
+	sheet := step.Ref()
+	for i, source := range sources {
+		x, y := layout.Cell(i, len(sources))
+		step.Decode(source).
+			Constrain(constraint).
+			DrawExactOnto(sheet, DrawExact{
+				X: float32(x), Y: float32(y), W: float32(layout.CellWidth), H: float32(layout.CellHeight), Blend: "compose",
+			})
+		sheet = step.Ref()
+	}
+	step.Encode(sink, preset)
+	return step
+}
@@ -0,0 +1,112 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestCollage(t *testing.T) {
+	data := loadTestImage(t)
+	sources := []ioOperation{NewBuffer(data), NewBuffer(data), NewBuffer(data), NewBuffer(data), NewBuffer(data)}
+	layout := CollageLayout{Columns: 3, CellWidth: 120, CellHeight: 80, Gutter: 10, Background: MustParseColor("white")}
+	step := Collage(sources, layout, GetBuffer("sheet"), MozJPEG{Quality: 85})
+	result, err := step.ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode, _ := result.Encode("sheet")
+	if encode.W != 400 || encode.H != 190 {
+		t.Errorf("expected a 400x190 sheet, got %dx%d", encode.W, encode.H)
+	}
+}
+
+func TestCollageLayout(t *testing.T) {
+	layout := CollageLayout{Columns: 3, CellWidth: 100, CellHeight: 50, Gutter: 4}
+	if w, h := layout.Size(7); w != 316 || h != 166 {
+		t.Errorf("expected 316x166, got %dx%d", w, h)
+	}
+	if w, h := layout.Size(2); w != 212 || h != 58 {
+		t.Errorf("expected a single row of two cells, got %dx%d", w, h)
+	}
+	if x, y := layout.Cell(4, 7); x != 108 || y != 58 {
+		t.Errorf("expected cell 4 at 108,58, got %d,%d", x, y)
+	}
+
+	layout.Columns = 0
+	if w, h := layout.Size(5); w != 316 || h != 112 {
+		t.Errorf("expected 3 columns for 5 images, got %dx%d", w, h)
+	}
+	for _, n := range []int{0, -1} {
+		if w, h := layout.Size(n); w != 0 || h != 0 {
+			t.Errorf("expected an empty sheet for %d images, got %dx%d", n, w, h)
+		}
+		if x, y := layout.Cell(0, n); x != 0 || y != 0 {
+			t.Errorf("expected 0,0 for %d images, got %d,%d", n, x, y)
+		}
+	}
+}
+
+func TestCollageGraph(t *testing.T) {
+	layout := CollageLayout{Columns: 2, CellWidth: 10, CellHeight: 10, Fit: ModeFitPad, Background: Black{}}
+	step := Collage([]ioOperation{NewBuffer(nil), NewBuffer(nil)}, layout, GetBuffer("out"), LosslessPNG{})
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Framewise struct {
+			Graph struct {
+				Nodes map[string]map[string]json.RawMessage
+				Edges []struct {
+					From, To int
+					Kind     string
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	kinds := []string{"create_canvas", "decode", "constrain", "draw_image_exact", "decode", "constrain", "draw_image_exact", "encode"}
+	for i, kind := range kinds {
+		if _, ok := parsed.Framewise.Graph.Nodes[strconv.Itoa(i)][kind]; !ok {
+			t.Errorf("expected node %d to be %s", i, kind)
+		}
+	}
+	canvases := map[int]int{}
+	for _, edge := range parsed.Framewise.Graph.Edges {
+		if edge.Kind == "canvas" {
+			canvases[edge.To] = edge.From
+		}
+	}
+	if canvases[3] != 0 || canvases[6] != 3 {
+		t.Errorf("expected every draw to target the previous sheet, got %v", canvases)
+	}
+	var draw DrawExact
+	if err := json.Unmarshal(parsed.Framewise.Graph.Nodes["6"]["draw_image_exact"], &draw); err != nil {
+		t.Fatal(err)
+	}
+	if draw.X != 10 || draw.Y != 0 || draw.W != 10 {
+		t.Errorf("unexpected position of the second image %+v", draw)
+	}
+}
+
+func TestCollageInvalid(t *testing.T) {
+	sources := []ioOperation{NewBuffer(nil)}
+	for _, layout := range []CollageLayout{
+		{CellWidth: 0, CellHeight: 10},
+		{CellWidth: 10, CellHeight: 10, Gutter: -1},
+		{CellWidth: 10, CellHeight: 10, Fit: ModeWithin},
+		{CellWidth: 10, CellHeight: 10, Fit: "cover"},
+	} {
+		step := Collage(sources, layout, GetBuffer("out"), LosslessPNG{})
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for %+v", layout)
+		}
+	}
+	step := Collage(nil, CollageLayout{CellWidth: 10, CellHeight: 10}, GetBuffer("out"), LosslessPNG{})
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error without sources")
+	}
+}
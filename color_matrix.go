@@ -0,0 +1,157 @@
+package imageflow
+
+import (
+	"fmt"
+	"math"
+)
+
+// ColorMatrix is a 5x5 matrix applied to every pixel by libimageflow
+// Rows are the input channels red, green, blue, alpha and a constant 1, columns are the output channels.
+// Channels are in 0..1, so the last row holds offsets: 0.5 adds half of the full range.
+// The last column is unused. Like the color filters, the matrix operates on sRGB values, not linear light.
+type ColorMatrix [5][5]float32
+
+// Channel is a color channel of a ColorMatrix
+type Channel int
+
+const (
+	// ChannelRed is the red channel
+	ChannelRed Channel = iota
+	// ChannelGreen is the green channel
+	ChannelGreen
+	// ChannelBlue is the blue channel
+	ChannelBlue
+	// ChannelAlpha is the alpha channel
+	ChannelAlpha
+)
+
+// Rec. 709 luma coefficients, the same as GrayscaleBT709
+const (
+	lumaRed   = 0.2126
+	lumaGreen = 0.7152
+	lumaBlue  = 0.0722
+)
+
+// IdentityColorMatrix returns the matrix which leaves every pixel unchanged
+func IdentityColorMatrix() ColorMatrix {
+	var m ColorMatrix
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// Then returns the matrix which applies m and then next, so several adjustments run as one node
+func (m ColorMatrix) Then(next ColorMatrix) ColorMatrix {
+	var product ColorMatrix
+	for i := range product {
+		for j := range product[i] {
+			var sum float32
+			for k := range m[i] {
+				sum += m[i][k] * next[k][j]
+			}
+			product[i][j] = sum
+		}
+	}
+	return product
+}
+
+// ComposeColorMatrices returns the matrix which applies every matrix in order
+func ComposeColorMatrices(matrices ...ColorMatrix) ColorMatrix {
+	composed := IdentityColorMatrix()
+	for _, m := range matrices {
+		composed = composed.Then(m)
+	}
+	return composed
+}
+
+// HueRotateMatrix returns a matrix rotating the hue by degrees, keeping the luma, like CSS hue-rotate
+func HueRotateMatrix(degrees float64) ColorMatrix {
+	radians := degrees * math.Pi / 180
+	cos, sin := math.Cos(radians), math.Sin(radians)
+	// the CSS matrix maps columns to inputs, it is transposed below
+	css := [3][3]float64{
+		{0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928},
+		{0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283},
+		{0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072},
+	}
+	m := IdentityColorMatrix()
+	for out := 0; out < 3; out++ {
+		for in := 0; in < 3; in++ {
+			m[in][out] = float32(css[out][in])
+		}
+	}
+	return m
+}
+
+// TintMatrix returns a matrix which multiplies the image with color, amount 0..1 blends between the image and the tinted image
+func TintMatrix(color SRGB, amount float32) ColorMatrix {
+	m := IdentityColorMatrix()
+	for i, value := range []uint8{color.R, color.G, color.B} {
+		m[i][i] = 1 - amount + amount*float32(value)/255
+	}
+	return m
+}
+
+// ChannelSwapMatrix returns a matrix which fills red, green and blue from the given input channels
+// ChannelSwapMatrix(ChannelBlue, ChannelGreen, ChannelRed) swaps red and blue.
+// It panics if a channel is not one of the Channel constants.
+func ChannelSwapMatrix(red Channel, green Channel, blue Channel) ColorMatrix {
+	m := IdentityColorMatrix()
+	for out, in := range []Channel{red, green, blue} {
+		if in < ChannelRed || in > ChannelAlpha {
+			panic(fmt.Sprintf("imageflow: invalid channel %d", in))
+		}
+		for i := 0; i < 4; i++ {
+			m[i][out] = 0
+		}
+		m[in][out] = 1
+	}
+	return m
+}
+
+// DuotoneMatrix returns a matrix mapping the luma of every pixel onto a gradient from shadow to highlight
+func DuotoneMatrix(shadow SRGB, highlight SRGB) ColorMatrix {
+	var m ColorMatrix
+	weights := []float32{lumaRed, lumaGreen, lumaBlue}
+	shadows := []uint8{shadow.R, shadow.G, shadow.B}
+	highlights := []uint8{highlight.R, highlight.G, highlight.B}
+	for out := 0; out < 3; out++ {
+		spread := (float32(highlights[out]) - float32(shadows[out])) / 255
+		for in, weight := range weights {
+			m[in][out] = weight * spread
+		}
+		m[4][out] = float32(shadows[out]) / 255
+	}
+	m[3][3] = 1
+	m[4][4] = 1
+	return m
+}
+
+// validate rejects matrices containing NaN or infinity
+func (m ColorMatrix) validate() error {
+	for i := range m {
+		for j := range m[i] {
+			if math.IsNaN(float64(m[i][j])) || math.IsInf(float64(m[i][j]), 0) {
+				return fmt.Errorf("imageflow: invalid color matrix value %v at [%d][%d]", m[i][j], i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// toStep create a step from ColorMatrix
+func (m ColorMatrix) toStep() interface{} {
+	return doubleMap("color_matrix_srgb", "matrix", m)
+}
+
+// ColorMatrix is used to apply a color matrix to the image
+// This command operates in the sRGB space, see ColorMatrix.
+func (steps *Steps) ColorMatrix(m ColorMatrix) *Steps {
+	if err := m.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	steps.input(m.toStep())
+	return steps
+}
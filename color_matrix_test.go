@@ -0,0 +1,109 @@
+package imageflow
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// applyColorMatrix applies m to a pixel with channels in 0..1 the way libimageflow does
+func applyColorMatrix(m ColorMatrix, pixel [4]float32) [4]float32 {
+	var out [4]float32
+	for j := range out {
+		out[j] = m[4][j]
+		for i, value := range pixel {
+			out[j] += value * m[i][j]
+		}
+	}
+	return out
+}
+
+func assertPixel(t *testing.T, name string, got [4]float32, expected [4]float32) {
+	t.Helper()
+	for i := range got {
+		if math.Abs(float64(got[i]-expected[i])) > 0.002 {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+			return
+		}
+	}
+}
+
+func TestColorMatrix(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		ColorMatrix(ComposeColorMatrices(HueRotateMatrix(90), TintMatrix(RGB(255, 200, 150), 0.5))).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("ColorMatrix produced empty output")
+	}
+}
+
+func TestColorMatrixJSON(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).ColorMatrix([5][5]float32{{1}, {0, 1}, {0, 0, 1}, {0, 0, 0, 1}, {0.5, 0, 0, 0, 1}})
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"color_matrix_srgb":{"matrix":[[1,0,0,0,0],[0,1,0,0,0],[0,0,1,0,0],[0,0,0,1,0],[0.5,0,0,0,1]]}}`
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("expected %s in %s", expected, data)
+	}
+
+	step = NewStep()
+	step.Decode(NewBuffer([]byte{})).ColorMatrix(ColorMatrix{{float32(math.NaN())}})
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error for NaN")
+	}
+}
+
+func TestHueRotateMatrix(t *testing.T) {
+	gray := [4]float32{0.5, 0.5, 0.5, 1}
+	assertPixel(t, "gray", applyColorMatrix(HueRotateMatrix(123), gray), gray)
+	red := [4]float32{1, 0, 0, 1}
+	assertPixel(t, "0 degrees", applyColorMatrix(HueRotateMatrix(0), red), red)
+	assertPixel(t, "360 degrees", applyColorMatrix(HueRotateMatrix(360), red), red)
+	half := HueRotateMatrix(90).Then(HueRotateMatrix(90))
+	assertPixel(t, "composed", applyColorMatrix(half, red), applyColorMatrix(HueRotateMatrix(180), red))
+}
+
+func TestTintMatrix(t *testing.T) {
+	pixel := [4]float32{1, 1, 1, 0.5}
+	assertPixel(t, "full", applyColorMatrix(TintMatrix(RGB(255, 0, 51), 1), pixel), [4]float32{1, 0, 0.2, 0.5})
+	assertPixel(t, "half", applyColorMatrix(TintMatrix(RGB(255, 0, 51), 0.5), pixel), [4]float32{1, 0.5, 0.6, 0.5})
+	assertPixel(t, "none", applyColorMatrix(TintMatrix(RGB(255, 0, 51), 0), pixel), pixel)
+}
+
+func TestChannelSwapMatrix(t *testing.T) {
+	pixel := [4]float32{0.1, 0.2, 0.3, 0.4}
+	assertPixel(t, "bgr", applyColorMatrix(ChannelSwapMatrix(ChannelBlue, ChannelGreen, ChannelRed), pixel), [4]float32{0.3, 0.2, 0.1, 0.4})
+	assertPixel(t, "alpha", applyColorMatrix(ChannelSwapMatrix(ChannelAlpha, ChannelAlpha, ChannelAlpha), pixel), [4]float32{0.4, 0.4, 0.4, 0.4})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an invalid channel")
+		}
+	}()
+	ChannelSwapMatrix(ChannelRed, Channel(7), ChannelBlue)
+}
+
+func TestDuotoneMatrix(t *testing.T) {
+	m := DuotoneMatrix(RGB(0, 0, 102), RGB(255, 204, 0))
+	assertPixel(t, "black", applyColorMatrix(m, [4]float32{0, 0, 0, 1}), [4]float32{0, 0, 0.4, 1})
+	assertPixel(t, "white", applyColorMatrix(m, [4]float32{1, 1, 1, 0.5}), [4]float32{1, 0.8, 0, 0.5})
+}
+
+func TestComposeColorMatrices(t *testing.T) {
+	pixel := [4]float32{0.2, 0.4, 0.6, 1}
+	swap := ChannelSwapMatrix(ChannelBlue, ChannelGreen, ChannelRed)
+	tint := TintMatrix(RGB(255, 128, 0), 1)
+	expected := applyColorMatrix(tint, applyColorMatrix(swap, pixel))
+	assertPixel(t, "compose", applyColorMatrix(ComposeColorMatrices(swap, tint), pixel), expected)
+	assertPixel(t, "identity", applyColorMatrix(ComposeColorMatrices(), pixel), pixel)
+}
@@ -0,0 +1,580 @@
+package imageflow
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CommandMode is the RIAPI fit mode
+type CommandMode string
+
+const (
+	// CommandMax fits within width x height without padding
+	CommandMax CommandMode = "max"
+	// CommandPad fits within width x height and pads to exactly width x height
+	CommandPad CommandMode = "pad"
+	// CommandCrop fills width x height and crops the overflow
+	CommandCrop CommandMode = "crop"
+	// CommandCarve is accepted for compatibility and behaves like stretch
+	CommandCarve CommandMode = "carve"
+	// CommandStretch resizes to exactly width x height, ignoring the aspect ratio
+	CommandStretch CommandMode = "stretch"
+	// CommandAspectCrop crops to the aspect ratio of width x height without scaling
+	CommandAspectCrop CommandMode = "aspectcrop"
+)
+
+var commandModes = []string{"max", "pad", "crop", "carve", "stretch", "aspectcrop"}
+
+// CommandAnchor is the RIAPI anchor used by crop and pad
+type CommandAnchor string
+
+// The anchors name a corner, an edge center or the center
+const (
+	AnchorTopLeft      CommandAnchor = "topleft"
+	AnchorTopCenter    CommandAnchor = "topcenter"
+	AnchorTopRight     CommandAnchor = "topright"
+	AnchorMiddleLeft   CommandAnchor = "middleleft"
+	AnchorMiddleCenter CommandAnchor = "middlecenter"
+	AnchorMiddleRight  CommandAnchor = "middleright"
+	AnchorBottomLeft   CommandAnchor = "bottomleft"
+	AnchorBottomCenter CommandAnchor = "bottomcenter"
+	AnchorBottomRight  CommandAnchor = "bottomright"
+)
+
+var commandAnchors = []string{
+	"topleft", "topcenter", "topright",
+	"middleleft", "middlecenter", "middleright",
+	"bottomleft", "bottomcenter", "bottomright",
+}
+
+// CommandScale controls whether RIAPI may upscale
+type CommandScale string
+
+const (
+	// ScaleDown never upscales, this is the default
+	ScaleDown CommandScale = "down"
+	// ScaleBoth upscales and downscales
+	ScaleBoth CommandScale = "both"
+	// ScaleUp never downscales
+	ScaleUp CommandScale = "up"
+	// ScaleCanvas pads instead of upscaling
+	ScaleCanvas CommandScale = "canvas"
+)
+
+var commandScales = []string{"down", "both", "up", "canvas"}
+
+var commandScaleAliases = map[string]string{
+	"downscaleonly": "down", "upscaleonly": "up", "upscalecanvas": "canvas",
+}
+
+// CommandFlip is a RIAPI flip direction
+type CommandFlip string
+
+const (
+	// FlipNone does not flip
+	FlipNone CommandFlip = "none"
+	// FlipHorizontal mirrors left to right
+	FlipHorizontal CommandFlip = "h"
+	// FlipVertical mirrors top to bottom
+	FlipVertical CommandFlip = "v"
+	// FlipBoth mirrors in both directions
+	FlipBoth CommandFlip = "both"
+)
+
+var commandFlips = []string{"none", "h", "v", "both"}
+
+var commandFlipAliases = map[string]string{"x": "h", "y": "v", "xy": "both"}
+
+var commandGrayscales = []string{"true", "ntsc", "bt709", "flat", "ry"}
+
+// CommandString is a typed RIAPI command string, see ParseCommandString.
+// Zero values and nil pointers are left out of the querystring.
+type CommandString struct {
+	Width     int
+	Height    int
+	MaxWidth  int
+	MaxHeight int
+	Mode      CommandMode
+	Anchor    CommandAnchor
+	Scale     CommandScale
+	Zoom      float64
+
+	Format  ImageFormat
+	Quality int
+	BgColor *SRGB
+
+	// Crop is x1,y1,x2,y2, negative values are relative to the bottom right corner
+	Crop       []float64
+	CropXUnits float64
+	CropYUnits float64
+
+	TrimThreshold      int
+	TrimPercentPadding float64
+
+	Rotate       int
+	SourceRotate int
+	Flip         CommandFlip
+	SourceFlip   CommandFlip
+	Autorotate   *bool
+
+	DownFilter Filter
+	UpFilter   Filter
+	Sharpen    float64
+
+	Grayscale  string
+	Sepia      bool
+	Invert     bool
+	Alpha      *float64
+	Contrast   float64
+	Brightness float64
+	Saturation float64
+
+	WebPQuality     int
+	WebPLossless    *bool
+	PNGQuality      int
+	PNGMinQuality   int
+	PNGLossless     *bool
+	JPEGProgressive *bool
+	IgnoreICCErrors bool
+}
+
+// CommandStringError is returned for an unknown, disallowed or invalid key
+type CommandStringError struct {
+	Key     string
+	Message string
+}
+
+func (e *CommandStringError) Error() string {
+	return fmt.Sprintf("imageflow: command string %q: %s", e.Key, e.Message)
+}
+
+// PublicCommandKeys is an allowlist for commands taken from public URLs.
+// It leaves out the keys that only tune the encoders and filters.
+var PublicCommandKeys = []string{
+	"width", "height", "maxwidth", "maxheight", "mode", "anchor", "scale", "zoom",
+	"format", "quality", "bgcolor", "crop", "cropxunits", "cropyunits",
+	"rotate", "srotate", "flip", "sflip", "autorotate",
+	"trim.threshold", "trim.percentpadding",
+}
+
+// commandKey is used to parse and format one key of a CommandString
+type commandKey struct {
+	name    string
+	aliases []string
+	parse   func(cmd *CommandString, value string) error
+	format  func(cmd *CommandString) string
+}
+
+var commandKeys = []commandKey{
+	intKey("width", func(c *CommandString) *int { return &c.Width }, 1, math.MaxInt32, "w"),
+	intKey("height", func(c *CommandString) *int { return &c.Height }, 1, math.MaxInt32, "h"),
+	intKey("maxwidth", func(c *CommandString) *int { return &c.MaxWidth }, 1, math.MaxInt32),
+	intKey("maxheight", func(c *CommandString) *int { return &c.MaxHeight }, 1, math.MaxInt32),
+	enumKey("mode", func(c *CommandString) *string { return (*string)(&c.Mode) }, commandModes, nil),
+	enumKey("anchor", func(c *CommandString) *string { return (*string)(&c.Anchor) }, commandAnchors, nil),
+	enumKey("scale", func(c *CommandString) *string { return (*string)(&c.Scale) }, commandScales, commandScaleAliases),
+	floatKey("zoom", func(c *CommandString) *float64 { return &c.Zoom }, 0.01, 100, "dpr"),
+	{
+		name: "format",
+		parse: func(c *CommandString, value string) error {
+			format, err := ParseImageFormat(strings.ToLower(value))
+			c.Format = format
+			return err
+		},
+		format: func(c *CommandString) string { return c.Format.Extension() },
+	},
+	intKey("quality", func(c *CommandString) *int { return &c.Quality }, 1, 100),
+	{
+		name: "bgcolor",
+		parse: func(c *CommandString, value string) error {
+			color, err := ParseColor(value)
+			c.BgColor = &color
+			return err
+		},
+		format: func(c *CommandString) string {
+			if c.BgColor == nil {
+				return ""
+			}
+			return c.BgColor.Hex()
+		},
+	},
+	{
+		name: "crop",
+		parse: func(c *CommandString, value string) error {
+			parts := strings.Split(value, ",")
+			if len(parts) != 4 {
+				return fmt.Errorf("expected x1,y1,x2,y2")
+			}
+			c.Crop = make([]float64, 4)
+			for i, part := range parts {
+				v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return fmt.Errorf("invalid coordinate %q", part)
+				}
+				c.Crop[i] = v
+			}
+			return nil
+		},
+		format: func(c *CommandString) string {
+			if c.Crop == nil {
+				return ""
+			}
+			parts := make([]string, len(c.Crop))
+			for i, v := range c.Crop {
+				parts[i] = formatCommandFloat(v)
+			}
+			return strings.Join(parts, ",")
+		},
+	},
+	floatKey("cropxunits", func(c *CommandString) *float64 { return &c.CropXUnits }, 1, math.MaxInt32),
+	floatKey("cropyunits", func(c *CommandString) *float64 { return &c.CropYUnits }, 1, math.MaxInt32),
+	intKey("trim.threshold", func(c *CommandString) *int { return &c.TrimThreshold }, 1, 255),
+	floatKey("trim.percentpadding", func(c *CommandString) *float64 { return &c.TrimPercentPadding }, 0, 100),
+	rotationKey("rotate", func(c *CommandString) *int { return &c.Rotate }),
+	rotationKey("srotate", func(c *CommandString) *int { return &c.SourceRotate }),
+	enumKey("flip", func(c *CommandString) *string { return (*string)(&c.Flip) }, commandFlips, commandFlipAliases),
+	enumKey("sflip", func(c *CommandString) *string { return (*string)(&c.SourceFlip) }, commandFlips, commandFlipAliases),
+	optionalBoolKey("autorotate", func(c *CommandString) **bool { return &c.Autorotate }),
+	enumKey("down.filter", func(c *CommandString) *string { return (*string)(&c.DownFilter) }, filters, nil),
+	enumKey("up.filter", func(c *CommandString) *string { return (*string)(&c.UpFilter) }, filters, nil),
+	floatKey("f.sharpen", func(c *CommandString) *float64 { return &c.Sharpen }, 0, 100),
+	enumKey("s.grayscale", func(c *CommandString) *string { return &c.Grayscale }, commandGrayscales, map[string]string{"y": "true"}),
+	boolKey("s.sepia", func(c *CommandString) *bool { return &c.Sepia }),
+	boolKey("s.invert", func(c *CommandString) *bool { return &c.Invert }),
+	{
+		name: "s.alpha",
+		parse: func(c *CommandString, value string) error {
+			v, err := parseCommandFloat(value, 0, 1)
+			c.Alpha = &v
+			return err
+		},
+		format: func(c *CommandString) string {
+			if c.Alpha == nil {
+				return ""
+			}
+			return formatCommandFloat(*c.Alpha)
+		},
+	},
+	floatKey("s.contrast", func(c *CommandString) *float64 { return &c.Contrast }, -1, 1),
+	floatKey("s.brightness", func(c *CommandString) *float64 { return &c.Brightness }, -1, 1),
+	floatKey("s.saturation", func(c *CommandString) *float64 { return &c.Saturation }, -1, 1),
+	intKey("webp.quality", func(c *CommandString) *int { return &c.WebPQuality }, 1, 100),
+	optionalBoolKey("webp.lossless", func(c *CommandString) **bool { return &c.WebPLossless }),
+	intKey("png.quality", func(c *CommandString) *int { return &c.PNGQuality }, 1, 100),
+	intKey("png.min_quality", func(c *CommandString) *int { return &c.PNGMinQuality }, 1, 100),
+	optionalBoolKey("png.lossless", func(c *CommandString) **bool { return &c.PNGLossless }),
+	optionalBoolKey("jpeg.progressive", func(c *CommandString) **bool { return &c.JPEGProgressive }),
+	boolKey("ignoreicc", func(c *CommandString) *bool { return &c.IgnoreICCErrors }, "ignore_icc_errors"),
+}
+
+// intKey is used to define a positive integer key, zero is unset
+func intKey(name string, field func(*CommandString) *int, min, max int, aliases ...string) commandKey {
+	return commandKey{
+		name:    name,
+		aliases: aliases,
+		parse: func(c *CommandString, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil || v < min || v > max {
+				return fmt.Errorf("expected an integer from %d to %d", min, max)
+			}
+			*field(c) = v
+			return nil
+		},
+		format: func(c *CommandString) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return strconv.Itoa(*field(c))
+		},
+	}
+}
+
+// floatKey is used to define a number key, zero is unset
+func floatKey(name string, field func(*CommandString) *float64, min, max float64, aliases ...string) commandKey {
+	return commandKey{
+		name:    name,
+		aliases: aliases,
+		parse: func(c *CommandString, value string) error {
+			v, err := parseCommandFloat(value, min, max)
+			*field(c) = v
+			return err
+		},
+		format: func(c *CommandString) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return formatCommandFloat(*field(c))
+		},
+	}
+}
+
+// rotationKey is used to define a key taking a multiple of 90 degrees
+func rotationKey(name string, field func(*CommandString) *int) commandKey {
+	return commandKey{
+		name: name,
+		parse: func(c *CommandString, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil || v%90 != 0 {
+				return fmt.Errorf("expected a multiple of 90")
+			}
+			*field(c) = (v%360 + 360) % 360
+			return nil
+		},
+		format: func(c *CommandString) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return strconv.Itoa(*field(c))
+		},
+	}
+}
+
+// enumKey is used to define a key taking one of values, aliases map to values
+func enumKey(name string, field func(*CommandString) *string, values []string, aliases map[string]string) commandKey {
+	return commandKey{
+		name: name,
+		parse: func(c *CommandString, value string) error {
+			value = strings.ToLower(value)
+			if alias, ok := aliases[value]; ok {
+				value = alias
+			}
+			if _, err := parseEnum(name, values, value); err != nil {
+				return fmt.Errorf("expected one of %s", strings.Join(values, ", "))
+			}
+			*field(c) = value
+			return nil
+		},
+		format: func(c *CommandString) string { return *field(c) },
+	}
+}
+
+// boolKey is used to define a flag, false is unset
+func boolKey(name string, field func(*CommandString) *bool, aliases ...string) commandKey {
+	return commandKey{
+		name:    name,
+		aliases: aliases,
+		parse: func(c *CommandString, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false")
+			}
+			*field(c) = v
+			return nil
+		},
+		format: func(c *CommandString) string {
+			if !*field(c) {
+				return ""
+			}
+			return "true"
+		},
+	}
+}
+
+// optionalBoolKey is used to define a flag where false overrides a default, nil is unset
+func optionalBoolKey(name string, field func(*CommandString) **bool) commandKey {
+	return commandKey{
+		name: name,
+		parse: func(c *CommandString, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false")
+			}
+			*field(c) = &v
+			return nil
+		},
+		format: func(c *CommandString) string {
+			if *field(c) == nil {
+				return ""
+			}
+			return strconv.FormatBool(**field(c))
+		},
+	}
+}
+
+// parseCommandFloat parses a finite number from min to max
+func parseCommandFloat(value string, min, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(v >= min && v <= max) {
+		return 0, fmt.Errorf("expected a number from %v to %v", min, max)
+	}
+	return v, nil
+}
+
+// formatCommandFloat formats a number without a trailing zero
+func formatCommandFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// lookupCommandKey returns the key named name or one of its aliases
+func lookupCommandKey(name string) (commandKey, bool) {
+	for _, key := range commandKeys {
+		if key.name == name {
+			return key, true
+		}
+		for _, alias := range key.aliases {
+			if alias == name {
+				return key, true
+			}
+		}
+	}
+	return commandKey{}, false
+}
+
+// ParseCommandString parses a RIAPI querystring such as "width=300&mode=max".
+// Keys are case insensitive. Unknown, repeated and invalid keys are a *CommandStringError.
+func ParseCommandString(query string) (*CommandString, error) {
+	return parseCommandString(query, nil)
+}
+
+// ParseCommandStringAllowed is ParseCommandString but also rejects any key not in allowed,
+// use it with PublicCommandKeys for querystrings from public URLs
+func ParseCommandStringAllowed(query string, allowed []string) (*CommandString, error) {
+	if allowed == nil {
+		allowed = []string{}
+	}
+	return parseCommandString(query, allowed)
+}
+
+// parseCommandString is used to parse a query, a nil allowed permits every key
+func parseCommandString(query string, allowed []string) (*CommandString, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil {
+		return nil, &CommandStringError{Key: query, Message: err.Error()}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cmd := &CommandString{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		key, ok := lookupCommandKey(strings.ToLower(name))
+		if !ok {
+			return nil, &CommandStringError{Key: name, Message: "unknown key"}
+		}
+		if allowed != nil && !containsString(allowed, key.name) {
+			return nil, &CommandStringError{Key: name, Message: "key is not allowed"}
+		}
+		if seen[key.name] || len(values[name]) > 1 {
+			return nil, &CommandStringError{Key: name, Message: "key is repeated"}
+		}
+		seen[key.name] = true
+		value := strings.TrimSpace(values[name][0])
+		if value == "" {
+			return nil, &CommandStringError{Key: name, Message: "missing value"}
+		}
+		if err := key.parse(cmd, value); err != nil {
+			return nil, &CommandStringError{Key: name, Message: err.Error()}
+		}
+	}
+	return cmd, nil
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the querystring with keys in a fixed order
+func (cmd CommandString) String() string {
+	var parts []string
+	for _, key := range commandKeys {
+		if value := key.format(&cmd); value != "" {
+			parts = append(parts, key.name+"="+strings.ReplaceAll(url.QueryEscape(value), "%2C", ","))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Keys returns the names of the keys that are set
+func (cmd CommandString) Keys() []string {
+	var keys []string
+	for _, key := range commandKeys {
+		if key.format(&cmd) != "" {
+			keys = append(keys, key.name)
+		}
+	}
+	return keys
+}
+
+// outputSize returns an upper bound of the size cmd produces from a width x height source
+// The source size is after EXIF rotation. Trimming only makes the image smaller and is left out.
+func (cmd CommandString) outputSize(width int, height int) (int, int) {
+	if cmd.SourceRotate%180 != 0 {
+		width, height = height, width
+	}
+	w, h := float64(width), float64(height)
+	if len(cmd.Crop) == 4 {
+		w = cropLength(cmd.Crop[0], cmd.Crop[2], w, cmd.CropXUnits)
+		h = cropLength(cmd.Crop[1], cmd.Crop[3], h, cmd.CropYUnits)
+	}
+	boxW, boxH := float64(cmd.Width), float64(cmd.Height)
+	if cmd.MaxWidth > 0 && (boxW == 0 || float64(cmd.MaxWidth) < boxW) {
+		boxW = float64(cmd.MaxWidth)
+	}
+	if cmd.MaxHeight > 0 && (boxH == 0 || float64(cmd.MaxHeight) < boxH) {
+		boxH = float64(cmd.MaxHeight)
+	}
+	// every mode fits within or fills the box, a missing side follows the aspect ratio
+	switch {
+	case boxW == 0 && boxH == 0:
+		boxW, boxH = w, h
+	case boxH == 0:
+		boxH = boxW * h / w
+	case boxW == 0:
+		boxW = boxH * w / h
+	case cmd.Mode == CommandMax || (cmd.Width == 0 && cmd.Height == 0):
+		scale := math.Min(boxW/w, boxH/h)
+		boxW, boxH = w*scale, h*scale
+	}
+	zoom := cmd.Zoom
+	if zoom == 0 {
+		zoom = 1
+	}
+	outW, outH := int(math.Ceil(boxW*zoom)), int(math.Ceil(boxH*zoom))
+	if cmd.Rotate%180 != 0 {
+		outW, outH = outH, outW
+	}
+	return outW, outH
+}
+
+// cropLength returns the length of the crop from start to end of a side of size
+// Units scale the coordinates to size, negative start and non-positive end count from the end.
+func cropLength(start float64, end float64, size float64, units float64) float64 {
+	if units > 0 {
+		start, end = start*size/units, end*size/units
+	}
+	if start < 0 {
+		start += size
+	}
+	if end <= 0 {
+		end += size
+	}
+	if length := math.Min(end, size) - math.Max(start, 0); length >= 1 {
+		return length
+	}
+	return size
+}
+
+// Validate checks that every field is in range
+// Format is checked directly as String drops formats without an extension.
+func (cmd CommandString) Validate() error {
+	if cmd.Format != "" {
+		if _, err := parseEnum("image format", imageFormats, string(cmd.Format)); err != nil {
+			return &CommandStringError{Key: "format", Message: err.Error()}
+		}
+	}
+	_, err := ParseCommandString(cmd.String())
+	return err
+}
@@ -0,0 +1,149 @@
+package imageflow
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandString(t *testing.T) {
+	cmd, err := ParseCommandString("?W=300&h=200&mode=crop&anchor=topleft&scale=upscalecanvas&format=JPG&quality=80" +
+		"&bgcolor=%23ff0000&crop=10,20,-10,-20&rotate=-90&flip=xy&autorotate=false&s.alpha=0&s.grayscale=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := RGB(255, 0, 0)
+	if cmd.Width != 300 || cmd.Height != 200 || cmd.Mode != CommandCrop || cmd.Anchor != AnchorTopLeft ||
+		cmd.Scale != ScaleCanvas || cmd.Format != FormatJPEG || cmd.Quality != 80 || *cmd.BgColor != red ||
+		len(cmd.Crop) != 4 || cmd.Crop[2] != -10 || cmd.Rotate != 270 || cmd.Flip != FlipBoth ||
+		cmd.Autorotate == nil || *cmd.Autorotate || cmd.Alpha == nil || *cmd.Alpha != 0 || cmd.Grayscale != "true" {
+		t.Errorf("unexpected %+v", cmd)
+	}
+	expected := "width=300&height=200&mode=crop&anchor=topleft&scale=canvas&format=jpg&quality=80" +
+		"&bgcolor=ff0000ff&crop=10,20,-10,-20&rotate=270&flip=both&autorotate=false&s.grayscale=true&s.alpha=0"
+	if cmd.String() != expected {
+		t.Errorf("expected %s, got %s", expected, cmd.String())
+	}
+	again, err := ParseCommandString(cmd.String())
+	if err != nil || again.String() != expected {
+		t.Errorf("round trip gave %v, %v", again, err)
+	}
+}
+
+func TestParseCommandStringErrors(t *testing.T) {
+	for query, key := range map[string]string{
+		"widht=300":               "widht",
+		"width=0":                 "width",
+		"width=abc":               "width",
+		"width=1&w=2":             "width",
+		"width=1&width=2":         "width",
+		"mode=fill":               "mode",
+		"quality=101":             "quality",
+		"format=bmp":              "format",
+		"bgcolor=nope":            "bgcolor",
+		"crop=1,2,3":              "crop",
+		"crop=1,2,3,NaN":          "crop",
+		"rotate=45":               "rotate",
+		"s.alpha=2":               "s.alpha",
+		"f.sharpen=NaN":           "f.sharpen",
+		"height=":                 "height",
+		"down.filter=bilinear":    "down.filter",
+		"autorotate=maybe":        "autorotate",
+		"trim.percentpadding=101": "trim.percentpadding",
+	} {
+		_, err := ParseCommandString(query)
+		var cmdErr *CommandStringError
+		if !errors.As(err, &cmdErr) || cmdErr.Key != key {
+			t.Errorf("%s: expected an error for %q, got %v", query, key, err)
+		}
+	}
+}
+
+func TestParseCommandStringAllowed(t *testing.T) {
+	if _, err := ParseCommandStringAllowed("w=100&format=webp", PublicCommandKeys); err != nil {
+		t.Error(err)
+	}
+	_, err := ParseCommandStringAllowed("width=100&webp.quality=10", PublicCommandKeys)
+	var cmdErr *CommandStringError
+	if !errors.As(err, &cmdErr) || cmdErr.Key != "webp.quality" || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected webp.quality to be rejected, got %v", err)
+	}
+	if _, err := ParseCommandStringAllowed("width=100", nil); err == nil {
+		t.Error("expected a nil allowlist to reject every key")
+	}
+}
+
+func TestCommandStringKeys(t *testing.T) {
+	lossless := true
+	cmd := CommandString{MaxWidth: 100, Sepia: true, PNGLossless: &lossless}
+	if keys := strings.Join(cmd.Keys(), ","); keys != "maxwidth,s.sepia,png.lossless" {
+		t.Errorf("unexpected keys %s", keys)
+	}
+	if (CommandString{}).String() != "" {
+		t.Error("expected an empty command string")
+	}
+	if err := (CommandString{Quality: 500}).Validate(); err == nil {
+		t.Error("expected quality 500 to be invalid")
+	}
+	if err := (CommandString{Crop: []float64{1, 2}}).Validate(); err == nil {
+		t.Error("expected a short crop to be invalid")
+	}
+	if err := (CommandString{Format: "bmp"}).Validate(); err == nil {
+		t.Error("expected format bmp to be invalid")
+	}
+	if err := (CommandString{Format: FormatWebP}).Validate(); err != nil {
+		t.Errorf("expected format webp to be valid, got %v", err)
+	}
+}
+
+func TestCommandStringStep(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer(nil)).
+		CommandString(CommandString{Width: 200, Mode: CommandMax, Format: FormatPNG}).
+		Encode(GetBuffer("out"), LosslessPNG{})
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"value":"width=200\u0026mode=max\u0026format=png"`) {
+		t.Errorf("unexpected graph %s", data)
+	}
+
+	step = NewStep()
+	step.Decode(NewBuffer(nil)).
+		CommandString(CommandString{Width: -1}).
+		Encode(GetBuffer("out"), LosslessPNG{})
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected an invalid command string to fail the job")
+	}
+}
+
+func TestCommandStringOutputSize(t *testing.T) {
+	for _, test := range []struct {
+		query     string
+		expectedW int
+		expectedH int
+	}{
+		{"", 400, 300},
+		{"width=200", 200, 150},
+		{"height=100", 134, 100},
+		{"maxwidth=100&maxheight=1000", 100, 75},
+		{"width=300&height=300&mode=crop", 300, 300},
+		{"width=300&height=300&mode=max", 300, 225},
+		{"width=200&maxwidth=100", 100, 75},
+		{"height=100&zoom=2", 267, 200},
+		{"height=100&srotate=90", 75, 100},
+		{"width=200&rotate=270", 150, 200},
+		{"height=100&crop=0,0,100,300", 34, 100},
+		{"height=100&crop=0,0,-300,0", 34, 100},
+		{"height=100&crop=0,0,1,1&cropxunits=4&cropyunits=1", 34, 100},
+	} {
+		cmd, err := ParseCommandString(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, h := cmd.outputSize(400, 300); w != test.expectedW || h != test.expectedH {
+			t.Errorf("%q: expected %dx%d, got %dx%d", test.query, test.expectedW, test.expectedH, w, h)
+		}
+	}
+}
@@ -1,8 +1,55 @@
 package imageflow
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // Decode is used to create a decode node in graph
 type decode struct {
-	IoID int `json:"io_id"`
+	IoID     int           `json:"io_id"`
+	Commands []interface{} `json:"commands,omitempty"`
+}
+
+// DecodeOptions are commands for the decoder
+// JPEGDownscale lets the JPEG decoder scale down during decoding, which is much faster for large images
+// DiscardColorProfile ignores the embedded ICC profile and treats the image as sRGB
+// IgnoreColorProfileErrors decodes images whose ICC profile is broken instead of failing
+// Frame selects a frame of an animated GIF or WebP, 0 is the first frame
+type DecodeOptions struct {
+	JPEGDownscale            *JPEGDownscaleHint
+	DiscardColorProfile      bool
+	IgnoreColorProfileErrors bool
+	Frame                    int
+}
+
+// JPEGDownscaleHint is the smallest size the JPEG decoder may scale down to using IDCT scaling
+// The image is decoded at the smallest IDCT scale that is still at least Width x Height.
+// ScaleLumaSpatially improves the quality of the downscaling.
+// LinearLight performs the spatial luma scaling in linear light instead of sRGB.
+type JPEGDownscaleHint struct {
+	Width              int64 `json:"width"`
+	Height             int64 `json:"height"`
+	ScaleLumaSpatially bool  `json:"scale_luma_spatially"`
+	LinearLight        bool  `json:"gamma_correct_for_srgb_during_spatial_luma_scaling"`
+}
+
+// toCommands converts the options to decoder commands
+func (options DecodeOptions) toCommands() []interface{} {
+	var commands []interface{}
+	if options.JPEGDownscale != nil {
+		commands = append(commands, singleMap("jpeg_downscale_hints", *options.JPEGDownscale))
+	}
+	if options.DiscardColorProfile {
+		commands = append(commands, "discard_color_profile")
+	}
+	if options.IgnoreColorProfileErrors {
+		commands = append(commands, "ignore_color_profile_errors")
+	}
+	if options.Frame != 0 {
+		commands = append(commands, singleMap("select_frame", options.Frame))
+	}
+	return commands
 }
 
 // toStep is used to convert a Decode to step
@@ -17,6 +64,14 @@ type presetInterface interface {
 	toPreset() interface{}
 }
 
+// presetValidator is implemented by presets which can be invalid
+type presetValidator interface {
+	validate() error
+}
+
+// Preset is any of the encoding presets, like MozJPEG or WebP, for use in lists of presets
+type Preset = presetInterface
+
 // Encode is used to convert to a image
 type encode struct {
 	IoID   int         `json:"io_id"`
@@ -31,19 +86,158 @@ func (encode encode) toStep() interface{} {
 }
 
 // MozJPEG is used to encode using mozjpeg library
+// Matte See Color. The background to flatten transparent images onto, JPEG has no alpha channel.
 type MozJPEG struct {
-	Quality     uint `json:"quality"`
-	Progressive bool `json:"progressive"`
+	Quality     uint  `json:"quality"`
+	Progressive bool  `json:"progressive"`
+	Matte       Color `json:"-"`
 }
 
 // toPreset is used to convert the MozJPG to a preset
 func (preset MozJPEG) toPreset() interface{} {
-	presetMap := make(map[string]presetInterface)
 	if preset.Quality == 0 {
 		preset.Quality = 90
 	}
-	presetMap["mozjpeg"] = preset
-	return presetMap
+	return singleMap("mozjpeg", struct {
+		Quality     uint        `json:"quality"`
+		Progressive bool        `json:"progressive"`
+		Matte       interface{} `json:"matte,omitempty"`
+	}{preset.Quality, preset.Progressive, toColorOrNil(preset.Matte)})
+}
+
+// LibJPEGTurbo is used to encode using libjpeg-turbo library
+// Quality 0..100, default 90
+// OptimizeHuffmanCoding makes files smaller at the cost of encoding speed
+// Matte See Color. The background to flatten transparent images onto, JPEG has no alpha channel.
+type LibJPEGTurbo struct {
+	Quality               int
+	Progressive           bool
+	OptimizeHuffmanCoding bool
+	Matte                 Color
+}
+
+// toPreset is used to convert LibJPEGTurbo to preset
+func (preset LibJPEGTurbo) toPreset() interface{} {
+	if preset.Quality == 0 {
+		preset.Quality = 90
+	}
+	return singleMap("libjpegturbo", struct {
+		Quality               int         `json:"quality"`
+		Progressive           bool        `json:"progressive"`
+		OptimizeHuffmanCoding bool        `json:"optimize_huffman_coding"`
+		Matte                 interface{} `json:"matte,omitempty"`
+	}{preset.Quality, preset.Progressive, preset.OptimizeHuffmanCoding, toColorOrNil(preset.Matte)})
+}
+
+// validate rejects qualities outside 0..100
+func (preset LibJPEGTurbo) validate() error {
+	if preset.Quality < 0 || preset.Quality > 100 {
+		return fmt.Errorf("imageflow: invalid libjpegturbo quality %d", preset.Quality)
+	}
+	return nil
+}
+
+// PNGBitDepth is the bit depth of a PNG written by LibPNG
+type PNGBitDepth string
+
+const (
+	// PNG32 keeps the alpha channel
+	PNG32 PNGBitDepth = "png_32"
+	// PNG24 drops the alpha channel, flattening onto the matte
+	PNG24 PNGBitDepth = "png_24"
+)
+
+var pngBitDepths = []string{"png_32", "png_24"}
+
+// String returns the name of the bit depth
+func (depth PNGBitDepth) String() string {
+	return string(depth)
+}
+
+// MarshalJSON implements json.Marshaler
+func (depth PNGBitDepth) MarshalJSON() ([]byte, error) {
+	return marshalEnum("png bit depth", pngBitDepths, string(depth))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (depth *PNGBitDepth) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("png bit depth", pngBitDepths, data)
+	*depth = PNGBitDepth(value)
+	return err
+}
+
+// LibPNG is used to encode using libpng library
+// Depth PNG32 or PNG24, default PNG32
+// ZlibCompression 1 (fastest) to 9 (smallest), 0 uses the default of libimageflow
+// Matte See Color. The background to flatten transparent images onto when Depth is PNG24.
+type LibPNG struct {
+	Depth           PNGBitDepth
+	ZlibCompression int
+	Matte           Color
+}
+
+// toPreset is used to convert LibPNG to preset
+func (preset LibPNG) toPreset() interface{} {
+	libpng := struct {
+		Depth           PNGBitDepth `json:"depth"`
+		ZlibCompression interface{} `json:"zlib_compression"`
+		Matte           interface{} `json:"matte,omitempty"`
+	}{Depth: preset.Depth, Matte: toColorOrNil(preset.Matte)}
+	if preset.ZlibCompression != 0 {
+		libpng.ZlibCompression = preset.ZlibCompression
+	}
+	return singleMap("libpng", libpng)
+}
+
+// validate rejects unknown bit depths and compression levels
+func (preset LibPNG) validate() error {
+	if preset.ZlibCompression < 0 || preset.ZlibCompression > 9 {
+		return fmt.Errorf("imageflow: invalid zlib compression %d", preset.ZlibCompression)
+	}
+	_, err := preset.Depth.MarshalJSON()
+	return err
+}
+
+// FormatProfile encodes to a fixed format, using a quality profile instead of encoder specific settings
+// Format The format to encode to
+// QualityProfile lowest through lossless, default QualityHigh
+// QualityProfileDPR The device pixel ratio the image is displayed at, higher ratios permit lower quality
+// Lossless Whether to use the lossless mode of the format
+// Matte See Color. The background to flatten alpha onto if the format has no alpha channel.
+type FormatProfile struct {
+	Format            ImageFormat
+	QualityProfile    QualityProfile
+	QualityProfileDPR float32
+	Lossless          LosslessPreference
+	Matte             Color
+}
+
+// toPreset is used to convert FormatProfile to preset
+func (preset FormatProfile) toPreset() interface{} {
+	profile := preset.QualityProfile
+	if profile == "" {
+		profile = QualityHigh
+	}
+	formatMap := map[string]interface{}{
+		"format":          preset.Format,
+		"quality_profile": profile,
+		"lossless":        preset.Lossless,
+	}
+	if preset.QualityProfileDPR != 0 {
+		formatMap["quality_profile_dpr"] = preset.QualityProfileDPR
+	}
+	if preset.Matte != nil {
+		formatMap["matte"] = preset.Matte.toColor()
+	}
+	return singleMap("format", formatMap)
+}
+
+// validate rejects unknown formats and profiles
+func (preset FormatProfile) validate() error {
+	if _, err := ParseImageFormat(string(preset.Format)); err != nil {
+		return err
+	}
+	return Auto{QualityProfile: preset.QualityProfile, QualityProfileDPR: preset.QualityProfileDPR, Lossless: preset.Lossless}.validate()
 }
 
 // GIF is used to encode to gif
@@ -107,12 +301,12 @@ func (preset WebPLossless) toPreset() interface{} {
 // Constrain is used to specify constraints for the image
 // W The width constraint in pixels
 // H The height constraint in pixels
-// Mode A constraint mode
+// Mode A constraint mode, see ConstraintMode
 // Gravity determines how the image is anchored when cropped or padded. {x: 0, y: 0} represents top-left, {x: 50, y: 50} represents center, {x:100, y:100} represents bottom-right. Default: center
 // Hints See resampling hints
-// Canvas_color See Color. The color of padding added to the image.
+// Canvas_color See Color. The color of padding added to the image, for example SRGB or a color from ParseColor.
 type Constrain struct {
-	Mode        string         `json:"mode"`
+	Mode        ConstraintMode `json:"mode"`
 	W           float64        `json:"w"`
 	H           float64        `json:"h"`
 	Hint        ConstraintHint `json:"hints"`
@@ -138,6 +332,14 @@ type Color interface {
 	toColor() interface{}
 }
 
+// toColorOrNil converts an optional Color
+func toColorOrNil(color Color) interface{} {
+	if color == nil {
+		return nil
+	}
+	return color.toColor()
+}
+
 // Black is the Implementation of interface Color and used as color black
 type Black struct{}
 
@@ -162,7 +364,9 @@ func (color Transparent) toColor() interface{} {
 // BackgroundColor The background color to apply.
 // ResampleWhen One of size_differs, size_differs_or_sharpening_requested, or always.
 // SharpenWhen One of downscaling, upscaling, size_differs, or always
-// Supported Filters
+// Empty values are left to libimageflow's defaults.
+// Supported Filters, see Filter
+// robidoux - The default and suggested downsampling filter
 // robidoux_sharp - A sharper version of the above
 // robidoux_fast - A faster, less accurate version of robidoux
 // ginseng - The default and suggested upsampling filter
@@ -185,20 +389,44 @@ func (color Transparent) toColor() interface{} {
 // n_cubic
 // n_cubic_sharp
 type ConstraintHint struct {
-	SharpenPercent    interface{} `json:"sharpen_percent"`
-	DownFilter        interface{} `json:"down_filter"`
-	UpFilter          interface{} `json:"up_filter"`
-	ScalingColorspace interface{} `json:"scaling_colorspace"`
-	BackgroundColor   interface{} `json:"background_color"`
-	ResampleWhen      interface{} `json:"resample_when"`
-	SharpenWhen       interface{} `json:"sharpen_when"`
+	SharpenPercent    interface{}       `json:"sharpen_percent"`
+	DownFilter        Filter            `json:"down_filter"`
+	UpFilter          Filter            `json:"up_filter"`
+	ScalingColorspace ScalingColorspace `json:"scaling_colorspace"`
+	BackgroundColor   interface{}       `json:"background_color"`
+	ResampleWhen      ResampleWhen      `json:"resample_when"`
+	SharpenWhen       SharpenWhen       `json:"sharpen_when"`
+}
+
+// validate rejects unknown filters and policies
+func (hint ConstraintHint) validate() error {
+	for _, value := range []json.Marshaler{hint.DownFilter, hint.UpFilter, hint.ScalingColorspace, hint.ResampleWhen, hint.SharpenWhen} {
+		if _, err := value.MarshalJSON(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate rejects unknown modes, filters and policies
+func (step Constrain) validate() error {
+	if _, err := ParseConstraintMode(string(step.Mode)); err != nil {
+		return err
+	}
+	return step.Hint.validate()
+}
+
+// toHint converts the colors of the hint
+func (hint ConstraintHint) toHint() ConstraintHint {
+	if color, ok := hint.BackgroundColor.(Color); ok {
+		hint.BackgroundColor = color.toColor()
+	}
+	return hint
 }
 
 // toStep Converts the Constraint to a step
 func (step Constrain) toStep() interface{} {
-	if step.Hint.BackgroundColor != nil {
-		step.Hint.BackgroundColor = step.Hint.BackgroundColor.(Color).toColor()
-	}
+	step.Hint = step.Hint.toHint()
 	if step.Gravity != nil {
 		step.Gravity = step.Gravity.(ConstraintGravity).toGravity()
 	}
@@ -335,6 +563,90 @@ func (region ExpandCanvas) toStep() interface{} {
 	return stepMap
 }
 
+// createCanvas is used to start a graph from a blank canvas
+type createCanvas struct {
+	W      int         `json:"w"`
+	H      int         `json:"h"`
+	Format PixelFormat `json:"format"`
+	Color  interface{} `json:"color"`
+}
+
+// validate rejects empty canvases and unknown pixel formats
+func (canvas createCanvas) validate() error {
+	if canvas.W <= 0 || canvas.H <= 0 {
+		return fmt.Errorf("imageflow: invalid canvas size %dx%d", canvas.W, canvas.H)
+	}
+	_, err := canvas.Format.MarshalJSON()
+	return err
+}
+
+// toStep create a step from createCanvas, the format defaults to bgra_32 and the color to transparent
+func (canvas createCanvas) toStep() interface{} {
+	if canvas.Format == "" {
+		canvas.Format = PixelBGRA32
+	}
+	if canvas.Color == nil {
+		canvas.Color = Transparent("")
+	}
+	canvas.Color = canvas.Color.(Color).toColor()
+	stepMap := make(map[string]stepInterface)
+	stepMap["create_canvas"] = canvas
+	return stepMap
+}
+
+// CornerRadius is used to specify the radius of rounded corners
+type CornerRadius interface {
+	toRadius() interface{}
+}
+
+// PixelRadius is a corner radius in pixels
+type PixelRadius float64
+
+// PercentageRadius is a corner radius in percent of the smaller side of the image, 50 gives a circle or an ellipse
+type PercentageRadius float64
+
+func (radius PixelRadius) toRadius() interface{} {
+	return singleMap("pixels", float64(radius))
+}
+
+func (radius PercentageRadius) toRadius() interface{} {
+	return singleMap("percentage", float64(radius))
+}
+
+// roundImageCorners is used to round the corners of the image
+type roundImageCorners struct {
+	Radius          CornerRadius
+	BackgroundColor Color
+}
+
+// validate rejects missing, negative and oversized radii
+func (corners roundImageCorners) validate() error {
+	switch radius := corners.Radius.(type) {
+	case nil:
+		return fmt.Errorf("imageflow: missing corner radius")
+	case PixelRadius:
+		if radius < 0 {
+			return fmt.Errorf("imageflow: invalid corner radius %v", float64(radius))
+		}
+	case PercentageRadius:
+		if radius < 0 || radius > 50 {
+			return fmt.Errorf("imageflow: invalid corner radius percentage %v, must be 0..50", float64(radius))
+		}
+	}
+	return nil
+}
+
+// toStep create a step from roundImageCorners, the background defaults to transparent
+func (corners roundImageCorners) toStep() interface{} {
+	if corners.BackgroundColor == nil {
+		corners.BackgroundColor = Transparent("")
+	}
+	return singleMap("round_image_corners", map[string]interface{}{
+		"radius":           corners.Radius.toRadius(),
+		"background_color": corners.BackgroundColor.toColor(),
+	})
+}
+
 // watermark is used to create a watermark
 type watermark struct {
 	IoID    uint        `json:"io_id"`
@@ -395,7 +707,7 @@ func (watermark watermark) toStep() interface{} {
 		watermark.Gravity = watermark.Gravity.(ConstraintGravity).toGravity()
 	}
 	if watermark.Hints != nil {
-		watermark.Hints = watermark.Hints.(ConstraintHint)
+		watermark.Hints = watermark.Hints.(ConstraintHint).toHint()
 	}
 	stepMap["watermark"] = watermark
 	return stepMap
@@ -438,8 +750,19 @@ type DrawExact struct {
 	Hints interface{} `json:"hints"`
 }
 
+// validate rejects unknown filters and policies in ConstraintHint hints
+func (rect DrawExact) validate() error {
+	if hint, ok := rect.Hints.(ConstraintHint); ok {
+		return hint.validate()
+	}
+	return nil
+}
+
 // toStep convert rect to copy
 func (rect DrawExact) toStep() interface{} {
+	if hint, ok := rect.Hints.(ConstraintHint); ok {
+		rect.Hints = hint.toHint()
+	}
 	rectMap := make(map[string]DrawExact)
 	rectMap["draw_image_exact"] = rect
 	return rectMap
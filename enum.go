@@ -0,0 +1,316 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ConstraintMode is the mode of a Constrain
+type ConstraintMode string
+
+const (
+	// ModeDistort resizes to exactly W x H, ignoring the aspect ratio
+	ModeDistort ConstraintMode = "distort"
+	// ModeWithin downscales so the image fits within W x H, it never upscales
+	ModeWithin ConstraintMode = "within"
+	// ModeFit scales up or down so the image fits within W x H
+	ModeFit ConstraintMode = "fit"
+	// ModeWithinCrop downscales and crops to W x H, it never upscales
+	ModeWithinCrop ConstraintMode = "within_crop"
+	// ModeFitCrop scales up or down and crops to W x H
+	ModeFitCrop ConstraintMode = "fit_crop"
+	// ModeAspectCrop crops to the aspect ratio of W x H without scaling
+	ModeAspectCrop ConstraintMode = "aspect_crop"
+	// ModeWithinPad downscales within W x H and pads to exactly W x H, it never upscales
+	ModeWithinPad ConstraintMode = "within_pad"
+	// ModeFitPad scales up or down within W x H and pads to exactly W x H
+	ModeFitPad ConstraintMode = "fit_pad"
+	// ModeLargerThan upscales so the image is at least W x H, it never downscales
+	ModeLargerThan ConstraintMode = "larger_than"
+)
+
+var constraintModes = []string{"distort", "within", "fit", "within_crop", "fit_crop", "aspect_crop", "within_pad", "fit_pad", "larger_than"}
+
+// ParseConstraintMode returns the ConstraintMode named s
+func ParseConstraintMode(s string) (ConstraintMode, error) {
+	value, err := parseEnum("constraint mode", constraintModes, s)
+	return ConstraintMode(value), err
+}
+
+// String returns the name of the mode
+func (mode ConstraintMode) String() string {
+	return string(mode)
+}
+
+// MarshalJSON implements json.Marshaler
+func (mode ConstraintMode) MarshalJSON() ([]byte, error) {
+	return marshalEnum("constraint mode", constraintModes, string(mode))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (mode *ConstraintMode) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("constraint mode", constraintModes, data)
+	*mode = ConstraintMode(value)
+	return err
+}
+
+// Filter is a resampling filter
+type Filter string
+
+const (
+	// FilterRobidouxFast is a faster, less accurate version of robidoux
+	FilterRobidouxFast Filter = "robidoux_fast"
+	// FilterRobidoux is the default and suggested downsampling filter
+	FilterRobidoux Filter = "robidoux"
+	// FilterRobidouxSharp is a sharper version of robidoux
+	FilterRobidouxSharp Filter = "robidoux_sharp"
+	// FilterGinseng is the default and suggested upsampling filter
+	FilterGinseng Filter = "ginseng"
+	// FilterGinsengSharp is a sharper version of ginseng
+	FilterGinsengSharp Filter = "ginseng_sharp"
+	// FilterLanczos is Lanczos-3, sharp with some ringing
+	FilterLanczos Filter = "lanczos"
+	// FilterLanczosSharp is a sharper version of lanczos
+	FilterLanczosSharp Filter = "lanczos_sharp"
+	// FilterLanczos2 is Lanczos-2, softer than lanczos with less ringing
+	FilterLanczos2 Filter = "lanczos_2"
+	// FilterLanczos2Sharp is a sharper version of lanczos_2
+	FilterLanczos2Sharp Filter = "lanczos_2_sharp"
+	// FilterCubic is a general cubic filter
+	FilterCubic Filter = "cubic"
+	// FilterCubicSharp is a sharper version of cubic
+	FilterCubicSharp Filter = "cubic_sharp"
+	// FilterCatmullRom is the Catmull-Rom spline, a sharp cubic
+	FilterCatmullRom Filter = "catmull_rom"
+	// FilterMitchell is the Mitchell-Netravali cubic, balancing blur and ringing
+	FilterMitchell Filter = "mitchell"
+	// FilterCubicBSpline is the cubic B-spline, smooth but blurry
+	FilterCubicBSpline Filter = "cubic_b_spline"
+	// FilterHermite is a smooth cubic without ringing
+	FilterHermite Filter = "hermite"
+	// FilterJinc is a radial filter based on the jinc function
+	FilterJinc Filter = "jinc"
+	// FilterTriangle weighs neighbours with a triangle
+	FilterTriangle Filter = "triangle"
+	// FilterLinear is linear interpolation
+	FilterLinear Filter = "linear"
+	// FilterBox averages the pixels covered by each output pixel
+	FilterBox Filter = "box"
+	// FilterFastest trades quality for speed
+	FilterFastest Filter = "fastest"
+	// FilterNCubic is the n-cubic filter
+	FilterNCubic Filter = "n_cubic"
+	// FilterNCubicSharp is a sharper version of n_cubic
+	FilterNCubicSharp Filter = "n_cubic_sharp"
+)
+
+var filters = []string{
+	"robidoux_fast", "robidoux", "robidoux_sharp", "ginseng", "ginseng_sharp",
+	"lanczos", "lanczos_sharp", "lanczos_2", "lanczos_2_sharp", "cubic", "cubic_sharp",
+	"catmull_rom", "mitchell", "cubic_b_spline", "hermite", "jinc", "triangle",
+	"linear", "box", "fastest", "n_cubic", "n_cubic_sharp",
+}
+
+// ParseFilter returns the Filter named s
+func ParseFilter(s string) (Filter, error) {
+	value, err := parseEnum("filter", filters, s)
+	return Filter(value), err
+}
+
+// String returns the name of the filter
+func (filter Filter) String() string {
+	return string(filter)
+}
+
+// MarshalJSON implements json.Marshaler
+func (filter Filter) MarshalJSON() ([]byte, error) {
+	return marshalEnum("filter", filters, string(filter))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (filter *Filter) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("filter", filters, data)
+	*filter = Filter(value)
+	return err
+}
+
+// ScalingColorspace is the colorspace resampling is performed in
+type ScalingColorspace string
+
+const (
+	// ColorspaceLinear gives the best results
+	ColorspaceLinear ScalingColorspace = "linear"
+	// ColorspaceSRGB mimics poorly-written software and can destroy image highlights
+	ColorspaceSRGB ScalingColorspace = "srgb"
+)
+
+var scalingColorspaces = []string{"linear", "srgb"}
+
+// ParseScalingColorspace returns the ScalingColorspace named s
+func ParseScalingColorspace(s string) (ScalingColorspace, error) {
+	value, err := parseEnum("scaling colorspace", scalingColorspaces, s)
+	return ScalingColorspace(value), err
+}
+
+// String returns the name of the colorspace
+func (colorspace ScalingColorspace) String() string {
+	return string(colorspace)
+}
+
+// MarshalJSON implements json.Marshaler
+func (colorspace ScalingColorspace) MarshalJSON() ([]byte, error) {
+	return marshalEnum("scaling colorspace", scalingColorspaces, string(colorspace))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (colorspace *ScalingColorspace) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("scaling colorspace", scalingColorspaces, data)
+	*colorspace = ScalingColorspace(value)
+	return err
+}
+
+// ResampleWhen is the policy for when to resample
+type ResampleWhen string
+
+const (
+	// ResampleSizeDiffers resamples only when the size changes
+	ResampleSizeDiffers ResampleWhen = "size_differs"
+	// ResampleSizeDiffersOrSharpeningRequested resamples when the size changes or sharpening is requested
+	ResampleSizeDiffersOrSharpeningRequested ResampleWhen = "size_differs_or_sharpening_requested"
+	// ResampleAlways always resamples
+	ResampleAlways ResampleWhen = "always"
+)
+
+var resampleWhens = []string{"size_differs", "size_differs_or_sharpening_requested", "always"}
+
+// ParseResampleWhen returns the ResampleWhen named s
+func ParseResampleWhen(s string) (ResampleWhen, error) {
+	value, err := parseEnum("resample_when", resampleWhens, s)
+	return ResampleWhen(value), err
+}
+
+// String returns the name of the policy
+func (when ResampleWhen) String() string {
+	return string(when)
+}
+
+// MarshalJSON implements json.Marshaler
+func (when ResampleWhen) MarshalJSON() ([]byte, error) {
+	return marshalEnum("resample_when", resampleWhens, string(when))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (when *ResampleWhen) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("resample_when", resampleWhens, data)
+	*when = ResampleWhen(value)
+	return err
+}
+
+// SharpenWhen is the policy for when to sharpen
+type SharpenWhen string
+
+const (
+	// SharpenDownscaling sharpens only when downscaling
+	SharpenDownscaling SharpenWhen = "downscaling"
+	// SharpenUpscaling sharpens only when upscaling
+	SharpenUpscaling SharpenWhen = "upscaling"
+	// SharpenSizeDiffers sharpens when the size changes
+	SharpenSizeDiffers SharpenWhen = "size_differs"
+	// SharpenAlways always sharpens
+	SharpenAlways SharpenWhen = "always"
+)
+
+var sharpenWhens = []string{"downscaling", "upscaling", "size_differs", "always"}
+
+// ParseSharpenWhen returns the SharpenWhen named s
+func ParseSharpenWhen(s string) (SharpenWhen, error) {
+	value, err := parseEnum("sharpen_when", sharpenWhens, s)
+	return SharpenWhen(value), err
+}
+
+// String returns the name of the policy
+func (when SharpenWhen) String() string {
+	return string(when)
+}
+
+// MarshalJSON implements json.Marshaler
+func (when SharpenWhen) MarshalJSON() ([]byte, error) {
+	return marshalEnum("sharpen_when", sharpenWhens, string(when))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (when *SharpenWhen) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("sharpen_when", sharpenWhens, data)
+	*when = SharpenWhen(value)
+	return err
+}
+
+// PixelFormat is the memory layout of a canvas
+type PixelFormat string
+
+const (
+	// PixelBGRA32 has an alpha channel
+	PixelBGRA32 PixelFormat = "bgra_32"
+	// PixelBGR32 is opaque with a padding byte per pixel
+	PixelBGR32 PixelFormat = "bgr_32"
+	// PixelBGR24 is opaque
+	PixelBGR24 PixelFormat = "bgr_24"
+	// PixelGray8 is a single gray channel
+	PixelGray8 PixelFormat = "gray_8"
+)
+
+var pixelFormats = []string{"bgra_32", "bgr_32", "bgr_24", "gray_8"}
+
+// ParsePixelFormat returns the PixelFormat named s
+func ParsePixelFormat(s string) (PixelFormat, error) {
+	value, err := parseEnum("pixel format", pixelFormats, s)
+	return PixelFormat(value), err
+}
+
+// String returns the name of the pixel format
+func (format PixelFormat) String() string {
+	return string(format)
+}
+
+// MarshalJSON implements json.Marshaler
+func (format PixelFormat) MarshalJSON() ([]byte, error) {
+	return marshalEnum("pixel format", pixelFormats, string(format))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (format *PixelFormat) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("pixel format", pixelFormats, data)
+	*format = PixelFormat(value)
+	return err
+}
+
+func parseEnum(kind string, values []string, s string) (string, error) {
+	for _, value := range values {
+		if value == s {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("imageflow: invalid %s %q", kind, s)
+}
+
+// marshalEnum serializes the zero value as null so libimageflow uses its default
+func marshalEnum(kind string, values []string, s string) ([]byte, error) {
+	if s == "" {
+		return []byte("null"), nil
+	}
+	if _, err := parseEnum(kind, values, s); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+func unmarshalEnum(kind string, values []string, data []byte) (string, error) {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	if s == nil {
+		return "", nil
+	}
+	return parseEnum(kind, values, *s)
+}
@@ -0,0 +1,249 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ImageFormat is an image file format
+type ImageFormat string
+
+const (
+	FormatJPEG ImageFormat = "jpeg"
+	FormatPNG  ImageFormat = "png"
+	FormatGIF  ImageFormat = "gif"
+	FormatWebP ImageFormat = "webp"
+	FormatAVIF ImageFormat = "avif"
+	FormatJXL  ImageFormat = "jxl"
+)
+
+var imageFormats = []string{"jpeg", "png", "gif", "webp", "avif", "jxl"}
+
+var mimeTypes = map[ImageFormat]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatGIF:  "image/gif",
+	FormatWebP: "image/webp",
+	FormatAVIF: "image/avif",
+	FormatJXL:  "image/jxl",
+}
+
+var extensions = map[ImageFormat]string{
+	FormatJPEG: "jpg",
+	FormatPNG:  "png",
+	FormatGIF:  "gif",
+	FormatWebP: "webp",
+	FormatAVIF: "avif",
+	FormatJXL:  "jxl",
+}
+
+// ParseImageFormat returns the ImageFormat named s, jpg is accepted for jpeg
+func ParseImageFormat(s string) (ImageFormat, error) {
+	if s == "jpg" {
+		return FormatJPEG, nil
+	}
+	value, err := parseEnum("image format", imageFormats, s)
+	return ImageFormat(value), err
+}
+
+// formatFromMimeType returns the ImageFormat of a MIME type
+func formatFromMimeType(mime string) ImageFormat {
+	for format, value := range mimeTypes {
+		if value == mime {
+			return format
+		}
+	}
+	return ""
+}
+
+// presetFormat returns the format a preset encodes to, ok is false for presets like Auto which choose at runtime
+func presetFormat(preset presetInterface) (ImageFormat, bool) {
+	switch preset := preset.(type) {
+	case MozJPEG, LibJPEGTurbo:
+		return FormatJPEG, true
+	case LosslessPNG, LossyPNG, LibPNG:
+		return FormatPNG, true
+	case WebP, WebPLossless:
+		return FormatWebP, true
+	case GIF:
+		return FormatGIF, true
+	case FormatProfile:
+		return preset.Format, preset.Format != ""
+	}
+	return "", false
+}
+
+// String returns the name of the format
+func (format ImageFormat) String() string {
+	return string(format)
+}
+
+// MimeType returns the MIME type of the format
+func (format ImageFormat) MimeType() string {
+	return mimeTypes[format]
+}
+
+// Extension returns the usual file extension of the format, without a dot
+func (format ImageFormat) Extension() string {
+	return extensions[format]
+}
+
+// MarshalJSON implements json.Marshaler
+func (format ImageFormat) MarshalJSON() ([]byte, error) {
+	return marshalEnum("image format", imageFormats, string(format))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (format *ImageFormat) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("image format", imageFormats, data)
+	*format = ImageFormat(value)
+	return err
+}
+
+// QualityProfile is a format independent quality level
+type QualityProfile string
+
+const (
+	QualityLowest    QualityProfile = "lowest"
+	QualityLow       QualityProfile = "low"
+	QualityMediumLow QualityProfile = "medium_low"
+	QualityMedium    QualityProfile = "medium"
+	QualityGood      QualityProfile = "good"
+	QualityHigh      QualityProfile = "high"
+	QualityHighest   QualityProfile = "highest"
+	QualityLossless  QualityProfile = "lossless"
+)
+
+var qualityProfiles = []string{"lowest", "low", "medium_low", "medium", "good", "high", "highest", "lossless"}
+
+// ParseQualityProfile returns the QualityProfile named s
+func ParseQualityProfile(s string) (QualityProfile, error) {
+	value, err := parseEnum("quality profile", qualityProfiles, s)
+	return QualityProfile(value), err
+}
+
+// String returns the name of the profile
+func (profile QualityProfile) String() string {
+	return string(profile)
+}
+
+// MarshalJSON implements json.Marshaler
+func (profile QualityProfile) MarshalJSON() ([]byte, error) {
+	return marshalEnum("quality profile", qualityProfiles, string(profile))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (profile *QualityProfile) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("quality profile", qualityProfiles, data)
+	*profile = QualityProfile(value)
+	return err
+}
+
+// LosslessPreference is whether a lossless format should be used
+type LosslessPreference string
+
+const (
+	// LosslessKeep uses a lossless format if the source image is lossless
+	LosslessKeep LosslessPreference = "keep"
+	// LosslessAlways always uses a lossless format
+	LosslessAlways LosslessPreference = "true"
+	// LosslessNever always uses a lossy format
+	LosslessNever LosslessPreference = "false"
+)
+
+var losslessPreferences = []string{"keep", "true", "false"}
+
+// String returns the name of the preference
+func (preference LosslessPreference) String() string {
+	return string(preference)
+}
+
+// MarshalJSON implements json.Marshaler
+func (preference LosslessPreference) MarshalJSON() ([]byte, error) {
+	return marshalEnum("lossless preference", losslessPreferences, string(preference))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (preference *LosslessPreference) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum("lossless preference", losslessPreferences, data)
+	*preference = LosslessPreference(value)
+	return err
+}
+
+// allowedFormats converts a list of formats to imageflow's allow object
+// Formats not in the list are disallowed, an empty list leaves the choice to libimageflow.
+func allowedFormats(formats []ImageFormat, colorProfiles bool) (interface{}, error) {
+	if len(formats) == 0 && !colorProfiles {
+		return nil, nil
+	}
+	allow := make(map[string]interface{})
+	if len(formats) > 0 {
+		for _, name := range imageFormats {
+			allow[name] = false
+		}
+		for _, format := range formats {
+			if _, err := parseEnum("image format", imageFormats, string(format)); err != nil {
+				return nil, err
+			}
+			allow[string(format)] = true
+		}
+	}
+	if colorProfiles {
+		allow["color_profiles"] = true
+	}
+	return allow, nil
+}
+
+// Auto lets libimageflow choose the output format
+// The format is chosen from Allow based on whether the image has alpha, the source format and its size.
+// Allow The formats that may be used, empty means the web-safe formats jpeg, png and gif
+// AllowColorProfiles Whether formats that keep color profiles may be chosen
+// QualityProfile The quality to encode with, default QualityHigh
+// QualityProfileDPR The device pixel ratio the image is displayed at, higher ratios permit lower quality
+// Lossless Whether to use a lossless format
+// Matte See Color. The background to flatten alpha onto if the chosen format has no alpha channel.
+// Use ExecuteWithResult to find out which format was chosen.
+type Auto struct {
+	Allow              []ImageFormat
+	AllowColorProfiles bool
+	QualityProfile     QualityProfile
+	QualityProfileDPR  float32
+	Lossless           LosslessPreference
+	Matte              Color
+}
+
+// toPreset is used to convert Auto to preset
+func (preset Auto) toPreset() interface{} {
+	profile := preset.QualityProfile
+	if profile == "" {
+		profile = QualityHigh
+	}
+	autoMap := map[string]interface{}{
+		"quality_profile": profile,
+		"lossless":        preset.Lossless,
+	}
+	autoMap["allow"], _ = allowedFormats(preset.Allow, preset.AllowColorProfiles)
+	if preset.QualityProfileDPR != 0 {
+		autoMap["quality_profile_dpr"] = preset.QualityProfileDPR
+	}
+	if preset.Matte != nil {
+		autoMap["matte"] = preset.Matte.toColor()
+	}
+	return singleMap("auto", autoMap)
+}
+
+// validate rejects unknown formats and profiles
+func (preset Auto) validate() error {
+	if _, err := allowedFormats(preset.Allow, preset.AllowColorProfiles); err != nil {
+		return err
+	}
+	if preset.QualityProfileDPR < 0 {
+		return fmt.Errorf("imageflow: invalid quality profile dpr %v", preset.QualityProfileDPR)
+	}
+	for _, value := range []json.Marshaler{preset.QualityProfile, preset.Lossless} {
+		if _, err := value.MarshalJSON(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GraphRecording enables imageflow's native graph_recording debug output.
+// RecordFrameImages writes a frame image for every node into the node_frames directory beneath the process working directory.
+// RecordGraphVersions and RenderGraphVersions write each version of the graph as it is optimized.
+// RenderLastGraph renders the final graph, RenderAnimatedGraph renders all versions as an animation.
+type GraphRecording struct {
+	RecordGraphVersions bool `json:"record_graph_versions"`
+	RecordFrameImages   bool `json:"record_frame_images"`
+	RenderLastGraph     bool `json:"render_last_graph"`
+	RenderGraphVersions bool `json:"render_graph_versions"`
+	RenderAnimatedGraph bool `json:"render_animated_graph"`
+}
+
+// GraphRecording turns on native debug recording for the job
+func (steps *Steps) GraphRecording(recording GraphRecording) *Steps {
+	steps.recording = &recording
+	return steps
+}
+
+// ToDOT renders the graph in Graphviz DOT format
+// Each vertex is labeled with its operation name and key parameters, each edge with its kind.
+func (steps *Steps) ToDOT() string {
+	var builder strings.Builder
+	builder.WriteString("digraph imageflow {\n")
+	builder.WriteString("  node [shape=box];\n")
+	for i := 0; i < len(steps.vertex); i++ {
+		name, params := describeVertex(steps.vertex[i])
+		label := strings.Join(append([]string{name}, params...), "\n")
+		fmt.Fprintf(&builder, "  n%d [label=%s];\n", i, dotQuote(label))
+	}
+	for _, e := range steps.innerGraph.edges {
+		style := ""
+		if e.Kind == "canvas" {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&builder, "  n%d -> n%d [label=%s%s];\n", e.From, e.To, dotQuote(e.Kind), style)
+	}
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// ToMermaid renders the graph as a Mermaid flowchart
+// Each vertex is labeled with its operation name and key parameters, each edge with its kind.
+func (steps *Steps) ToMermaid() string {
+	var builder strings.Builder
+	builder.WriteString("flowchart TD\n")
+	for i := 0; i < len(steps.vertex); i++ {
+		name, params := describeVertex(steps.vertex[i])
+		lines := append([]string{name}, params...)
+		for j := range lines {
+			lines[j] = mermaidEscape(lines[j])
+		}
+		fmt.Fprintf(&builder, "  n%d[\"%s\"]\n", i, strings.Join(lines, "<br/>"))
+	}
+	for _, e := range steps.innerGraph.edges {
+		arrow := "-->"
+		if e.Kind == "canvas" {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(&builder, "  n%d %s|%s| n%d\n", e.From, arrow, e.Kind, e.To)
+	}
+	return builder.String()
+}
+
+// describeVertex returns the operation name of a vertex and its non-null parameters as key=value pairs
+func describeVertex(vertex interface{}) (string, []string) {
+	js, err := json.Marshal(vertex)
+	if err != nil {
+		return "invalid", []string{err.Error()}
+	}
+	var generic interface{}
+	if err := json.Unmarshal(js, &generic); err != nil {
+		return "invalid", []string{err.Error()}
+	}
+	switch node := generic.(type) {
+	case string:
+		return node, nil
+	case map[string]interface{}:
+		if len(node) != 1 {
+			return string(js), nil
+		}
+		for name, value := range node {
+			return name, describeParams(value)
+		}
+	}
+	return string(js), nil
+}
+
+func describeParams(value interface{}) []string {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		if value == nil {
+			return nil
+		}
+		return []string{compactJSON(value)}
+	}
+	keys := make([]string, 0, len(fields))
+	for key, field := range fields {
+		if field != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		params = append(params, key+"="+compactJSON(fields[key]))
+	}
+	return params
+}
+
+func compactJSON(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	js, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(js)
+}
+
+func dotQuote(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+func mermaidEscape(s string) string {
+	replacer := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	return replacer.Replace(s)
+}
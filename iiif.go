@@ -0,0 +1,442 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IIIFError is a IIIF request which cannot be served
+// Status is the HTTP status the Image API requires, 400 for invalid requests and 501 for unsupported features.
+type IIIFError struct {
+	Status  int
+	Message string
+}
+
+func (err *IIIFError) Error() string {
+	return fmt.Sprintf("imageflow: iiif %d: %s", err.Status, err.Message)
+}
+
+func iiifBadRequest(format string, args ...interface{}) error {
+	return &IIIFError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func iiifNotImplemented(format string, args ...interface{}) error {
+	return &IIIFError{Status: http.StatusNotImplemented, Message: fmt.Sprintf(format, args...)}
+}
+
+// IIIFRegion is the region parameter of a IIIF request
+// Full and Square are the keywords, otherwise X, Y, W and H are pixels or, if Percent, percentages.
+type IIIFRegion struct {
+	Full    bool
+	Square  bool
+	Percent bool
+	X       float64
+	Y       float64
+	W       float64
+	H       float64
+}
+
+// IIIFSize is the size parameter of a IIIF request
+// Max is max, Percent is pct:Scale, otherwise W and H are pixels and 0 when omitted.
+// Confined is the ! prefix, scaling to fit within W and H. Upscale is the ^ prefix.
+type IIIFSize struct {
+	Max      bool
+	Upscale  bool
+	Confined bool
+	Percent  bool
+	Scale    float64
+	W        int
+	H        int
+}
+
+// IIIFRequest is a parsed IIIF Image API 3.0 request
+// Rotation is 0, 90, 180 or 270 degrees clockwise, Mirror flips the image horizontally before rotating.
+// Quality is default, color or gray.
+type IIIFRequest struct {
+	Identifier string
+	Region     IIIFRegion
+	Size       IIIFSize
+	Rotation   int
+	Mirror     bool
+	Quality    string
+	Format     ImageFormat
+}
+
+// IIIFOptions are the limits and encoders of a IIIF service
+// MaxWidth, MaxHeight and MaxArea limit the size of responses, 0 is unlimited.
+// Presets replaces the encoder of a format, the defaults are MozJPEG, LosslessPNG, GIF and WebP.
+type IIIFOptions struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int
+	Presets   map[ImageFormat]presetInterface
+}
+
+var iiifFormats = map[string]ImageFormat{"jpg": FormatJPEG, "png": FormatPNG, "gif": FormatGIF, "webp": FormatWebP}
+
+// ParseIIIFRequest parses {identifier}/{region}/{size}/{rotation}/{quality}.{format}
+// The identifier is optional and may contain escaped slashes. Errors are *IIIFError.
+func ParseIIIFRequest(path string) (*IIIFRequest, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 4 {
+		return nil, iiifBadRequest("expected {region}/{size}/{rotation}/{quality}.{format}, got %q", path)
+	}
+	params := segments[len(segments)-4:]
+	request := &IIIFRequest{}
+	if identifier := strings.Join(segments[:len(segments)-4], "/"); identifier != "" {
+		unescaped, err := url.PathUnescape(identifier)
+		if err != nil {
+			return nil, iiifBadRequest("invalid identifier %q", identifier)
+		}
+		request.Identifier = unescaped
+	}
+
+	var err error
+	if request.Region, err = parseIIIFRegion(params[0]); err != nil {
+		return nil, err
+	}
+	if request.Size, err = parseIIIFSize(params[1]); err != nil {
+		return nil, err
+	}
+	if request.Rotation, request.Mirror, err = parseIIIFRotation(params[2]); err != nil {
+		return nil, err
+	}
+	quality, extension, found := strings.Cut(params[3], ".")
+	if !found {
+		return nil, iiifBadRequest("missing format in %q", params[3])
+	}
+	switch quality {
+	case "default", "color", "gray":
+		request.Quality = quality
+	case "bitonal":
+		return nil, iiifNotImplemented("quality bitonal is not supported")
+	default:
+		return nil, iiifBadRequest("invalid quality %q", quality)
+	}
+	format, ok := iiifFormats[extension]
+	if !ok {
+		if extension == "tif" || extension == "jp2" || extension == "pdf" {
+			return nil, iiifNotImplemented("format %s is not supported", extension)
+		}
+		return nil, iiifBadRequest("invalid format %q", extension)
+	}
+	request.Format = format
+	return request, nil
+}
+
+// parseIIIFNumbers parses n comma separated non-negative numbers, integers unless decimals is set
+func parseIIIFNumbers(s string, n int, decimals bool) ([]float64, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		var err error
+		if decimals {
+			values[i], err = strconv.ParseFloat(part, 64)
+		} else {
+			var value int
+			value, err = strconv.Atoi(part)
+			values[i] = float64(value)
+		}
+		if err != nil || !(values[i] >= 0) || math.IsInf(values[i], 0) || strings.HasPrefix(part, "+") {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func parseIIIFRegion(s string) (IIIFRegion, error) {
+	switch s {
+	case "full":
+		return IIIFRegion{Full: true}, nil
+	case "square":
+		return IIIFRegion{Square: true}, nil
+	}
+	region := IIIFRegion{}
+	numbers := s
+	if strings.HasPrefix(s, "pct:") {
+		region.Percent = true
+		numbers = strings.TrimPrefix(s, "pct:")
+	}
+	values, ok := parseIIIFNumbers(numbers, 4, region.Percent)
+	if !ok {
+		return region, iiifBadRequest("invalid region %q", s)
+	}
+	region.X, region.Y, region.W, region.H = values[0], values[1], values[2], values[3]
+	if region.W == 0 || region.H == 0 {
+		return region, iiifBadRequest("region %q is empty", s)
+	}
+	return region, nil
+}
+
+func parseIIIFSize(s string) (IIIFSize, error) {
+	size := IIIFSize{}
+	rest := s
+	if strings.HasPrefix(rest, "^") {
+		size.Upscale = true
+		rest = rest[1:]
+	}
+	switch {
+	case rest == "max":
+		size.Max = true
+		return size, nil
+	case strings.HasPrefix(rest, "pct:"):
+		values, ok := parseIIIFNumbers(strings.TrimPrefix(rest, "pct:"), 1, true)
+		if !ok || values[0] == 0 {
+			return size, iiifBadRequest("invalid size %q", s)
+		}
+		size.Percent, size.Scale = true, values[0]
+		if size.Scale > 100 && !size.Upscale {
+			return size, iiifBadRequest("size %q upscales without ^", s)
+		}
+		return size, nil
+	case strings.HasPrefix(rest, "!"):
+		size.Confined = true
+		rest = rest[1:]
+	}
+
+	w, h, found := strings.Cut(rest, ",")
+	if !found || (w == "" && h == "") || (size.Confined && (w == "" || h == "")) {
+		return size, iiifBadRequest("invalid size %q", s)
+	}
+	for _, part := range []struct {
+		value  string
+		target *int
+	}{{w, &size.W}, {h, &size.H}} {
+		if part.value == "" {
+			continue
+		}
+		values, ok := parseIIIFNumbers(part.value, 1, false)
+		if !ok || values[0] == 0 {
+			return size, iiifBadRequest("invalid size %q", s)
+		}
+		*part.target = int(values[0])
+	}
+	return size, nil
+}
+
+func parseIIIFRotation(s string) (int, bool, error) {
+	mirror := strings.HasPrefix(s, "!")
+	values, ok := parseIIIFNumbers(strings.TrimPrefix(s, "!"), 1, true)
+	if !ok || values[0] > 360 {
+		return 0, false, iiifBadRequest("invalid rotation %q", s)
+	}
+	if math.Mod(values[0], 90) != 0 {
+		return 0, false, iiifNotImplemented("rotation %q is not a multiple of 90", s)
+	}
+	return int(values[0]) % 360, mirror, nil
+}
+
+// regionRect returns the region in pixels of a width x height image
+func (request *IIIFRequest) regionRect(width int, height int) (int, int, int, int, error) {
+	region := request.Region
+	var x, y, w, h float64
+	switch {
+	case region.Full:
+		return 0, 0, width, height, nil
+	case region.Square:
+		side := min(width, height)
+		return (width - side) / 2, (height - side) / 2, side, side, nil
+	case region.Percent:
+		x, y = region.X*float64(width)/100, region.Y*float64(height)/100
+		w, h = region.W*float64(width)/100, region.H*float64(height)/100
+	default:
+		x, y, w, h = region.X, region.Y, region.W, region.H
+	}
+	left, top := int(math.Round(x)), int(math.Round(y))
+	if left >= width || top >= height {
+		return 0, 0, 0, 0, iiifBadRequest("region is outside the %dx%d image", width, height)
+	}
+	right := min(int(math.Round(x+w)), width)
+	bottom := min(int(math.Round(y+h)), height)
+	if right <= left || bottom <= top {
+		return 0, 0, 0, 0, iiifBadRequest("region is empty")
+	}
+	return left, top, right - left, bottom - top, nil
+}
+
+// outputSize returns the size of the response for a regionW x regionH region
+func (request *IIIFRequest) outputSize(regionW int, regionH int, options IIIFOptions) (int, int, error) {
+	size := request.Size
+	rw, rh := float64(regionW), float64(regionH)
+	var w, h float64
+	switch {
+	case size.Max:
+		scale := 1.0
+		if size.Upscale {
+			scale = math.Inf(1)
+		}
+		scale = options.limitScale(scale, rw, rh)
+		if math.IsInf(scale, 1) {
+			scale = 1
+		}
+		w, h = rw*scale, rh*scale
+	case size.Percent:
+		w, h = rw*size.Scale/100, rh*size.Scale/100
+	case size.Confined:
+		scale := math.Min(float64(size.W)/rw, float64(size.H)/rh)
+		if !size.Upscale {
+			scale = math.Min(scale, 1)
+		}
+		w, h = rw*scale, rh*scale
+	case size.H == 0:
+		w, h = float64(size.W), float64(size.W)*rh/rw
+	case size.W == 0:
+		w, h = float64(size.H)*rw/rh, float64(size.H)
+	default:
+		w, h = float64(size.W), float64(size.H)
+	}
+	outW, outH := int(math.Round(w)), int(math.Round(h))
+	if size.Max {
+		// rounding up could break the limits max was scaled down to
+		outW, outH = int(math.Floor(w)), int(math.Floor(h))
+	}
+	if outW < 1 || outH < 1 {
+		return 0, 0, iiifBadRequest("size is empty")
+	}
+	if !size.Upscale && (outW > regionW || outH > regionH) {
+		return 0, 0, iiifBadRequest("size %dx%d is larger than the %dx%d region, use ^ to upscale", outW, outH, regionW, regionH)
+	}
+	if !size.Max && options.limitScale(1, float64(outW), float64(outH)) < 1 {
+		return 0, 0, iiifBadRequest("size %dx%d exceeds the limits of the service", outW, outH)
+	}
+	return outW, outH, nil
+}
+
+// limitScale returns scale, reduced so a w x h image scaled by it stays within the limits
+func (options IIIFOptions) limitScale(scale float64, w float64, h float64) float64 {
+	if options.MaxWidth > 0 {
+		scale = math.Min(scale, float64(options.MaxWidth)/w)
+	}
+	if options.MaxHeight > 0 {
+		scale = math.Min(scale, float64(options.MaxHeight)/h)
+	}
+	if options.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(options.MaxArea)/(w*h)))
+	}
+	return scale
+}
+
+// preset returns the encoder of the requested format
+func (request *IIIFRequest) preset(options IIIFOptions) presetInterface {
+	if preset, ok := options.Presets[request.Format]; ok {
+		return preset
+	}
+	switch request.Format {
+	case FormatPNG:
+		return LosslessPNG{}
+	case FormatGIF:
+		return GIF{}
+	case FormatWebP:
+		return WebP{Quality: 80}
+	}
+	return MozJPEG{}
+}
+
+// Build returns the steps serving the request from source, an image of width x height, into sink
+// Errors are *IIIFError.
+func (request *IIIFRequest) Build(width int, height int, source IO, sink IO, options IIIFOptions) (Steps, error) {
+	x, y, w, h, err := request.regionRect(width, height)
+	if err != nil {
+		return Steps{}, err
+	}
+	outW, outH, err := request.outputSize(w, h, options)
+	if err != nil {
+		return Steps{}, err
+	}
+
+	step := NewStep()
+	step.Decode(source)
+	switch {
+	case request.Region.Percent:
+		step.RegionPercentage(RegionPercentage{
+			X1: request.Region.X, Y1: request.Region.Y,
+			X2: math.Min(request.Region.X+request.Region.W, 100), Y2: math.Min(request.Region.Y+request.Region.H, 100),
+			BackgroundColor: Transparent(""),
+		})
+	case x != 0 || y != 0 || w != width || h != height:
+		step.Region(Region{
+			X1: float64(x), Y1: float64(y), X2: float64(x + w), Y2: float64(y + h),
+			BackgroundColor: Transparent(""),
+		})
+	}
+	if outW != w || outH != h || request.Region.Percent {
+		step.Constrain(Constrain{Mode: ModeDistort, W: float64(outW), H: float64(outH)})
+	}
+	if request.Mirror {
+		step.FlipH()
+	}
+	switch request.Rotation {
+	case 90:
+		step.Rotate90()
+	case 180:
+		step.Rotate180()
+	case 270:
+		step.Rotate270()
+	}
+	if request.Quality == "gray" {
+		step.GrayscaleBT709()
+	}
+	step.Encode(sink, request.preset(options))
+	return step, nil
+}
+
+// ExecuteIIIF serves a IIIF request path from source and returns the encoded image and its MIME type
+// Invalid and unsupported requests return a *IIIFError carrying the HTTP status.
+func ExecuteIIIF(path string, source IO, options IIIFOptions) ([]byte, string, error) {
+	request, err := ParseIIIFRequest(path)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := orientedImageInfo(data)
+	if err != nil {
+		return nil, "", err
+	}
+	out := &capture{}
+	step, err := request.Build(info.Width, info.Height, NewBuffer(data), out, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := step.Execute(); err != nil {
+		return nil, "", err
+	}
+	return out.data, request.Format.MimeType(), nil
+}
+
+// IIIFInfo returns the info.json of an image for a level 2 IIIF Image API 3.0 service
+// id is the base URI of the image, without a trailing slash.
+func IIIFInfo(id string, info ImageInfo, options IIIFOptions) ([]byte, error) {
+	document := map[string]interface{}{
+		"@context":       "http://iiif.io/api/image/3/context.json",
+		"id":             id,
+		"type":           "ImageService3",
+		"protocol":       "http://iiif.io/api/image",
+		"profile":        "level2",
+		"width":          info.Width,
+		"height":         info.Height,
+		"extraQualities": []string{"gray"},
+		"extraFormats":   []string{"gif", "webp"},
+		"extraFeatures":  []string{"mirroring", "sizeUpscaling"},
+	}
+	if options.MaxWidth > 0 {
+		document["maxWidth"] = options.MaxWidth
+	}
+	if options.MaxHeight > 0 {
+		document["maxHeight"] = options.MaxHeight
+	}
+	if options.MaxArea > 0 {
+		document["maxArea"] = options.MaxArea
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
@@ -0,0 +1,248 @@
+package imageflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestExecuteIIIF(t *testing.T) {
+	data := loadTestImage(t)
+	out, mime, err := ExecuteIIIF("photo/square/!100,100/!90/gray.png", NewBuffer(data), IIIFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/png" {
+		t.Errorf("unexpected mime type %q", mime)
+	}
+	frame, err := DecodeFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 100 || frame.Bounds().Dy() != 100 {
+		t.Errorf("expected 100x100, got %v", frame.Bounds())
+	}
+
+	_, _, err = ExecuteIIIF("full/99999,/0/default.jpg", NewBuffer(data), IIIFOptions{})
+	var iiifErr *IIIFError
+	if !errors.As(err, &iiifErr) || iiifErr.Status != 400 {
+		t.Errorf("expected a 400 for upscaling without ^, got %v", err)
+	}
+}
+
+// rotatedJPEG returns a w x h JPEG with EXIF orientation 6, which decodes to h x w
+func rotatedJPEG(t *testing.T, w int, h int) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, 0x00, byte(len(segment) + 2)}, segment...)
+	data := buffer.Bytes()
+	rotated := append(append([]byte{}, data[:2]...), app1...)
+	rotated = append(rotated, data[2:]...)
+	if jpegOrientation(rotated) != 6 {
+		t.Fatal("the fixture has no EXIF orientation")
+	}
+	return rotated
+}
+
+func TestExecuteIIIFOrientation(t *testing.T) {
+	data := rotatedJPEG(t, 200, 100)
+	for path, expected := range map[string]image.Point{
+		"full/max/0/default.png":          {X: 100, Y: 200},
+		"full/,100/0/default.png":         {X: 50, Y: 100},
+		"0,100,100,100/max/0/default.png": {X: 100, Y: 100},
+	} {
+		out, _, err := ExecuteIIIF(path, NewBuffer(data), IIIFOptions{})
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		frame, err := DecodeFrame(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Bounds().Size() != expected {
+			t.Errorf("%s: expected %v, got %v", path, expected, frame.Bounds().Size())
+		}
+	}
+}
+
+func TestParseIIIFRequest(t *testing.T) {
+	request, err := ParseIIIFRequest("/iiif/3/ark:%2F12025%2Fabc/pct:10,20,50.5,30/^!300,200/!270/gray.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := IIIFRequest{
+		Identifier: "iiif/3/ark:/12025/abc",
+		Region:     IIIFRegion{Percent: true, X: 10, Y: 20, W: 50.5, H: 30},
+		Size:       IIIFSize{Upscale: true, Confined: true, W: 300, H: 200},
+		Rotation:   270,
+		Mirror:     true,
+		Quality:    "gray",
+		Format:     FormatWebP,
+	}
+	if *request != expected {
+		t.Errorf("expected %+v, got %+v", expected, *request)
+	}
+
+	for path, size := range map[string]IIIFSize{
+		"full/max/0/default.jpg":    {Max: true},
+		"full/^max/0/default.jpg":   {Max: true, Upscale: true},
+		"full/150,/0/default.jpg":   {W: 150},
+		"full/,150/0/default.jpg":   {H: 150},
+		"full/pct:50/0/default.jpg": {Percent: true, Scale: 50},
+		"full/225,100/0/color.jpg":  {W: 225, H: 100},
+	} {
+		request, err := ParseIIIFRequest(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if request.Size != size || request.Identifier != "" || !request.Region.Full {
+			t.Errorf("%s: unexpected %+v", path, request)
+		}
+	}
+}
+
+func TestParseIIIFRequestErrors(t *testing.T) {
+	for path, status := range map[string]int{
+		"max/0/default.jpg":              400,
+		"full/max/0/default":             400,
+		"full/max/0/default.bmp":         400,
+		"full/max/0/sepia.jpg":           400,
+		"all/max/0/default.jpg":          400,
+		"1,2,3/max/0/default.jpg":        400,
+		"0,0,0,10/max/0/default.jpg":     400,
+		"-1,0,10,10/max/0/default.jpg":   400,
+		"full/full/0/default.jpg":        400,
+		"full/,/0/default.jpg":           400,
+		"full/!100,/0/default.jpg":       400,
+		"full/0,100/0/default.jpg":       400,
+		"full/pct:150/0/default.jpg":     400,
+		"full/pct:NaN/0/default.jpg":     400,
+		"full/max/400/default.jpg":       400,
+		"full/max/x/default.jpg":         400,
+		"full/max/45/default.jpg":        501,
+		"full/max/0/bitonal.jpg":         501,
+		"full/max/0/default.jp2":         501,
+		"full/max/0/default.tif":         501,
+		"pct:0,0,100,100/max/0/gray.pdf": 501,
+	} {
+		_, err := ParseIIIFRequest(path)
+		var iiifErr *IIIFError
+		if !errors.As(err, &iiifErr) || iiifErr.Status != status {
+			t.Errorf("%s: expected status %d, got %v", path, status, err)
+		}
+	}
+}
+
+func TestIIIFSizes(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		options IIIFOptions
+		x, y    int
+		w, h    int
+		outW    int
+		outH    int
+	}{
+		{"full/max/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 1000, 600},
+		{"full/max/0/default.jpg", IIIFOptions{MaxWidth: 500}, 0, 0, 1000, 600, 500, 300},
+		{"full/^max/0/default.jpg", IIIFOptions{MaxArea: 2400000}, 0, 0, 1000, 600, 2000, 1200},
+		{"full/max/0/default.jpg", IIIFOptions{MaxArea: 500001}, 0, 0, 1000, 600, 912, 547},
+		{"full/^max/0/default.jpg", IIIFOptions{MaxArea: 500001}, 0, 0, 1000, 600, 912, 547},
+		{"square/max/0/default.jpg", IIIFOptions{}, 200, 0, 600, 600, 600, 600},
+		{"125,15,120,140/90,/0/default.jpg", IIIFOptions{}, 125, 15, 120, 140, 90, 105},
+		{"900,500,200,200/max/0/default.jpg", IIIFOptions{}, 900, 500, 100, 100, 100, 100},
+		{"pct:10,10,80,80/,240/0/default.jpg", IIIFOptions{}, 100, 60, 800, 480, 400, 240},
+		{"full/pct:25/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 250, 150},
+		{"full/!300,300/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 300, 180},
+		{"full/^!3000,3000/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 3000, 1800},
+		{"full/!3000,3000/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 1000, 600},
+		{"full/^1500,100/0/default.jpg", IIIFOptions{}, 0, 0, 1000, 600, 1500, 100},
+	} {
+		request, err := ParseIIIFRequest(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y, w, h, err := request.regionRect(1000, 600)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		outW, outH, err := request.outputSize(w, h, test.options)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if x != test.x || y != test.y || w != test.w || h != test.h || outW != test.outW || outH != test.outH {
+			t.Errorf("%s: got region %d,%d,%d,%d size %dx%d", test.path, x, y, w, h, outW, outH)
+		}
+	}
+
+	for path, options := range map[string]IIIFOptions{
+		"1000,0,10,10/max/0/default.jpg": {},
+		"full/2000,/0/default.jpg":       {},
+		"full/800,/0/default.jpg":        {MaxWidth: 500},
+		"full/max/0/default.jpg":         {},
+	} {
+		request, _ := ParseIIIFRequest(path)
+		_, err := request.Build(1000, 600, NewBuffer(nil), GetBuffer("out"), options)
+		if path == "full/max/0/default.jpg" {
+			if err != nil {
+				t.Errorf("%s: %v", path, err)
+			}
+			continue
+		}
+		var iiifErr *IIIFError
+		if !errors.As(err, &iiifErr) || iiifErr.Status != 400 {
+			t.Errorf("%s: expected status 400, got %v", path, err)
+		}
+	}
+}
+
+func TestIIIFBuild(t *testing.T) {
+	request, _ := ParseIIIFRequest("10,20,300,200/150,/!90/gray.png")
+	step, err := request.Build(1000, 600, NewBuffer(nil), GetBuffer("out"), IIIFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`"region":{"x1":10,"y1":20,"x2":310,"y2":220`,
+		`"constrain":{"mode":"distort","w":150,"h":100`,
+		`"flip_h"`,
+		`"rotate_90"`,
+		`"color_filter_srgb":"grayscale_bt709"`,
+		`"lodepng"`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+	}
+}
+
+func TestIIIFInfo(t *testing.T) {
+	data, err := IIIFInfo("https://example.org/iiif/photo", ImageInfo{Width: 1000, Height: 600}, IIIFOptions{MaxWidth: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info["id"] != "https://example.org/iiif/photo" || info["type"] != "ImageService3" || info["profile"] != "level2" ||
+		info["width"] != 1000.0 || info["maxWidth"] != 2000.0 || info["maxArea"] != nil {
+		t.Errorf("unexpected info.json %s", data)
+	}
+}
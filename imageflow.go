@@ -3,6 +3,7 @@ package imageflow
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 // Steps is the builder for creating a operation
@@ -13,20 +14,50 @@ type Steps struct {
 	last       uint
 	innerGraph graph
 	ioID       int
+	recording  *GraphRecording
+	smallest   []smallestGroup
+	err        error
 }
 
 // Decode is used to import a image
 func (steps *Steps) Decode(task ioOperation) *Steps {
+	return steps.DecodeWithOptions(task, DecodeOptions{})
+}
+
+// DecodeWithOptions is used to import a image with decoder commands
+func (steps *Steps) DecodeWithOptions(task ioOperation, options DecodeOptions) *Steps {
+	if options.Frame < 0 {
+		steps.fail(fmt.Errorf("imageflow: invalid frame %d", options.Frame))
+		return steps
+	}
 	steps.inputs = append(steps.inputs, task)
 	task.setIo(uint(steps.ioID))
 	steps.vertex = append(steps.vertex, decode{
-		IoID: steps.ioID,
+		IoID:     steps.ioID,
+		Commands: options.toCommands(),
 	}.toStep())
 	steps.ioID++
 	steps.last = uint(len(steps.vertex) - 1)
 	return steps
 }
 
+// CreateCanvas is used to start from a blank w x h image filled with color
+// Like Decode it has no input, so it can begin a graph or a new canvas for DrawExactOnto and CopyRectangleOnto.
+// format defaults to PixelBGRA32 and a nil color to transparent.
+func (steps *Steps) CreateCanvas(w int, h int, format PixelFormat, color Color) *Steps {
+	canvas := createCanvas{W: w, H: h, Format: format}
+	if color != nil {
+		canvas.Color = color
+	}
+	if err := canvas.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	steps.vertex = append(steps.vertex, canvas.toStep())
+	steps.last = uint(len(steps.vertex) - 1)
+	return steps
+}
+
 // ConstrainWithin is used to constraint a image
 func (steps *Steps) ConstrainWithin(w float64, h float64) *Steps {
 	steps.input(constrainWithinMap(w, h))
@@ -62,12 +93,22 @@ func constrainWithinMap(w interface{}, h interface{}) map[string]interface{} {
 
 // Constrain is used to constraint a image
 func (steps *Steps) Constrain(dataMap Constrain) *Steps {
+	if err := dataMap.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
 	steps.input(dataMap.toStep())
 	return steps
 }
 
 // Encode is used to convert the image
 func (steps *Steps) Encode(task ioOperation, preset presetInterface) *Steps {
+	if v, ok := preset.(presetValidator); ok {
+		if err := v.validate(); err != nil {
+			steps.fail(err)
+			return steps
+		}
+	}
 	task.setIo(uint(steps.ioID))
 	steps.outputs = append(steps.outputs, task)
 	steps.input(encode{
@@ -122,9 +163,18 @@ func (steps *Steps) input(step interface{}) {
 func (steps *Steps) canvas(f func(*Steps), step stepInterface) *Steps {
 	last := steps.last
 	f(steps)
+	canvas := NodeRef(steps.last)
+	steps.last = last
+	return steps.composite(canvas, step)
+}
+
+func (steps *Steps) composite(canvas NodeRef, step stepInterface) *Steps {
+	if !steps.validRef(canvas) {
+		return steps
+	}
 	steps.vertex = append(steps.vertex, step.toStep())
-	steps.innerGraph.AddEdge(last, uint(len(steps.vertex)-1), "input")
-	steps.innerGraph.AddEdge(steps.last, uint(len(steps.vertex)-1), "canvas")
+	steps.innerGraph.AddEdge(steps.last, uint(len(steps.vertex)-1), "input")
+	steps.innerGraph.AddEdge(uint(canvas), uint(len(steps.vertex)-1), "canvas")
 	steps.last = uint(len(steps.vertex) - 1)
 	return steps
 }
@@ -136,12 +186,105 @@ func (steps *Steps) CopyRectangle(f func(steps *Steps), rect RectangleToCanvas)
 
 // DrawExact copy a image
 func (steps *Steps) DrawExact(f func(steps *Steps), rect DrawExact) *Steps {
+	if err := rect.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
 	return steps.canvas(f, rect)
 }
 
+// NodeRef identifies a node in the graph
+type NodeRef uint
+
+// EdgeKind is the role an edge plays for the node it points to
+type EdgeKind string
+
+const (
+	// EdgeInput carries the image being operated on
+	EdgeInput EdgeKind = "input"
+	// EdgeCanvas carries the image being drawn onto
+	EdgeCanvas EdgeKind = "canvas"
+)
+
+// Ref returns the node added by the last builder method
+func (steps *Steps) Ref() NodeRef {
+	return NodeRef(steps.last)
+}
+
+// Mark stores the node added by the last builder method in ref without breaking the chain
+func (steps *Steps) Mark(ref *NodeRef) *Steps {
+	*ref = steps.Ref()
+	return steps
+}
+
+// From continues the chain from ref, so the next step uses it as input
+// It can be used to reuse an intermediate node in several places.
+func (steps *Steps) From(ref NodeRef) *Steps {
+	if steps.validRef(ref) {
+		steps.last = uint(ref)
+	}
+	return steps
+}
+
+// Connect adds an edge of the given kind between two existing nodes
+func (steps *Steps) Connect(from NodeRef, to NodeRef, kind EdgeKind) *Steps {
+	if kind != EdgeInput && kind != EdgeCanvas {
+		steps.fail(fmt.Errorf("imageflow: unknown edge kind %q", kind))
+		return steps
+	}
+	if steps.validRef(from) && steps.validRef(to) {
+		steps.innerGraph.AddEdge(uint(from), uint(to), string(kind))
+	}
+	return steps
+}
+
+// CopyRectangleOnto copies from the current node onto the canvas node
+func (steps *Steps) CopyRectangleOnto(canvas NodeRef, rect RectangleToCanvas) *Steps {
+	return steps.composite(canvas, rect)
+}
+
+// DrawExactOnto draws the current node onto the canvas node
+func (steps *Steps) DrawExactOnto(canvas NodeRef, rect DrawExact) *Steps {
+	if err := rect.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	return steps.composite(canvas, rect)
+}
+
+func (steps *Steps) validRef(ref NodeRef) bool {
+	if int(ref) >= len(steps.vertex) {
+		steps.fail(fmt.Errorf("imageflow: node %d does not exist", ref))
+		return false
+	}
+	return true
+}
+
+// fail records the first error found while building, it is returned by Execute
+func (steps *Steps) fail(err error) {
+	if steps.err == nil {
+		steps.err = err
+	}
+}
+
 // Execute the graph
 func (steps *Steps) Execute() (map[string][]byte, error) {
-	js := steps.ToJSON()
+	result, err := steps.ExecuteWithResult()
+	if err != nil {
+		return nil, err
+	}
+	return result.Outputs, nil
+}
+
+// ExecuteWithResult executes the graph and reports what was encoded for each output
+func (steps *Steps) ExecuteWithResult() (*Result, error) {
+	if steps.err != nil {
+		return nil, steps.err
+	}
+	js, err := steps.toJSON()
+	if err != nil {
+		return nil, err
+	}
 	job, err := newJob()
 	if err != nil {
 		return nil, err
@@ -164,24 +307,35 @@ func (steps *Steps) Execute() (map[string][]byte, error) {
 			return nil, errorInOutput
 		}
 	}
-	errorInMessage := job.Message(js)
+	response, errorInMessage := job.Send("v1/execute", js)
 
 	if errorInMessage != nil {
 		return nil, errorInMessage
 	}
 
-	bufferMap := make(map[string][]byte)
+	result := &Result{Outputs: make(map[string][]byte)}
+	sizes := make(map[int]int)
 	for i := 0; i < len(steps.outputs); i++ {
 		data, errorInOutput := job.GetOutput(steps.outputs[i].getIo())
 		if errorInOutput != nil {
 			return nil, errorInOutput
 		}
-		bufferMap, err = steps.outputs[i].toOutput(data, bufferMap)
+		sizes[int(steps.outputs[i].getIo())] = len(data)
+		result.Outputs, err = steps.outputs[i].toOutput(data, result.Outputs)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return bufferMap, nil
+	result.Encodes, err = parseEncodes(response, steps.outputs, sizes)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range steps.smallest {
+		if err := group.resolve(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
 // Branch create a alternate path for the output
@@ -192,6 +346,17 @@ func (steps *Steps) Branch(f func(*Steps)) *Steps {
 	return steps
 }
 
+// clone returns a copy of steps which can be extended without changing steps
+func (steps *Steps) clone() *Steps {
+	copied := *steps
+	copied.inputs = append([]ioOperation(nil), steps.inputs...)
+	copied.outputs = append([]ioOperation(nil), steps.outputs...)
+	copied.vertex = append([]interface{}(nil), steps.vertex...)
+	copied.innerGraph.edges = append([]edge(nil), steps.innerGraph.edges...)
+	copied.smallest = append([]smallestGroup(nil), steps.smallest...)
+	return &copied
+}
+
 // Region is used to crop or add padding to image
 func (steps *Steps) Region(region Region) *Steps {
 	steps.input(region.toStep())
@@ -216,6 +381,25 @@ func (steps *Steps) FillRect(x1 float64, y1 float64, x2 float64, y2 float64, col
 	return steps
 }
 
+// RoundCorners is used to round the corners of the image
+// The corners are filled with background, nil leaves them transparent.
+func (steps *Steps) RoundCorners(radius CornerRadius, background Color) *Steps {
+	corners := roundImageCorners{Radius: radius, BackgroundColor: background}
+	if err := corners.validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	steps.input(corners.toStep())
+	return steps
+}
+
+// Circle is used to crop the image to a centered square and cut a transparent circle out of it
+// Encode to a format with alpha like PNG or WebP to keep the transparency.
+func (steps *Steps) Circle() *Steps {
+	return steps.Constrain(Constrain{Mode: ModeAspectCrop, W: 1, H: 1}).
+		RoundCorners(PercentageRadius(50), Transparent(""))
+}
+
 // ExpandCanvas is used create a rectangle on the image
 func (steps *Steps) ExpandCanvas(canvas ExpandCanvas) *Steps {
 	steps.input(canvas.toStep())
@@ -224,6 +408,12 @@ func (steps *Steps) ExpandCanvas(canvas ExpandCanvas) *Steps {
 
 // Watermark is used to watermark a image
 func (steps *Steps) Watermark(data ioOperation, gravity interface{}, fitMode string, fitBox FitBox, opacity float32, hint interface{}) *Steps {
+	if hint, ok := hint.(ConstraintHint); ok {
+		if err := hint.validate(); err != nil {
+			steps.fail(err)
+			return steps
+		}
+	}
 	data.setIo(uint(steps.ioID))
 	steps.inputs = append(steps.inputs, data)
 	steps.input(watermark{
@@ -249,6 +439,39 @@ func (steps *Steps) Command(cmd string) *Steps {
 	return steps
 }
 
+// CommandWithIO is used to run a command string which decodes src and encodes dst itself
+// Like Decode it has no input. The encoder is picked by format= and quality= in cmd,
+// ExecuteWithResult reports the one libimageflow chose in the EncodeResult of dst.
+func (steps *Steps) CommandWithIO(src ioOperation, dst ioOperation, cmd string) *Steps {
+	steps.inputs = append(steps.inputs, src)
+	src.setIo(uint(steps.ioID))
+	decodeID := steps.ioID
+	steps.ioID++
+	steps.outputs = append(steps.outputs, dst)
+	dst.setIo(uint(steps.ioID))
+	encodeID := steps.ioID
+	steps.ioID++
+	steps.vertex = append(steps.vertex, map[string]interface{}{
+		"command_string": map[string]interface{}{
+			"kind":   "ir4",
+			"value":  cmd,
+			"decode": decodeID,
+			"encode": encodeID,
+		},
+	})
+	steps.last = uint(len(steps.vertex) - 1)
+	return steps
+}
+
+// CommandString is used to add a typed command string, invalid fields fail the job
+func (steps *Steps) CommandString(cmd CommandString) *Steps {
+	if err := cmd.Validate(); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	return steps.Command(cmd.String())
+}
+
 // WhiteBalanceSRGB histogram area
 // This command is not recommended as it operates in the sRGB space and does not produce perfect results.
 func (steps *Steps) WhiteBalanceSRGB(threshold float32) *Steps {
@@ -380,7 +603,13 @@ func NewStep() Steps {
 	}
 }
 
+// ToJSON returns the graph in the form sent to libimageflow
 func (steps *Steps) ToJSON() []byte {
+	js, _ := steps.toJSON()
+	return js
+}
+
+func (steps *Steps) toJSON() ([]byte, error) {
 	nodeMap := make(map[int]interface{})
 	for i := 0; i < len(steps.vertex); i++ {
 		nodeMap[i] = steps.vertex[i]
@@ -388,6 +617,8 @@ func (steps *Steps) ToJSON() []byte {
 	jsonMap := map[string]interface{}{"framewise": map[string]interface{}{
 		"graph": map[string]interface{}{"nodes": nodeMap, "edges": steps.innerGraph.edges},
 	}}
-	js, _ := json.Marshal(jsonMap)
-	return js
+	if steps.recording != nil {
+		jsonMap["graph_recording"] = steps.recording
+	}
+	return json.Marshal(jsonMap)
 }
@@ -70,21 +70,44 @@ func (job *job) AddOutput(id uint) error {
 
 // Message execute a command
 func (job *job) Message(message []byte) error {
+	_, err := job.Send("v1/execute", message)
+	return err
+}
+
+// Send a message to an endpoint and return the JSON response
+func (job *job) Send(method string, message []byte) ([]byte, error) {
 	if job.CheckError() {
-		return job.ReadError()
+		return nil, job.ReadError()
 	}
 
-	cs := C.CString("v1/execute")
+	cs := C.CString(method)
 	defer C.free(unsafe.Pointer(cs))
 
 	cb := C.CBytes(message)
 	defer C.free(cb)
 
-	C.imageflow_context_send_json(job.inner, cs, (*C.uchar)(cb), C.size_t(len(message)))
+	response := C.imageflow_context_send_json(job.inner, cs, (*C.uchar)(cb), C.size_t(len(message)))
+	if response != nil {
+		defer C.imageflow_json_response_destroy(job.inner, (*C.struct_imageflow_json_response)(unsafe.Pointer(response)))
+	}
 	if job.CheckError() {
-		return job.ReadError()
+		return nil, job.ReadError()
 	}
-	return nil
+
+	var status C.int64_t
+	var bufPtr *C.uint8_t
+	var bufLen C.size_t
+	if !bool(C.imageflow_json_response_read(job.inner, response, &status, &bufPtr, &bufLen)) {
+		if job.CheckError() {
+			return nil, job.ReadError()
+		}
+		return nil, errors.New("imageflow_context_send_json returned no response")
+	}
+	data := C.GoBytes(unsafe.Pointer(bufPtr), C.int(bufLen))
+	if status != 200 {
+		return nil, responseError(method, int(status), data)
+	}
+	return data, nil
 }
 
 // newJob creates a context after verifying ABI compatibility
@@ -2,7 +2,10 @@ package imageflow
 
 import (
 	"encoding/json"
+	"errors"
+	"image/color"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -225,6 +228,210 @@ func TestEncodeGIF(t *testing.T) {
 	}
 }
 
+func TestEncodeLibJPEGTurbo(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		Encode(GetBuffer("out"), LibJPEGTurbo{Quality: 80, Progressive: true, OptimizeHuffmanCoding: true}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := m["out"]
+	if len(out) < 2 || out[0] != 0xFF || out[1] != 0xD8 {
+		t.Error("output does not start with JPEG magic bytes")
+	}
+}
+
+func TestEncodeLibPNG(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		Encode(GetBuffer("out"), LibPNG{Depth: PNG24, ZlibCompression: 9, Matte: RGB(255, 255, 255)}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := m["out"]
+	if len(out) < 4 || out[0] != 0x89 || out[1] != 0x50 || out[2] != 0x4E || out[3] != 0x47 {
+		t.Error("output does not start with PNG magic bytes")
+	}
+}
+
+func TestEncodeJPEGWithMatte(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		ExpandCanvas(ExpandCanvas{Left: 10, Right: 10, Color: Transparent("")}).
+		Encode(GetBuffer("out"), MozJPEG{Matte: MustParseColor("white")}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("MozJPEG with matte produced empty output")
+	}
+}
+
+func TestEncodeFormatProfile(t *testing.T) {
+	data := loadTestImage(t)
+	for _, profile := range []QualityProfile{QualityLowest, QualityMedium, QualityHighest, QualityLossless} {
+		step := NewStep()
+		result, err := step.Decode(NewBuffer(data)).
+			ConstrainWithinW(100).
+			Encode(GetBuffer("out"), FormatProfile{Format: FormatWebP, QualityProfile: profile}).
+			ExecuteWithResult()
+		if err != nil {
+			t.Fatalf("%s: %v", profile, err)
+		}
+		if encode, _ := result.Encode("out"); encode.Format() != FormatWebP {
+			t.Errorf("%s: expected webp, got %q", profile, encode.PreferredMimeType)
+		}
+	}
+}
+
+func TestPresetJSON(t *testing.T) {
+	cases := []struct {
+		preset presetInterface
+		want   string
+	}{
+		{MozJPEG{}, `{"mozjpeg":{"quality":90,"progressive":false}}`},
+		{MozJPEG{Quality: 70, Matte: RGB(255, 255, 255)}, `{"mozjpeg":{"quality":70,"progressive":false,"matte":{"srgb":{"hex":"ffffffff"}}}}`},
+		{LibJPEGTurbo{Progressive: true}, `{"libjpegturbo":{"quality":90,"progressive":true,"optimize_huffman_coding":false}}`},
+		{LibPNG{}, `{"libpng":{"depth":null,"zlib_compression":null}}`},
+		{LibPNG{Depth: PNG24, ZlibCompression: 6, Matte: Black{}}, `{"libpng":{"depth":"png_24","zlib_compression":6,"matte":"black"}}`},
+		{FormatProfile{Format: FormatJPEG, QualityProfile: QualityMediumLow}, `{"format":{"format":"jpeg","lossless":null,"quality_profile":"medium_low"}}`},
+	}
+	for _, c := range cases {
+		js, err := json.Marshal(c.preset.toPreset())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(js) != c.want {
+			t.Errorf("got %s, want %s", js, c.want)
+		}
+	}
+
+	for _, preset := range []presetInterface{
+		LibJPEGTurbo{Quality: 101},
+		LibPNG{Depth: "png_16"},
+		LibPNG{ZlibCompression: 10},
+		FormatProfile{},
+		FormatProfile{Format: FormatPNG, QualityProfile: "ultra"},
+	} {
+		step := NewStep()
+		step.Decode(NewBuffer([]byte{})).Encode(GetBuffer("out"), preset)
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for %+v", preset)
+		}
+	}
+}
+
+func TestEncodeAuto(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		Encode(GetBuffer("out"), Auto{
+			Allow:          []ImageFormat{FormatWebP, FormatJPEG, FormatPNG},
+			QualityProfile: QualityGood,
+			Lossless:       LosslessKeep,
+			Matte:          RGB(255, 255, 255),
+		}).
+		ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Outputs["out"]) == 0 {
+		t.Fatal("Auto produced empty output")
+	}
+	encode, ok := result.Encode("out")
+	if !ok {
+		t.Fatal("missing encode result for Auto")
+	}
+	if encode.Format() != FormatWebP && encode.Format() != FormatJPEG && encode.Format() != FormatPNG {
+		t.Errorf("Auto chose a format that was not allowed: %q", encode.PreferredMimeType)
+	}
+}
+
+func TestExecuteWithResult(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(data)).
+		ConstrainWithin(100, 100).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode, ok := result.Encode("out")
+	if !ok {
+		t.Fatal("missing encode result")
+	}
+	if encode.PreferredMimeType != "image/jpeg" || encode.Format() != FormatJPEG {
+		t.Errorf("unexpected mime type %q", encode.PreferredMimeType)
+	}
+	if encode.W > 100 || encode.H > 100 || encode.W == 0 {
+		t.Errorf("unexpected size %dx%d", encode.W, encode.H)
+	}
+	if encode.Bytes != len(result.Outputs["out"]) {
+		t.Errorf("expected %d bytes, got %d", len(result.Outputs["out"]), encode.Bytes)
+	}
+}
+
+func TestAutoPresetJSON(t *testing.T) {
+	js, err := json.Marshal(Auto{Allow: []ImageFormat{FormatWebP, FormatPNG}, QualityProfileDPR: 2}.toPreset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"auto":{"allow":{"avif":false,"gif":false,"jpeg":false,"jxl":false,"png":true,"webp":true},"lossless":null,"quality_profile":"high","quality_profile_dpr":2}}`
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
+	}
+
+	for _, preset := range []Auto{
+		{Allow: []ImageFormat{"bmp"}},
+		{QualityProfile: "best"},
+		{Lossless: "maybe"},
+	} {
+		step := NewStep()
+		step.Decode(NewBuffer([]byte{})).Encode(GetBuffer("out"), preset)
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for %+v", preset)
+		}
+	}
+}
+
+func TestParseEncodes(t *testing.T) {
+	response := []byte(`{"code":200,"success":true,"message":"OK","data":{"job_result":{"encodes":[{"preset":"webplossy","io_id":1,"w":100,"h":50,"bytes":"elided","preferred_mime_type":"image/webp","preferred_extension":"webp"}]}}}`)
+	output := GetBuffer("thumb")
+	output.setIo(1)
+	encodes, err := parseEncodes(response, []ioOperation{output}, map[int]int{1: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EncodeResult{IoID: 1, Key: "thumb", W: 100, H: 50, Bytes: 1234, Preset: "webplossy", PreferredMimeType: "image/webp", PreferredExtension: "webp"}
+	if len(encodes) != 1 || encodes[0] != want {
+		t.Fatalf("unexpected encodes %+v", encodes)
+	}
+	if encodes[0].Format() != FormatWebP {
+		t.Errorf("unexpected format %q", encodes[0].Format())
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	err := responseError("v1/execute", 400, []byte(`{"code":400,"success":false,"message":"InvalidNodeParams: w must be positive"}`))
+	if err == nil || err.Error() != "imageflow: v1/execute returned status 400: InvalidNodeParams: w must be positive" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := responseError("v1/execute", 500, []byte("panic")); err == nil || err.Error() != "imageflow: v1/execute returned status 500: panic" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
 // Shorthand encode helpers
 func TestPNGShorthand(t *testing.T) {
 	data := loadTestImage(t)
@@ -286,6 +493,317 @@ func TestGIFShorthand(t *testing.T) {
 	}
 }
 
+// ---------------------------------------------------------------------------
+// Decode option tests
+// ---------------------------------------------------------------------------
+
+func TestDecodeWithOptions(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.DecodeWithOptions(NewBuffer(data), DecodeOptions{
+		JPEGDownscale: &JPEGDownscaleHint{
+			Width: 100, Height: 100,
+			ScaleLumaSpatially: true,
+			LinearLight:        true,
+		},
+		IgnoreColorProfileErrors: true,
+	}).
+		ConstrainWithin(100, 100).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("DecodeWithOptions produced empty output")
+	}
+}
+
+func TestDecodeDiscardColorProfile(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.DecodeWithOptions(NewBuffer(data), DecodeOptions{DiscardColorProfile: true}).
+		ConstrainWithinW(100).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("DecodeWithOptions produced empty output")
+	}
+}
+
+func TestDecodeOptionsJSON(t *testing.T) {
+	step := NewStep()
+	step.DecodeWithOptions(NewBuffer([]byte{}), DecodeOptions{
+		JPEGDownscale:            &JPEGDownscaleHint{Width: 800, Height: 600, ScaleLumaSpatially: true},
+		DiscardColorProfile:      true,
+		IgnoreColorProfileErrors: true,
+		Frame:                    2,
+	})
+	js, err := json.Marshal(step.vertex[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"decode":{"io_id":0,"commands":[{"jpeg_downscale_hints":{"width":800,"height":600,"scale_luma_spatially":true,"gamma_correct_for_srgb_during_spatial_luma_scaling":false}},"discard_color_profile","ignore_color_profile_errors",{"select_frame":2}]}}`
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
+	}
+
+	step = NewStep()
+	step.Decode(NewBuffer([]byte{}))
+	if js, _ := json.Marshal(step.vertex[0]); string(js) != `{"decode":{"io_id":0}}` {
+		t.Errorf("plain Decode changed: %s", js)
+	}
+
+	step = NewStep()
+	step.DecodeWithOptions(NewBuffer([]byte{}), DecodeOptions{Frame: -1})
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error for negative frame")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Quality search tests
+// ---------------------------------------------------------------------------
+
+func TestEncodeToSize(t *testing.T) {
+	data := loadTestImage(t)
+	for _, preset := range []presetInterface{MozJPEG{Progressive: true}, WebP{}, LossyPNG{Speed: 5}} {
+		step := NewStep()
+		result, err := step.Decode(NewBuffer(data)).
+			ConstrainWithinW(300).
+			Branch(func(s *Steps) {
+				s.ConstrainWithinW(50).Encode(GetBuffer("small"), GIF{})
+			}).
+			EncodeToSize(GetBuffer("out"), preset, 12000)
+		if err != nil {
+			t.Fatalf("%T: %v", preset, err)
+		}
+		if len(result.Outputs["out"]) == 0 || len(result.Outputs["out"]) > 12000 {
+			t.Errorf("%T: output of %d bytes does not fit the budget", preset, len(result.Outputs["out"]))
+		}
+		if result.Bytes != len(result.Outputs["out"]) || result.Quality < 1 || result.Quality > 100 {
+			t.Errorf("%T: unexpected result quality %d, %d bytes", preset, result.Quality, result.Bytes)
+		}
+		if len(result.Outputs["small"]) == 0 {
+			t.Errorf("%T: other outputs of the graph are missing", preset)
+		}
+		if encode, ok := result.Encode("out"); !ok || encode.Bytes != result.Bytes {
+			t.Errorf("%T: unexpected encode result %+v", preset, encode)
+		}
+		if len(result.Candidates) == 0 {
+			t.Errorf("%T: no candidates reported", preset)
+		}
+	}
+}
+
+func TestEncodeToSizeBudgetError(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	_, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(300).
+		EncodeToSize(GetBuffer("out"), MozJPEG{}, 10)
+	var budget *SizeBudgetError
+	if !errors.As(err, &budget) {
+		t.Fatalf("expected SizeBudgetError, got %v", err)
+	}
+	if budget.MinQuality != 1 || budget.Bytes <= 10 {
+		t.Errorf("unexpected error %+v", budget)
+	}
+}
+
+func TestEncodeToQuality(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		EncodeToQuality(GetBuffer("out"), WebP{}, 0.98)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SSIM < 0.98 {
+		t.Errorf("chosen quality %d has ssim %v", result.Quality, result.SSIM)
+	}
+	if len(result.Outputs["out"]) != result.Bytes {
+		t.Errorf("expected %d bytes, got %d", result.Bytes, len(result.Outputs["out"]))
+	}
+	for _, candidate := range result.Candidates {
+		if candidate.SSIM <= 0 || candidate.Bytes == 0 {
+			t.Errorf("candidate was not scored: %+v", candidate)
+		}
+		if candidate.SSIM >= 0.98 && candidate.Quality < result.Quality {
+			t.Errorf("candidate %+v passes with a lower quality than %d", candidate, result.Quality)
+		}
+	}
+
+	frame, err := DecodeFrame(result.Outputs["out"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 200 {
+		t.Errorf("unexpected width %d", frame.Bounds().Dx())
+	}
+}
+
+func TestEncodeToQualityUnreachable(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	_, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		EncodeToQuality(GetBuffer("out"), LossyPNG{}, 1)
+	var similarity *SimilarityError
+	if !errors.As(err, &similarity) {
+		t.Fatalf("expected SimilarityError, got %v", err)
+	}
+}
+
+func TestEncodeToSizeKeepsSteps(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).ConstrainWithinW(100).Encode(GetBuffer("other"), GIF{})
+	graph := string(step.ToJSON())
+	outputs := len(step.outputs)
+	for i := 0; i < 2; i++ {
+		step.EncodeToSize(GetBuffer("out"), MozJPEG{}, 1000)
+		step.EncodeToQuality(GetBuffer("out"), WebP{}, 0.9)
+	}
+	if after := string(step.ToJSON()); after != graph || len(step.outputs) != outputs {
+		t.Errorf("searching changed the graph\n%s\n%s", graph, after)
+	}
+}
+
+func TestEncodeToSizeInvalid(t *testing.T) {
+	step := NewStep()
+	if _, err := step.Decode(NewBuffer([]byte{})).EncodeToSize(GetBuffer("out"), GIF{}, 1000); err == nil {
+		t.Error("expected error for preset without quality")
+	}
+	if _, err := step.EncodeToSize(GetBuffer("out"), MozJPEG{}, 0); err == nil {
+		t.Error("expected error for empty budget")
+	}
+	if _, err := step.EncodeToQuality(GetBuffer("out"), MozJPEG{}, 1.5); err == nil {
+		t.Error("expected error for ssim target above 1")
+	}
+}
+
+func TestBisectQuality(t *testing.T) {
+	for boundary := 0; boundary <= 101; boundary++ {
+		tries := 0
+		quality, found, err := bisectQuality(1, 100, false, func(q int) (bool, error) {
+			tries++
+			return q <= boundary, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantFound := boundary >= 1
+		want := boundary
+		if boundary > 100 {
+			want = 100
+		}
+		if found != wantFound || (found && quality != want) {
+			t.Errorf("descending boundary %d: got %d, %v", boundary, quality, found)
+		}
+		if tries > 7 {
+			t.Errorf("descending boundary %d: %d tries", boundary, tries)
+		}
+
+		quality, found, _ = bisectQuality(1, 100, true, func(q int) (bool, error) {
+			return q >= boundary, nil
+		})
+		wantFound = boundary <= 100
+		want = boundary
+		if boundary < 1 {
+			want = 1
+		}
+		if found != wantFound || (found && quality != want) {
+			t.Errorf("ascending boundary %d: got %d, %v", boundary, quality, found)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Smallest encode tests
+// ---------------------------------------------------------------------------
+
+func TestEncodeSmallest(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		Branch(func(s *Steps) {
+			s.Encode(GetBuffer("png"), LosslessPNG{})
+		}).
+		EncodeSmallest(GetBuffer("out"), MozJPEG{Quality: 80}, WebP{Quality: 80}, LosslessPNG{}).
+		ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Encodes) != 2 {
+		t.Fatalf("expected only the chosen candidate and the branch, got %+v", result.Encodes)
+	}
+	encode, ok := result.Encode("out")
+	if !ok {
+		t.Fatal("missing encode result for the smallest output")
+	}
+	if encode.Format() != FormatJPEG && encode.Format() != FormatWebP {
+		t.Errorf("expected a lossy format to win for a photo, got %q", encode.PreferredMimeType)
+	}
+	if encode.Bytes != len(result.Outputs["out"]) || len(result.Outputs["out"]) >= len(result.Outputs["png"]) {
+		t.Errorf("output of %d bytes is not the smallest", len(result.Outputs["out"]))
+	}
+}
+
+func TestSmallestPick(t *testing.T) {
+	candidate := func(size int) *capture {
+		return &capture{data: make([]byte, size)}
+	}
+	group := smallestGroup{
+		candidates: []*capture{candidate(1000), candidate(800), candidate(900)},
+		lossless:   []bool{false, false, true},
+	}
+	if group.pick() != 1 {
+		t.Errorf("expected the smallest candidate, got %d", group.pick())
+	}
+	group.options.LosslessRatio = 1.2
+	if group.pick() != 2 {
+		t.Errorf("expected the lossless candidate within the ratio, got %d", group.pick())
+	}
+	group.options.LosslessRatio = 1.1
+	if group.pick() != 1 {
+		t.Errorf("expected the lossy candidate outside the ratio, got %d", group.pick())
+	}
+	group.lossless = []bool{true, true, true}
+	if group.pick() != 1 {
+		t.Errorf("expected the smallest candidate without lossy ones, got %d", group.pick())
+	}
+}
+
+func TestSmallestResolve(t *testing.T) {
+	small := &capture{iOID: 2, data: []byte("small")}
+	large := &capture{iOID: 3, data: []byte("larger")}
+	group := smallestGroup{sink: GetBuffer("out"), candidates: []*capture{large, small}, lossless: []bool{false, false}}
+	result := &Result{
+		Outputs: map[string][]byte{"other": []byte("x")},
+		Encodes: []EncodeResult{{IoID: 1, Key: "other"}, {IoID: 2, PreferredMimeType: "image/webp"}, {IoID: 3}},
+	}
+	if err := group.resolve(result); err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Outputs["out"]) != "small" || len(result.Outputs) != 2 {
+		t.Errorf("unexpected outputs %v", result.Outputs)
+	}
+	if len(result.Encodes) != 2 || result.Encodes[1].Key != "out" || result.Encodes[1].Format() != FormatWebP {
+		t.Errorf("unexpected encodes %+v", result.Encodes)
+	}
+
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).EncodeSmallest(GetBuffer("out"))
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error without presets")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Constraint tests
 // ---------------------------------------------------------------------------
@@ -381,6 +899,119 @@ func TestConstrainWithGravityAndCanvasColor(t *testing.T) {
 	}
 }
 
+func TestConstrainTypedHints(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		Constrain(Constrain{
+			Mode: ModeFitCrop,
+			W:    200,
+			H:    100,
+			Hint: ConstraintHint{
+				DownFilter:        FilterRobidouxSharp,
+				UpFilter:          FilterGinseng,
+				ScalingColorspace: ColorspaceLinear,
+				ResampleWhen:      ResampleSizeDiffersOrSharpeningRequested,
+				SharpenWhen:       SharpenDownscaling,
+				SharpenPercent:    15,
+			},
+		}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("Constrain with typed hints produced empty output")
+	}
+}
+
+func TestConstrainInvalidEnums(t *testing.T) {
+	invalid := []Constrain{
+		{Mode: "max", W: 10},
+		{W: 10},
+		{Mode: ModeWithin, W: 10, Hint: ConstraintHint{DownFilter: "lanczoz"}},
+		{Mode: ModeWithin, W: 10, Hint: ConstraintHint{ScalingColorspace: "cmyk"}},
+		{Mode: ModeWithin, W: 10, Hint: ConstraintHint{ResampleWhen: "sometimes"}},
+		{Mode: ModeWithin, W: 10, Hint: ConstraintHint{SharpenWhen: "never"}},
+	}
+	for _, constrain := range invalid {
+		step := NewStep()
+		step.Decode(NewBuffer([]byte{})).Constrain(constrain)
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for %+v", constrain)
+		}
+	}
+}
+
+func TestDrawExactInvalidEnums(t *testing.T) {
+	invalid := DrawExact{W: 10, H: 10, Blend: "compose", Hints: ConstraintHint{UpFilter: "lanczoz"}}
+	step := NewStep()
+	step.CreateCanvas(20, 20, PixelBGRA32, nil)
+	canvas := step.Ref()
+	step.Decode(NewBuffer([]byte{})).DrawExactOnto(canvas, invalid)
+	if _, err := step.Execute(); err == nil || !strings.Contains(err.Error(), "lanczoz") {
+		t.Errorf("expected error for DrawExactOnto, got %v", err)
+	}
+	step = NewStep()
+	step.CreateCanvas(20, 20, PixelBGRA32, nil).DrawExact(func(s *Steps) {
+		s.Decode(NewBuffer([]byte{}))
+	}, invalid)
+	if _, err := step.Execute(); err == nil || !strings.Contains(err.Error(), "lanczoz") {
+		t.Errorf("expected error for DrawExact, got %v", err)
+	}
+}
+
+func TestEnumJSON(t *testing.T) {
+	js, err := json.Marshal(ConstraintHint{DownFilter: FilterLanczos2Sharp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"sharpen_percent":null,"down_filter":"lanczos_2_sharp","up_filter":null,"scaling_colorspace":null,"background_color":null,"resample_when":null,"sharpen_when":null}`
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
+	}
+
+	var hint ConstraintHint
+	if err := json.Unmarshal([]byte(want), &hint); err != nil {
+		t.Fatal(err)
+	}
+	if hint.DownFilter != FilterLanczos2Sharp || hint.UpFilter != "" {
+		t.Errorf("unexpected hint %+v", hint)
+	}
+	if err := json.Unmarshal([]byte(`{"down_filter":"bogus"}`), &hint); err == nil {
+		t.Error("expected error unmarshaling an unknown filter")
+	}
+	var mode ConstraintMode
+	if err := json.Unmarshal([]byte(`"larger_than"`), &mode); err != nil || mode != ModeLargerThan {
+		t.Errorf("unexpected mode %q: %v", mode, err)
+	}
+	if _, err := json.Marshal(Filter("bogus")); err == nil {
+		t.Error("expected error marshaling an unknown filter")
+	}
+}
+
+func TestParseEnums(t *testing.T) {
+	if mode, err := ParseConstraintMode("within_pad"); err != nil || mode != ModeWithinPad {
+		t.Errorf("ParseConstraintMode: %q, %v", mode, err)
+	}
+	if filter, err := ParseFilter("catmull_rom"); err != nil || filter.String() != "catmull_rom" {
+		t.Errorf("ParseFilter: %q, %v", filter, err)
+	}
+	if _, err := ParseScalingColorspace("srgb"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseResampleWhen("always"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseSharpenWhen("upscaling"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseFilter("Lanczos"); err == nil {
+		t.Error("expected error for wrongly cased filter")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Transform tests
 // ---------------------------------------------------------------------------
@@ -470,120 +1101,342 @@ func TestAllRotationsAndFlips(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m["out"]) == 0 {
-		t.Fatal("chained transforms produced empty output")
+	if len(m["out"]) == 0 {
+		t.Fatal("chained transforms produced empty output")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Region / crop tests
+// ---------------------------------------------------------------------------
+
+func TestRegion(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		Region(Region{
+			X1: 10, Y1: 10, X2: 200, Y2: 200,
+			BackgroundColor: Black{},
+		}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("Region produced empty output")
+	}
+}
+
+func TestRegionPercentage(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		RegionPercentage(RegionPercentage{
+			X1: 10, Y1: 10, X2: 90, Y2: 90,
+			BackgroundColor: Black{},
+		}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("RegionPercentage produced empty output")
+	}
+}
+
+func TestCropWhitespace(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		CropWhitespace(80, 0.5).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("CropWhitespace produced empty output")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Drawing / canvas tests
+// ---------------------------------------------------------------------------
+
+func TestFillRect(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		FillRect(0, 0, 50, 50, Black{}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("FillRect produced empty output")
+	}
+}
+
+func TestExpandCanvas(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		ExpandCanvas(ExpandCanvas{
+			Left: 10, Right: 10, Top: 20, Bottom: 20,
+			Color: Black{},
+		}).
+		Encode(GetBuffer("out"), LosslessPNG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("ExpandCanvas produced empty output")
+	}
+}
+
+func TestExpandCanvasTransparent(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		ExpandCanvas(ExpandCanvas{
+			Left: 5, Right: 5, Top: 5, Bottom: 5,
+			Color: Transparent(""),
+		}).
+		Encode(GetBuffer("out"), LosslessPNG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("ExpandCanvas with Transparent produced empty output")
+	}
+}
+
+func TestRoundCorners(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		RoundCorners(PixelRadius(20), nil).
+		Branch(func(s *Steps) {
+			s.RoundCorners(PercentageRadius(10), MustParseColor("#ffffff")).
+				Encode(GetBuffer("white"), MozJPEG{})
+		}).
+		Encode(GetBuffer("out"), LosslessPNG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 || len(m["white"]) == 0 {
+		t.Fatal("RoundCorners produced empty output")
+	}
+}
+
+func TestCircle(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).
+		Circle().
+		Encode(GetBuffer("out"), LosslessPNG{}).
+		ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode, _ := result.Encode("out")
+	if encode.W != encode.H || encode.W == 0 {
+		t.Errorf("expected a square, got %dx%d", encode.W, encode.H)
+	}
+	frame, err := DecodeFrame(result.Outputs["out"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := frame.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected a transparent corner, got alpha %d", a)
+	}
+	center := frame.Bounds().Dx() / 2
+	if _, _, _, a := frame.At(center, center).RGBA(); a != 0xffff {
+		t.Errorf("expected an opaque center, got alpha %d", a)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// Region / crop tests
-// ---------------------------------------------------------------------------
-
-func TestRegion(t *testing.T) {
-	data := loadTestImage(t)
+func TestRoundCornersJSON(t *testing.T) {
 	step := NewStep()
-	m, err := step.Decode(NewBuffer(data)).
-		Region(Region{
-			X1: 10, Y1: 10, X2: 200, Y2: 200,
-			BackgroundColor: Black{},
-		}).
-		Encode(GetBuffer("out"), MozJPEG{}).
-		Execute()
+	step.Decode(NewBuffer([]byte{})).RoundCorners(PixelRadius(8), nil).Circle()
+	data, err := step.toJSON()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m["out"]) == 0 {
-		t.Fatal("Region produced empty output")
+	for _, expected := range []string{
+		`{"round_image_corners":{"background_color":"transparent","radius":{"pixels":8}}}`,
+		`"constrain":{"mode":"aspect_crop","w":1,"h":1`,
+		`{"round_image_corners":{"background_color":"transparent","radius":{"percentage":50}}}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+	}
+
+	for _, radius := range []CornerRadius{nil, PixelRadius(-1), PercentageRadius(51)} {
+		step := NewStep()
+		step.Decode(NewBuffer([]byte{})).RoundCorners(radius, nil)
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for radius %v", radius)
+		}
 	}
 }
 
-func TestRegionPercentage(t *testing.T) {
+func TestCreateCanvas(t *testing.T) {
 	data := loadTestImage(t)
+	var card NodeRef
 	step := NewStep()
-	m, err := step.Decode(NewBuffer(data)).
-		RegionPercentage(RegionPercentage{
-			X1: 10, Y1: 10, X2: 90, Y2: 90,
-			BackgroundColor: Black{},
-		}).
-		Encode(GetBuffer("out"), MozJPEG{}).
-		Execute()
+	result, err := step.CreateCanvas(600, 300, PixelBGRA32, MustParseColor("#1da1f2")).Mark(&card).
+		Decode(NewBuffer(data)).
+		Constrain(Constrain{Mode: ModeFitCrop, W: 200, H: 200}).
+		DrawExactOnto(card, DrawExact{X: 50, Y: 50, W: 200, H: 200, Blend: "overwrite"}).
+		Decode(NewBuffer(data)).
+		Constrain(Constrain{Mode: ModeFitCrop, W: 100, H: 100}).
+		CopyRectangleOnto(card, RectangleToCanvas{W: 100, H: 100, X: 400, Y: 100}).
+		Encode(GetBuffer("out"), LosslessPNG{}).
+		ExecuteWithResult()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m["out"]) == 0 {
-		t.Fatal("RegionPercentage produced empty output")
+	encode, _ := result.Encode("out")
+	if encode.W != 600 || encode.H != 300 {
+		t.Errorf("expected a 600x300 card, got %dx%d", encode.W, encode.H)
+	}
+	frame, err := DecodeFrame(result.Outputs["out"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := frame.At(5, 5).RGBA(); r>>8 != 0x1d || g>>8 != 0xa1 || b>>8 != 0xf2 {
+		t.Errorf("expected the background color, got %d %d %d", r>>8, g>>8, b>>8)
 	}
 }
 
-func TestCropWhitespace(t *testing.T) {
-	data := loadTestImage(t)
+func TestCreateCanvasJSON(t *testing.T) {
 	step := NewStep()
-	m, err := step.Decode(NewBuffer(data)).
-		CropWhitespace(80, 0.5).
-		Encode(GetBuffer("out"), MozJPEG{}).
-		Execute()
+	step.CreateCanvas(40, 20, "", nil).FillRect(0, 0, 10, 10, Black{})
+	data, err := step.toJSON()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m["out"]) == 0 {
-		t.Fatal("CropWhitespace produced empty output")
+	expected := `{"create_canvas":{"w":40,"h":20,"format":"bgra_32","color":"transparent"}}`
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("expected %s in %s", expected, data)
+	}
+	if !strings.Contains(string(data), `"edges":[{"kind":"input","to":1,"from":0}]`) {
+		t.Errorf("expected a single edge from the canvas in %s", data)
+	}
+
+	for _, canvas := range []createCanvas{{W: 0, H: 10}, {W: 10, H: -1}, {W: 10, H: 10, Format: "rgba"}} {
+		step := NewStep()
+		step.CreateCanvas(canvas.W, canvas.H, canvas.Format, nil)
+		if _, err := step.Execute(); err == nil {
+			t.Errorf("expected error for %+v", canvas)
+		}
 	}
 }
 
 // ---------------------------------------------------------------------------
-// Drawing / canvas tests
+// Color tests
 // ---------------------------------------------------------------------------
 
-func TestFillRect(t *testing.T) {
+func TestExpandCanvasSRGB(t *testing.T) {
 	data := loadTestImage(t)
 	step := NewStep()
 	m, err := step.Decode(NewBuffer(data)).
-		FillRect(0, 0, 50, 50, Black{}).
-		Encode(GetBuffer("out"), MozJPEG{}).
+		ConstrainWithinW(200).
+		ExpandCanvas(ExpandCanvas{
+			Left: 10, Right: 10, Top: 10, Bottom: 10,
+			Color: MustParseColor("#336699"),
+		}).
+		FillRect(0, 0, 5, 5, SRGB{R: 255, A: 128}).
+		Encode(GetBuffer("out"), LosslessPNG{}).
 		Execute()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(m["out"]) == 0 {
-		t.Fatal("FillRect produced empty output")
+		t.Fatal("ExpandCanvas with SRGB produced empty output")
 	}
 }
 
-func TestExpandCanvas(t *testing.T) {
+func TestConstrainCanvasColorNamed(t *testing.T) {
 	data := loadTestImage(t)
 	step := NewStep()
 	m, err := step.Decode(NewBuffer(data)).
-		ConstrainWithinW(200).
-		ExpandCanvas(ExpandCanvas{
-			Left: 10, Right: 10, Top: 20, Bottom: 20,
-			Color: Black{},
+		Constrain(Constrain{
+			Mode:        "within_pad",
+			W:           300,
+			H:           300,
+			CanvasColor: MustParseColor("white"),
+			Hint:        ConstraintHint{BackgroundColor: MustParseColor("whitesmoke")},
 		}).
-		Encode(GetBuffer("out"), LosslessPNG{}).
+		Encode(GetBuffer("out"), MozJPEG{}).
 		Execute()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(m["out"]) == 0 {
-		t.Fatal("ExpandCanvas produced empty output")
+		t.Fatal("Constrain with named canvas color produced empty output")
 	}
 }
 
-func TestExpandCanvasTransparent(t *testing.T) {
-	data := loadTestImage(t)
+func TestParseColor(t *testing.T) {
+	cases := map[string]SRGB{
+		"#fff":          {255, 255, 255, 255},
+		"#336699":       {0x33, 0x66, 0x99, 255},
+		"336699":        {0x33, 0x66, 0x99, 255},
+		"#33669980":     {0x33, 0x66, 0x99, 0x80},
+		"RebeccaPurple": {0x66, 0x33, 0x99, 255},
+		"transparent":   {0, 0, 0, 0},
+	}
+	for input, want := range cases {
+		got, err := ParseColor(input)
+		if err != nil {
+			t.Errorf("ParseColor(%q): %v", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseColor(%q) = %v, want %v", input, got, want)
+		}
+	}
+	for _, input := range []string{"", "#12", "#12345", "#ggg", "notacolor"} {
+		if _, err := ParseColor(input); err == nil {
+			t.Errorf("ParseColor(%q): expected error", input)
+		}
+	}
+}
+
+func TestFromColor(t *testing.T) {
+	got := FromColor(color.RGBA{R: 50, G: 0, B: 0, A: 128})
+	if got != (SRGB{R: 99, G: 0, B: 0, A: 128}) {
+		t.Errorf("unexpected conversion of premultiplied color: %v", got)
+	}
+	if FromColor(RGB(1, 2, 3)) != RGB(1, 2, 3) {
+		t.Error("SRGB did not round trip through color.Color")
+	}
+}
+
+func TestSRGBSerialization(t *testing.T) {
 	step := NewStep()
-	m, err := step.Decode(NewBuffer(data)).
-		ConstrainWithinW(200).
-		ExpandCanvas(ExpandCanvas{
-			Left: 5, Right: 5, Top: 5, Bottom: 5,
-			Color: Transparent(""),
-		}).
-		Encode(GetBuffer("out"), LosslessPNG{}).
-		Execute()
+	step.Decode(NewBuffer([]byte{})).
+		Region(Region{X2: 10, Y2: 10, BackgroundColor: RGB(255, 255, 255)})
+	want := `{"region":{"x1":0,"y1":0,"x2":10,"y2":10,"background_color":{"srgb":{"hex":"ffffffff"}}}}`
+	js, err := json.Marshal(step.vertex[1])
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m["out"]) == 0 {
-		t.Fatal("ExpandCanvas with Transparent produced empty output")
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
 	}
 }
 
@@ -1017,6 +1870,216 @@ func TestCopyRectangle(t *testing.T) {
 	}
 }
 
+// ---------------------------------------------------------------------------
+// Node reference tests
+// ---------------------------------------------------------------------------
+
+func TestNodeRefCompositeLayers(t *testing.T) {
+	data := loadTestImage(t)
+	var background, middle NodeRef
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithin(400, 400).Mark(&background).
+		Decode(NewBuffer(data)).
+		ConstrainWithin(200, 200).
+		DrawExactOnto(background, DrawExact{X: 10, Y: 10, W: 200, H: 100, Blend: "overwrite"}).
+		Mark(&middle).
+		Decode(NewBuffer(data)).
+		ConstrainWithin(50, 50).
+		DrawExactOnto(middle, DrawExact{X: 20, Y: 20, W: 50, H: 25, Blend: "compose"}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("layered composite produced empty output")
+	}
+}
+
+func TestNodeRefReuse(t *testing.T) {
+	data := loadTestImage(t)
+	var resized NodeRef
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(200).Mark(&resized).
+		Rotate90().
+		Encode(GetBuffer("rotated"), MozJPEG{}).
+		From(resized).
+		FlipH().
+		Encode(GetBuffer("flipped"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["rotated"]) == 0 || len(m["flipped"]) == 0 {
+		t.Fatal("reused node produced empty output")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{}))
+	image := step.Ref()
+	step.Decode(NewBuffer([]byte{}))
+	canvas := step.Ref()
+	step.From(image).Rotate90()
+	rotated := step.Ref()
+	step.Connect(canvas, rotated, EdgeCanvas)
+	edges := step.innerGraph.edges
+	if len(edges) != 2 {
+		t.Fatalf("expected 2 edges, got %d", len(edges))
+	}
+	if edges[0] != (edge{From: 0, To: 2, Kind: "input"}) {
+		t.Errorf("unexpected input edge %+v", edges[0])
+	}
+	if edges[1] != (edge{From: 1, To: 2, Kind: "canvas"}) {
+		t.Errorf("unexpected canvas edge %+v", edges[1])
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).Connect(0, 5, EdgeInput)
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error for edge to a missing node")
+	}
+
+	step = NewStep()
+	step.Decode(NewBuffer([]byte{})).Rotate90().Connect(0, 1, "sideways")
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected error for unknown edge kind")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Custom node tests
+// ---------------------------------------------------------------------------
+
+func TestAddCustomNode(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		Add(CustomNode{Name: "constrain", Params: map[string]interface{}{"mode": "within", "w": 100}}).
+		Add(CustomNode{Name: "transpose"}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("custom node produced empty output")
+	}
+}
+
+func TestAddCanvasCustomNode(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	m, err := step.Decode(NewBuffer(data)).
+		ConstrainWithinW(100).
+		AddCanvas(func(s *Steps) {
+			s.Decode(NewBuffer(data))
+		}, CustomNode{Name: "copy_rect_to_canvas", Params: RectangleToCanvas{W: 50, H: 50, X: 10, Y: 10}}).
+		Encode(GetBuffer("out"), MozJPEG{}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["out"]) == 0 {
+		t.Fatal("custom canvas node produced empty output")
+	}
+}
+
+type testBlurNode struct {
+	Sigma float64 `json:"sigma"`
+}
+
+func (node *testBlurNode) Kind() string         { return "test_blur" }
+func (node *testBlurNode) Payload() interface{} { return node }
+func (node *testBlurNode) Validate() error {
+	if node.Sigma <= 0 {
+		return errors.New("sigma must be positive")
+	}
+	return nil
+}
+
+func TestRegisterNode(t *testing.T) {
+	RegisterNode("test_blur", func() Node { return &testBlurNode{} })
+
+	node, err := ParseNode([]byte(`{"test_blur":{"sigma":1.5}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blur, ok := node.(*testBlurNode)
+	if !ok || blur.Sigma != 1.5 {
+		t.Fatalf("unexpected node %#v", node)
+	}
+	if _, err := ParseNode([]byte(`{"test_blur":{"sigma":0}}`)); err == nil {
+		t.Error("expected validation error for registered node")
+	}
+
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).Add(&testBlurNode{Sigma: -1})
+	if _, err := step.Execute(); err == nil {
+		t.Error("expected Execute to report the invalid node")
+	}
+}
+
+func TestParseNodeUnknownKind(t *testing.T) {
+	if _, err := ParseNode([]byte(`"rotate_45"`)); err == nil {
+		t.Error("expected error for unknown node kind")
+	}
+	if _, err := ParseNode([]byte(`{"rotate_90":null,"flip_h":null}`)); err == nil {
+		t.Error("expected error for node with two kinds")
+	}
+	node, err := ParseNode([]byte(`"rotate_90"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Kind() != "rotate_90" || node.Payload() != nil {
+		t.Errorf("unexpected node %#v", node)
+	}
+}
+
+func TestFromJSONRoundTrip(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).
+		ConstrainWithinW(200).
+		Branch(func(s *Steps) {
+			s.Rotate90().Encode(GetBuffer("a"), GIF{})
+		}).
+		DrawExact(func(s *Steps) {
+			s.Decode(NewBuffer([]byte{}))
+		}, DrawExact{W: 10, H: 10, Blend: "overwrite"}).
+		Encode(GetBuffer("b"), MozJPEG{})
+
+	parsed, err := FromJSON(step.ToJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parsed.ToJSON()) != string(step.ToJSON()) {
+		t.Errorf("round trip changed the graph:\n%s\n%s", step.ToJSON(), parsed.ToJSON())
+	}
+	if parsed.ioID != step.ioID {
+		t.Errorf("expected next io_id %d, got %d", step.ioID, parsed.ioID)
+	}
+
+	linear, err := FromJSON([]byte(`{"framewise":{"steps":[{"decode":{"io_id":0}},"flip_v",{"encode":{"io_id":1,"preset":"gif"}}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linear.vertex) != 3 || len(linear.innerGraph.edges) != 2 {
+		t.Errorf("unexpected linear graph %s", linear.ToJSON())
+	}
+
+	if _, err := FromJSON([]byte(`{"framewise":{"steps":["rotate_45"]}}`)); err == nil {
+		t.Error("expected error for unknown node kind")
+	}
+	if _, err := FromJSON([]byte(`{"framewise":{"graph":{"nodes":{"0":"flip_h"},"edges":[{"from":0,"to":3,"kind":"input"}]}}}`)); err == nil {
+		t.Error("expected error for edge to a missing node")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Command string test
 // ---------------------------------------------------------------------------
@@ -1036,6 +2099,44 @@ func TestCommand(t *testing.T) {
 	}
 }
 
+func TestCommandWithIO(t *testing.T) {
+	data := loadTestImage(t)
+	step := NewStep()
+	result, err := step.CommandWithIO(NewBuffer(data), GetBuffer("out"), "width=120&mode=max&format=png").
+		ExecuteWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode, ok := result.Encode("out")
+	if !ok || encode.Format() != FormatPNG || encode.W != 120 {
+		t.Errorf("unexpected encode %+v", encode)
+	}
+	if len(result.Outputs["out"]) != encode.Bytes {
+		t.Errorf("expected %d bytes, got %d", encode.Bytes, len(result.Outputs["out"]))
+	}
+}
+
+func TestCommandWithIOJSON(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer(nil)).
+		Encode(GetBuffer("first"), MozJPEG{}).
+		CommandWithIO(NewBuffer(nil), GetBuffer("second"), "format=webp")
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `"2":{"command_string":{"decode":2,"encode":3,"kind":"ir4","value":"format=webp"}}`
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("expected %s in %s", expected, data)
+	}
+	if strings.Contains(string(data), `"to":2`) {
+		t.Errorf("expected the command string to have no input edge in %s", data)
+	}
+	if len(step.inputs) != 2 || len(step.outputs) != 2 || step.outputs[1].getIo() != 3 {
+		t.Errorf("unexpected io %v %v", step.inputs, step.outputs)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // JSON serialization test
 // ---------------------------------------------------------------------------
@@ -1073,6 +2174,75 @@ func TestToJSON(t *testing.T) {
 	}
 }
 
+// ---------------------------------------------------------------------------
+// Graph export tests
+// ---------------------------------------------------------------------------
+
+func TestToDOT(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).
+		ConstrainWithinW(200).
+		DrawExact(func(s *Steps) {
+			s.Decode(NewBuffer([]byte{}))
+		}, DrawExact{W: 10, H: 10, Blend: "overwrite"}).
+		Encode(GetBuffer("out"), MozJPEG{})
+	dot := step.ToDOT()
+	for _, want := range []string{
+		"digraph imageflow {",
+		`n0 [label="decode\nio_id=0"];`,
+		`n1 [label="constrain\nmode=within\nw=200"];`,
+		`n0 -> n1 [label="input"];`,
+		`n1 -> n3 [label="input"];`,
+		`n2 -> n3 [label="canvas", style=dashed];`,
+		`preset={\"mozjpeg\":{\"progressive\":false,\"quality\":90}}`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output missing %q:\n%s", want, dot)
+		}
+	}
+}
+
+func TestToMermaid(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).
+		Rotate90().
+		CopyRectangle(func(s *Steps) {
+			s.Decode(NewBuffer([]byte{}))
+		}, RectangleToCanvas{W: 5, H: 5}).
+		Encode(GetBuffer("out"), GIF{})
+	mermaid := step.ToMermaid()
+	for _, want := range []string{
+		"flowchart TD",
+		`n1["rotate_90"]`,
+		"n0 -->|input| n1",
+		"n1 -->|input| n3",
+		"n2 -.->|canvas| n3",
+		`n4["encode<br/>io_id=2<br/>preset=gif"]`,
+	} {
+		if !strings.Contains(mermaid, want) {
+			t.Errorf("Mermaid output missing %q:\n%s", want, mermaid)
+		}
+	}
+}
+
+func TestGraphRecordingJSON(t *testing.T) {
+	step := NewStep()
+	step.Decode(NewBuffer([]byte{})).
+		GraphRecording(GraphRecording{RecordFrameImages: true}).
+		Encode(GetBuffer("out"), GIF{})
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(step.ToJSON(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	recording, ok := parsed["graph_recording"].(map[string]interface{})
+	if !ok {
+		t.Fatal("JSON missing 'graph_recording' key")
+	}
+	if recording["record_frame_images"] != true {
+		t.Error("record_frame_images not enabled")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Complex pipeline (original TestStep equivalent)
 // ---------------------------------------------------------------------------
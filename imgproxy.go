@@ -0,0 +1,624 @@
+package imageflow
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ImgproxyError is an imgproxy URL which cannot be served
+// Status is 400 for invalid URLs and 403 for missing or wrong signatures.
+// Unsupported lists the options which have no Steps equivalent.
+type ImgproxyError struct {
+	Status      int
+	Message     string
+	Unsupported []string
+}
+
+func (err *ImgproxyError) Error() string {
+	if len(err.Unsupported) > 0 {
+		return fmt.Sprintf("imageflow: imgproxy %d: %s: %s", err.Status, err.Message, strings.Join(err.Unsupported, ", "))
+	}
+	return fmt.Sprintf("imageflow: imgproxy %d: %s", err.Status, err.Message)
+}
+
+func imgproxyBadRequest(format string, args ...interface{}) error {
+	return &ImgproxyError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func imgproxyForbidden(format string, args ...interface{}) error {
+	return &ImgproxyError{Status: http.StatusForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// ImgproxyGravity is the g: option
+// Type is one of no, so, ea, we, noea, nowe, soea, sowe, ce or fp. For fp, X and Y are the focus point from 0 to 1.
+type ImgproxyGravity struct {
+	Type string
+	X    float64
+	Y    float64
+}
+
+var imgproxyGravities = map[string]ConstraintGravity{
+	"no": {X: 50, Y: 0}, "so": {X: 50, Y: 100}, "ea": {X: 100, Y: 50}, "we": {X: 0, Y: 50},
+	"noea": {X: 100, Y: 0}, "nowe": {X: 0, Y: 0}, "soea": {X: 100, Y: 100}, "sowe": {X: 0, Y: 100},
+	"ce": {X: 50, Y: 50},
+}
+
+// percentage returns the gravity in percent, the center when unset
+func (gravity ImgproxyGravity) percentage() ConstraintGravity {
+	if gravity.Type == "fp" {
+		return ConstraintGravity{X: gravity.X * 100, Y: gravity.Y * 100}
+	}
+	if value, ok := imgproxyGravities[gravity.Type]; ok {
+		return value
+	}
+	return ConstraintGravity{X: 50, Y: 50}
+}
+
+// ImgproxyRequest is a parsed imgproxy URL
+// ResizingType is fit, fill, fill-down, force or auto. Width and Height are 0 when omitted.
+// Padding is top, right, bottom and left in pixels. Format is empty to keep the source format.
+type ImgproxyRequest struct {
+	Signature     string
+	ResizingType  string
+	Width         int
+	Height        int
+	Enlarge       bool
+	Extend        bool
+	ExtendGravity ImgproxyGravity
+	Gravity       ImgproxyGravity
+	Quality       int
+	Format        ImageFormat
+	Background    *SRGB
+	Padding       [4]int
+	Rotate        int
+	FlipH         bool
+	FlipV         bool
+	Source        string
+}
+
+// ImgproxyOptions configures the translation of imgproxy URLs
+// Key and Salt are the hex encoded IMGPROXY_KEY and IMGPROXY_SALT, AllowInsecure accepts
+// the insecure and _ signatures. Quality is the default quality, 80 if 0.
+// Presets replaces the encoder of a format and ignores q: for it.
+type ImgproxyOptions struct {
+	Key           string
+	Salt          string
+	AllowInsecure bool
+	Quality       int
+	Presets       map[ImageFormat]Preset
+}
+
+var imgproxyFormats = map[string]ImageFormat{"jpg": FormatJPEG, "jpeg": FormatJPEG, "png": FormatPNG, "gif": FormatGIF, "webp": FormatWebP}
+
+// imgproxySignature is the unpadded url safe base64 HMAC-SHA256 of salt and path
+func imgproxySignature(key string, salt string, path string) (string, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("imageflow: invalid imgproxy key: %w", err)
+	}
+	saltBytes, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("imageflow: invalid imgproxy salt: %w", err)
+	}
+	mac := hmac.New(sha256.New, keyBytes)
+	mac.Write(saltBytes)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// SignImgproxyURL returns path, the options and source of an imgproxy URL, signed with the hex encoded key and salt
+func SignImgproxyURL(key string, salt string, path string) (string, error) {
+	path = "/" + strings.TrimPrefix(path, "/")
+	signature, err := imgproxySignature(key, salt, path)
+	if err != nil {
+		return "", err
+	}
+	return "/" + signature + path, nil
+}
+
+// parseImgproxyBool parses 1, t and true like imgproxy, anything else is false
+func parseImgproxyBool(s string) bool {
+	return s == "1" || s == "t" || s == "true"
+}
+
+// parseImgproxyInt parses a non-negative integer, an empty argument keeps value
+func parseImgproxyInt(s string, value *int) error {
+	if s == "" {
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return imgproxyBadRequest("invalid number %q", s)
+	}
+	*value = v
+	return nil
+}
+
+// parseImgproxyGravity parses type[:x:y], offsets have no Steps equivalent
+func parseImgproxyGravity(args []string) (ImgproxyGravity, string, error) {
+	if len(args) == 0 || args[0] == "" {
+		return ImgproxyGravity{}, "", imgproxyBadRequest("missing gravity type")
+	}
+	gravity := ImgproxyGravity{Type: args[0]}
+	switch {
+	case args[0] == "fp":
+		if len(args) != 3 {
+			return gravity, "", imgproxyBadRequest("fp gravity takes x and y")
+		}
+		for i, value := range []*float64{&gravity.X, &gravity.Y} {
+			v, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || !(v >= 0 && v <= 1) {
+				return gravity, "", imgproxyBadRequest("invalid focus point %q", args[i+1])
+			}
+			*value = v
+		}
+	case args[0] == "sm":
+		return gravity, "g:sm", nil
+	default:
+		if _, ok := imgproxyGravities[args[0]]; !ok {
+			return gravity, "", imgproxyBadRequest("invalid gravity %q", args[0])
+		}
+		if len(args) > 3 {
+			return gravity, "", imgproxyBadRequest("too many gravity arguments")
+		}
+		for _, offset := range args[1:] {
+			if offset != "" && offset != "0" {
+				return gravity, "g offsets", nil
+			}
+		}
+	}
+	return gravity, "", nil
+}
+
+// parseImgproxyFormat parses an extension, unknown formats have no Steps equivalent
+func parseImgproxyFormat(extension string) (ImageFormat, string) {
+	if format, ok := imgproxyFormats[strings.ToLower(extension)]; ok {
+		return format, ""
+	}
+	return "", "f:" + extension
+}
+
+// ParseImgproxyURL parses an imgproxy URL path such as /{signature}/rs:fit:300:200/q:80/plain/{source}@webp
+// and checks its signature. Options without a Steps equivalent fail with an *ImgproxyError listing them.
+func ParseImgproxyURL(urlPath string, options ImgproxyOptions) (*ImgproxyRequest, error) {
+	trimmed := strings.TrimPrefix(urlPath, "/")
+	signature, rest, found := strings.Cut(trimmed, "/")
+	if !found {
+		return nil, imgproxyBadRequest("missing options and source")
+	}
+	request := &ImgproxyRequest{ResizingType: "fit"}
+	if signature == "insecure" || signature == "_" {
+		if !options.AllowInsecure {
+			return nil, imgproxyForbidden("insecure URLs are not allowed")
+		}
+	} else {
+		if options.Key == "" {
+			return nil, imgproxyForbidden("no key to verify the signature")
+		}
+		expected, err := imgproxySignature(options.Key, options.Salt, "/"+rest)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil, imgproxyForbidden("invalid signature")
+		}
+		request.Signature = signature
+	}
+
+	var unsupported []string
+	segments := strings.Split(rest, "/")
+	i := 0
+	for ; i < len(segments) && strings.Contains(segments[i], ":"); i++ {
+		parts := strings.Split(segments[i], ":")
+		reason, err := request.option(parts[0], parts[1:])
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			unsupported = append(unsupported, reason)
+		}
+	}
+	source := segments[i:]
+	if len(source) == 0 || source[0] == "" {
+		return nil, imgproxyBadRequest("missing source")
+	}
+	extension := ""
+	switch source[0] {
+	case "plain":
+		plain := strings.Join(source[1:], "/")
+		if at := strings.LastIndex(plain, "@"); at >= 0 {
+			plain, extension = plain[:at], plain[at+1:]
+		}
+		unescaped, err := url.PathUnescape(plain)
+		if err != nil || unescaped == "" {
+			return nil, imgproxyBadRequest("invalid source %q", plain)
+		}
+		request.Source = unescaped
+	case "enc":
+		unsupported = append(unsupported, "encrypted source")
+	default:
+		encoded := strings.Join(source, "")
+		if dot := strings.LastIndex(encoded, "."); dot >= 0 {
+			encoded, extension = encoded[:dot], encoded[dot+1:]
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil || len(decoded) == 0 {
+			return nil, imgproxyBadRequest("invalid base64 source %q", encoded)
+		}
+		request.Source = string(decoded)
+	}
+	if extension != "" {
+		format, reason := parseImgproxyFormat(extension)
+		if reason != "" {
+			unsupported = append(unsupported, reason)
+		}
+		request.Format = format
+	}
+	if len(unsupported) > 0 {
+		return nil, &ImgproxyError{Status: http.StatusBadRequest, Message: "unsupported options", Unsupported: unsupported}
+	}
+	return request, nil
+}
+
+// option applies one processing option and returns a description if it has no Steps equivalent
+func (request *ImgproxyRequest) option(name string, args []string) (string, error) {
+	switch name {
+	case "resize", "rs":
+		if len(args) > 0 && args[0] != "" {
+			if _, err := request.option("rt", args[:1]); err != nil {
+				return "", err
+			}
+		}
+		if len(args) > 1 {
+			return request.option("s", args[1:])
+		}
+	case "size", "s":
+		if len(args) > 4 {
+			return "", imgproxyBadRequest("too many size arguments")
+		}
+		for i, arg := range args {
+			switch i {
+			case 0:
+				if err := parseImgproxyInt(arg, &request.Width); err != nil {
+					return "", err
+				}
+			case 1:
+				if err := parseImgproxyInt(arg, &request.Height); err != nil {
+					return "", err
+				}
+			case 2:
+				request.Enlarge = parseImgproxyBool(arg)
+			case 3:
+				request.Extend = parseImgproxyBool(arg)
+			}
+		}
+	case "resizing_type", "rt":
+		if len(args) != 1 {
+			return "", imgproxyBadRequest("%s takes one argument", name)
+		}
+		switch args[0] {
+		case "fit", "fill", "fill-down", "force", "auto":
+			request.ResizingType = args[0]
+		default:
+			return "", imgproxyBadRequest("invalid resizing type %q", args[0])
+		}
+	case "width", "w", "height", "h":
+		if len(args) != 1 {
+			return "", imgproxyBadRequest("%s takes one argument", name)
+		}
+		if name[0] == 'w' {
+			return "", parseImgproxyInt(args[0], &request.Width)
+		}
+		return "", parseImgproxyInt(args[0], &request.Height)
+	case "enlarge", "el":
+		request.Enlarge = len(args) > 0 && parseImgproxyBool(args[0])
+	case "extend", "ex":
+		request.Extend = len(args) > 0 && parseImgproxyBool(args[0])
+		if len(args) > 1 {
+			gravity, reason, err := parseImgproxyGravity(args[1:])
+			request.ExtendGravity = gravity
+			return reason, err
+		}
+	case "gravity", "g":
+		gravity, reason, err := parseImgproxyGravity(args)
+		request.Gravity = gravity
+		return reason, err
+	case "quality", "q":
+		if len(args) != 1 {
+			return "", imgproxyBadRequest("%s takes one argument", name)
+		}
+		if err := parseImgproxyInt(args[0], &request.Quality); err != nil || request.Quality > 100 {
+			return "", imgproxyBadRequest("invalid quality %q", args[0])
+		}
+	case "format", "f", "ext":
+		if len(args) != 1 {
+			return "", imgproxyBadRequest("%s takes one argument", name)
+		}
+		format, reason := parseImgproxyFormat(args[0])
+		request.Format = format
+		return reason, nil
+	case "background", "bg":
+		switch len(args) {
+		case 1:
+			if args[0] == "" {
+				request.Background = nil
+				return "", nil
+			}
+			color, err := ParseColor(args[0])
+			if err != nil {
+				return "", imgproxyBadRequest("invalid background %q", args[0])
+			}
+			request.Background = &color
+		case 3:
+			var rgb [3]int
+			for i, arg := range args {
+				if err := parseImgproxyInt(arg, &rgb[i]); err != nil || rgb[i] > 255 {
+					return "", imgproxyBadRequest("invalid background %q", strings.Join(args, ":"))
+				}
+			}
+			color := RGB(uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2]))
+			request.Background = &color
+		default:
+			return "", imgproxyBadRequest("background takes a hex color or r:g:b")
+		}
+	case "padding", "pd":
+		if len(args) == 0 || len(args) > 4 {
+			return "", imgproxyBadRequest("padding takes one to four arguments")
+		}
+		var values [4]int
+		for i, arg := range args {
+			if err := parseImgproxyInt(arg, &values[i]); err != nil {
+				return "", err
+			}
+		}
+		// CSS shorthand: a missing right repeats top, bottom repeats top and left repeats right
+		switch len(args) {
+		case 1:
+			values[1], values[2], values[3] = values[0], values[0], values[0]
+		case 2:
+			values[2], values[3] = values[0], values[1]
+		case 3:
+			values[3] = values[1]
+		}
+		request.Padding = values
+	case "rotate", "rot":
+		if len(args) != 1 {
+			return "", imgproxyBadRequest("%s takes one argument", name)
+		}
+		rotate, err := strconv.Atoi(args[0])
+		if err != nil || rotate%90 != 0 {
+			return "", imgproxyBadRequest("invalid rotation %q, must be a multiple of 90", args[0])
+		}
+		request.Rotate = (rotate%360 + 360) % 360
+	case "flip", "fl":
+		if len(args) == 0 || len(args) > 2 {
+			return "", imgproxyBadRequest("flip takes one or two arguments")
+		}
+		request.FlipH = parseImgproxyBool(args[0])
+		request.FlipV = len(args) > 1 && parseImgproxyBool(args[1])
+	case "auto_rotate", "ar":
+		// libimageflow always applies the EXIF orientation when decoding
+		if len(args) != 1 || !parseImgproxyBool(args[0]) {
+			return name + ":" + strings.Join(args, ":"), nil
+		}
+	default:
+		return name, nil
+	}
+	return "", nil
+}
+
+// format returns the format of the response for a source of format source
+func (request *ImgproxyRequest) format(source ImageFormat) ImageFormat {
+	if request.Format != "" {
+		return request.Format
+	}
+	switch source {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+		return source
+	}
+	return FormatJPEG
+}
+
+// preset returns the encoder of format
+func (request *ImgproxyRequest) preset(format ImageFormat, options ImgproxyOptions) Preset {
+	if preset, ok := options.Presets[format]; ok {
+		return preset
+	}
+	quality := request.Quality
+	if quality == 0 {
+		quality = options.Quality
+	}
+	if quality == 0 {
+		quality = 80
+	}
+	switch format {
+	case FormatPNG:
+		return LosslessPNG{}
+	case FormatGIF:
+		return GIF{}
+	case FormatWebP:
+		return WebP{Quality: quality}
+	}
+	return MozJPEG{Quality: uint(quality)}
+}
+
+// resize returns the region of a w x h image to keep and the size to scale it to
+func (request *ImgproxyRequest) resize(w int, h int) (x, y, regionW, regionH, outW, outH int) {
+	width, height := request.Width, request.Height
+	mode := request.ResizingType
+	if mode == "auto" {
+		mode = "fit"
+		if width > 0 && height > 0 && (width >= height) == (w >= h) {
+			mode = "fill"
+		}
+	}
+	if mode == "force" {
+		if width == 0 {
+			width = w
+		}
+		if height == 0 {
+			height = h
+		}
+		return 0, 0, w, h, width, height
+	}
+	if (mode == "fill" || mode == "fill-down") && (width == 0 || height == 0) {
+		mode = "fit"
+	}
+
+	scaleW, scaleH := float64(width)/float64(w), float64(height)/float64(h)
+	var scale float64
+	switch {
+	case width == 0 && height == 0:
+		scale = 1
+	case width == 0:
+		scale = scaleH
+	case height == 0:
+		scale = scaleW
+	case mode == "fit":
+		scale = math.Min(scaleW, scaleH)
+	default:
+		scale = math.Max(scaleW, scaleH)
+	}
+	if !request.Enlarge {
+		scale = math.Min(scale, 1)
+	}
+	resizedW := int(math.Max(math.Round(float64(w)*scale), 1))
+	resizedH := int(math.Max(math.Round(float64(h)*scale), 1))
+	if mode == "fit" {
+		return 0, 0, w, h, resizedW, resizedH
+	}
+
+	outW, outH = min(width, resizedW), min(height, resizedH)
+	if mode == "fill-down" && (outW < width || outH < height) {
+		// keep the requested aspect ratio when the image is too small to fill it
+		if float64(resizedW)*float64(height) > float64(resizedH)*float64(width) {
+			outW = int(math.Max(math.Round(float64(resizedH)*float64(width)/float64(height)), 1))
+			outH = resizedH
+		} else {
+			outW = resizedW
+			outH = int(math.Max(math.Round(float64(resizedW)*float64(height)/float64(width)), 1))
+		}
+	}
+	regionW = min(int(math.Round(float64(outW)/scale)), w)
+	regionH = min(int(math.Round(float64(outH)/scale)), h)
+	gravity := request.Gravity
+	x = imgproxyOffset(gravity, gravity.X, gravity.percentage().X, w, regionW)
+	y = imgproxyOffset(gravity, gravity.Y, gravity.percentage().Y, h, regionH)
+	return x, y, regionW, regionH, outW, outH
+}
+
+// imgproxyOffset returns the start of a span of size kept from total, centered on a focus point or anchored in percent
+func imgproxyOffset(gravity ImgproxyGravity, focus float64, percentage float64, total int, size int) int {
+	var offset float64
+	if gravity.Type == "fp" {
+		offset = focus*float64(total) - float64(size)/2
+	} else {
+		offset = float64(total-size) * percentage / 100
+	}
+	return int(math.Round(math.Max(0, math.Min(offset, float64(total-size)))))
+}
+
+// Build returns the steps serving the request from source into sink
+// info must have the size of the decoded frame, after EXIF rotation.
+func (request *ImgproxyRequest) Build(info ImageInfo, source IO, sink IO, options ImgproxyOptions) (Steps, error) {
+	w, h := info.Width, info.Height
+	if w <= 0 || h <= 0 {
+		return Steps{}, fmt.Errorf("imageflow: invalid image size %dx%d", w, h)
+	}
+	if request.Rotate == 90 || request.Rotate == 270 {
+		w, h = h, w
+	}
+	x, y, regionW, regionH, outW, outH := request.resize(w, h)
+	finalW, finalH := outW, outH
+	extendW, extendH := 0, 0
+	if request.Extend {
+		extendW, extendH = max(request.Width-outW, 0), max(request.Height-outH, 0)
+		finalW, finalH = finalW+extendW, finalH+extendH
+	}
+	finalW += request.Padding[1] + request.Padding[3]
+	finalH += request.Padding[0] + request.Padding[2]
+
+	step := NewStep()
+	var background NodeRef
+	if request.Background != nil {
+		step.CreateCanvas(finalW, finalH, PixelBGRA32, *request.Background)
+		background = step.Ref()
+	}
+	step.Decode(source)
+	switch request.Rotate {
+	case 90:
+		step.Rotate90()
+	case 180:
+		step.Rotate180()
+	case 270:
+		step.Rotate270()
+	}
+	if request.FlipH {
+		step.FlipH()
+	}
+	if request.FlipV {
+		step.FlipV()
+	}
+	if x != 0 || y != 0 || regionW != w || regionH != h {
+		step.Region(Region{
+			X1: float64(x), Y1: float64(y), X2: float64(x + regionW), Y2: float64(y + regionH),
+			BackgroundColor: Transparent(""),
+		})
+	}
+	if outW != regionW || outH != regionH {
+		step.Constrain(Constrain{Mode: ModeDistort, W: float64(outW), H: float64(outH)})
+	}
+
+	var padColor Color = Transparent("")
+	if request.Background != nil {
+		padColor = *request.Background
+	}
+	if extendW > 0 || extendH > 0 {
+		gravity := request.ExtendGravity.percentage()
+		left := int(math.Round(float64(extendW) * gravity.X / 100))
+		top := int(math.Round(float64(extendH) * gravity.Y / 100))
+		step.ExpandCanvas(ExpandCanvas{
+			Left: float64(left), Right: float64(extendW - left), Top: float64(top), Bottom: float64(extendH - top), Color: padColor,
+		})
+	}
+	if request.Padding != [4]int{} {
+		step.ExpandCanvas(ExpandCanvas{
+			Top: float64(request.Padding[0]), Right: float64(request.Padding[1]),
+			Bottom: float64(request.Padding[2]), Left: float64(request.Padding[3]), Color: padColor,
+		})
+	}
+	if request.Background != nil {
+		step.DrawExactOnto(background, DrawExact{W: float32(finalW), H: float32(finalH), Blend: "compose"})
+	}
+	step.Encode(sink, request.preset(request.format(info.Format()), options))
+	return step, nil
+}
+
+// Execute serves the request from source and returns the encoded image and its MIME type
+func (request *ImgproxyRequest) Execute(source IO, options ImgproxyOptions) ([]byte, string, error) {
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := orientedImageInfo(data)
+	if err != nil {
+		return nil, "", err
+	}
+	out := &capture{}
+	step, err := request.Build(*info, NewBuffer(data), out, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := step.Execute(); err != nil {
+		return nil, "", err
+	}
+	return out.data, request.format(info.Format()).MimeType(), nil
+}
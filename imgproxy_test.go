@@ -0,0 +1,216 @@
+package imageflow
+
+import (
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	imgproxyTestKey  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	imgproxyTestSalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+)
+
+func TestImgproxyExecute(t *testing.T) {
+	data := loadTestImage(t)
+	options := ImgproxyOptions{AllowInsecure: true}
+	request, err := ParseImgproxyURL("/insecure/rs:fill:100:80/bg:255:255:255/pd:10/plain/photo.jpg@png", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, mime, err := request.Execute(NewBuffer(data), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/png" {
+		t.Errorf("unexpected mime type %q", mime)
+	}
+	frame, err := DecodeFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 120 || frame.Bounds().Dy() != 100 {
+		t.Errorf("expected 120x100, got %v", frame.Bounds())
+	}
+}
+
+func TestImgproxyExecuteOrientation(t *testing.T) {
+	data := rotatedJPEG(t, 200, 100)
+	options := ImgproxyOptions{AllowInsecure: true}
+	for path, expected := range map[string]image.Point{
+		"/insecure/rs:fit:50:50/plain/photo.jpg@png":         {X: 25, Y: 50},
+		"/insecure/rs:fill:100:100/g:so/plain/photo.jpg@png": {X: 100, Y: 100},
+	} {
+		request, err := ParseImgproxyURL(path, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _, err := request.Execute(NewBuffer(data), options)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		frame, err := DecodeFrame(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Bounds().Size() != expected {
+			t.Errorf("%s: expected %v, got %v", path, expected, frame.Bounds().Size())
+		}
+	}
+}
+
+func TestParseImgproxyURL(t *testing.T) {
+	request, err := ParseImgproxyURL("/_/rs:fill-down:300::1:1/g:fp:0.25:0.75/q:70/f:webp/bg:ff0000/pd:1:2:3/rot:-90/fl:1:0/ar:1/"+
+		"plain/https://example.org/a%20b.jpg", ImgproxyOptions{AllowInsecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := RGB(255, 0, 0)
+	expected := &ImgproxyRequest{
+		ResizingType: "fill-down", Width: 300, Enlarge: true, Extend: true,
+		Gravity: ImgproxyGravity{Type: "fp", X: 0.25, Y: 0.75}, Quality: 70, Format: FormatWebP,
+		Background: &red, Padding: [4]int{1, 2, 3, 2}, Rotate: 270, FlipH: true,
+		Source: "https://example.org/a b.jpg",
+	}
+	if !reflect.DeepEqual(request, expected) {
+		t.Errorf("expected %+v, got %+v", expected, request)
+	}
+
+	request, err = ParseImgproxyURL("/insecure/w:100/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.gif",
+		ImgproxyOptions{AllowInsecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Source != "http://example.com/images/curiosity.jpg" || request.Format != FormatGIF || request.Width != 100 {
+		t.Errorf("unexpected %+v", request)
+	}
+}
+
+func TestParseImgproxyURLErrors(t *testing.T) {
+	options := ImgproxyOptions{AllowInsecure: true}
+	for path, status := range map[string]int{
+		"/insecure":                          400,
+		"/insecure/rs:fit:100/":              400,
+		"/insecure/rt:crop/plain/a.jpg":      400,
+		"/insecure/w:-1/plain/a.jpg":         400,
+		"/insecure/q:101/plain/a.jpg":        400,
+		"/insecure/g:up/plain/a.jpg":         400,
+		"/insecure/g:fp:2:0/plain/a.jpg":     400,
+		"/insecure/bg:300:0:0/plain/a.jpg":   400,
+		"/insecure/rot:45/plain/a.jpg":       400,
+		"/insecure/pd:1:2:3:4:5/plain/a.jpg": 400,
+		"/insecure/w:100/!!!":                400,
+		"/rs:fit:100:100/plain/a.jpg":        403,
+		"/abcdef/rs:fit:100:100/plain/a.jpg": 403,
+	} {
+		_, err := ParseImgproxyURL(path, options)
+		var imgproxyErr *ImgproxyError
+		if !errors.As(err, &imgproxyErr) || imgproxyErr.Status != status {
+			t.Errorf("%s: expected status %d, got %v", path, status, err)
+		}
+	}
+}
+
+func TestImgproxyUnsupported(t *testing.T) {
+	_, err := ParseImgproxyURL("/insecure/rs:fit:100:100/g:sm/blur:5/g:no:10:0/ar:0/f:avif/plain/a.jpg", ImgproxyOptions{AllowInsecure: true})
+	var imgproxyErr *ImgproxyError
+	if !errors.As(err, &imgproxyErr) || imgproxyErr.Status != 400 {
+		t.Fatalf("expected a 400, got %v", err)
+	}
+	expected := []string{"g:sm", "blur", "g offsets", "ar:0", "f:avif"}
+	if !reflect.DeepEqual(imgproxyErr.Unsupported, expected) {
+		t.Errorf("expected %v, got %v", expected, imgproxyErr.Unsupported)
+	}
+	if !strings.Contains(err.Error(), "g:sm, blur") {
+		t.Errorf("expected the options in %q", err)
+	}
+}
+
+func TestImgproxySignature(t *testing.T) {
+	path := "/rs:fill:300:400:0/g:ce/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png"
+	signed, err := SignImgproxyURL(imgproxyTestKey, imgproxyTestSalt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base64.urlsafe_b64encode(hmac.new(key, salt + path, hashlib.sha256).digest()).rstrip(b"=")
+	if signed != "/33QyyG2ZoERl9ekmHupf6bUac3OtNZdCEo6MRSGpljI"+path {
+		t.Errorf("unexpected signed URL %s", signed)
+	}
+	options := ImgproxyOptions{Key: imgproxyTestKey, Salt: imgproxyTestSalt}
+	if _, err := ParseImgproxyURL(signed, options); err != nil {
+		t.Error(err)
+	}
+	_, err = ParseImgproxyURL(strings.Replace(signed, "300", "3000", 1), options)
+	var imgproxyErr *ImgproxyError
+	if !errors.As(err, &imgproxyErr) || imgproxyErr.Status != 403 {
+		t.Errorf("expected a tampered URL to be rejected, got %v", err)
+	}
+	if _, err := ParseImgproxyURL("/insecure"+path, options); err == nil {
+		t.Error("expected insecure URLs to be rejected by default")
+	}
+	if _, err := SignImgproxyURL("zz", "", path); err == nil {
+		t.Error("expected an error for a key which is not hex")
+	}
+}
+
+func TestImgproxyResize(t *testing.T) {
+	for _, test := range []struct {
+		options                            string
+		x, y, regionW, regionH, outW, outH int
+	}{
+		{"rs:fit:500:500", 0, 0, 1000, 600, 500, 300},
+		{"rs:fit:2000:2000", 0, 0, 1000, 600, 1000, 600},
+		{"rs:fit:2000:2000:1", 0, 0, 1000, 600, 2000, 1200},
+		{"rs:fit:0:300", 0, 0, 1000, 600, 500, 300},
+		{"rs:fill:300:300", 200, 0, 600, 600, 300, 300},
+		{"rs:fill:300:300/g:we", 0, 0, 600, 600, 300, 300},
+		{"rs:fill:300:300/g:fp:0.9:0.5", 400, 0, 600, 600, 300, 300},
+		{"rs:fill:2000:600", 0, 0, 1000, 600, 1000, 600},
+		{"rs:fill-down:2000:600", 0, 150, 1000, 300, 1000, 300},
+		{"rs:force:100:0", 0, 0, 1000, 600, 100, 600},
+		{"rs:auto:300:300", 200, 0, 600, 600, 300, 300},
+		{"rs:auto:300:400", 0, 0, 1000, 600, 300, 180},
+	} {
+		request, err := ParseImgproxyURL("/_/"+test.options+"/plain/a.jpg", ImgproxyOptions{AllowInsecure: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y, regionW, regionH, outW, outH := request.resize(1000, 600)
+		if x != test.x || y != test.y || regionW != test.regionW || regionH != test.regionH || outW != test.outW || outH != test.outH {
+			t.Errorf("%s: got region %d,%d,%d,%d size %dx%d", test.options, x, y, regionW, regionH, outW, outH)
+		}
+	}
+}
+
+func TestImgproxyBuild(t *testing.T) {
+	info := ImageInfo{Width: 600, Height: 1000, PreferredMimeType: "image/png"}
+	request, err := ParseImgproxyURL("/_/rs:fit:300:300:0:1/ex:1:so/rot:90/pd:5/bg:white/q:50/plain/a.png@jpg",
+		ImgproxyOptions{AllowInsecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, err := request.Build(info, NewBuffer(nil), GetBuffer("out"), ImgproxyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := step.toJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`"create_canvas":{"w":310,"h":310`,
+		`"rotate_90"`,
+		`"constrain":{"mode":"distort","w":300,"h":180`,
+		`"expand_canvas":{"left":0,"right":0,"top":120,"bottom":0`,
+		`"expand_canvas":{"left":5,"right":5,"top":5,"bottom":5`,
+		`"draw_image_exact":{"w":310,"h":310,"x":0,"y":0,"blend":"compose"`,
+		`"mozjpeg":{"quality":50`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package imageflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// ImageInfo describes a source image
+// FrameDecodesInto is the pixel format of the decoded frame, like bgra_32 for images with alpha.
+type ImageInfo struct {
+	Width              int    `json:"image_width"`
+	Height             int    `json:"image_height"`
+	PreferredMimeType  string `json:"preferred_mime_type"`
+	PreferredExtension string `json:"preferred_extension"`
+	FrameDecodesInto   string `json:"frame_decodes_into"`
+	Lossless           bool   `json:"lossless"`
+	MultipleFrames     bool   `json:"multiple_frames"`
+}
+
+// Format returns the format of the image
+func (info ImageInfo) Format() ImageFormat {
+	return formatFromMimeType(info.PreferredMimeType)
+}
+
+// HasAlpha reports whether the decoded frame has an alpha channel
+func (info ImageInfo) HasAlpha() bool {
+	return info.FrameDecodesInto == "bgra_32"
+}
+
+// GetImageInfo reads the size and format of an image without decoding it
+func GetImageInfo(source ioOperation) (*ImageInfo, error) {
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return imageInfo(data)
+}
+
+func imageInfo(data []byte) (*ImageInfo, error) {
+	job, err := newJob()
+	if err != nil {
+		return nil, err
+	}
+	defer job.CleanUp()
+
+	if err := job.AddInput(0, data); err != nil {
+		return nil, err
+	}
+	response, err := job.Send("v1/get_image_info", []byte(`{"io_id":0}`))
+	if err != nil {
+		return nil, err
+	}
+	return parseImageInfo(response)
+}
+
+// orientedImageInfo is imageInfo with the width and height of the decoded frame
+// The decoder applies the EXIF orientation, which swaps the sides for orientations 5 to 8.
+func orientedImageInfo(data []byte) (*ImageInfo, error) {
+	info, err := imageInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	if jpegOrientation(data) >= 5 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info, nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 if there is none
+// Orientations 5 to 8 are rotated by 90 degrees.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		if segment := data[i+4 : i+2+length]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of a TIFF header, 1 if there is none
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := int(ifd) + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// parseImageInfo reads the image_info of a v1/get_image_info response
+func parseImageInfo(response []byte) (*ImageInfo, error) {
+	var parsed struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+		Data    struct {
+			ImageInfo *ImageInfo `json:"image_info"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &parsed); err != nil {
+		return nil, fmt.Errorf("imageflow: invalid response: %w", err)
+	}
+	if !parsed.Success || parsed.Data.ImageInfo == nil {
+		return nil, fmt.Errorf("imageflow: %s", parsed.Message)
+	}
+	return parsed.Data.ImageInfo, nil
+}
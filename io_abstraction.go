@@ -14,6 +14,9 @@ type ioOperation interface {
 	getIo() uint
 }
 
+// IO is any of the inputs and outputs, like Buffer, File or URL, for use in lists of sources
+type IO = ioOperation
+
 func (file File) toBuffer() ([]byte, error) {
 	return os.ReadFile(file.filename)
 }
@@ -120,3 +123,26 @@ func NewFile(filename string) *File {
 		filename: filename,
 	}
 }
+
+// capture is an internal io operation which keeps the encoded data for further processing
+type capture struct {
+	iOID uint
+	data []byte
+}
+
+func (file *capture) toBuffer() ([]byte, error) {
+	return file.data, nil
+}
+
+func (file *capture) toOutput(data []byte, m map[string][]byte) (map[string][]byte, error) {
+	file.data = data
+	return m, nil
+}
+
+func (file *capture) setIo(id uint) {
+	file.iOID = id
+}
+
+func (file *capture) getIo() uint {
+	return file.iOID
+}
@@ -0,0 +1,264 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Node is an operation in the graph, identified by its kind and JSON payload
+// It can be used for nodes of libimageflow that don't have a builder method yet.
+// A node with a nil payload is serialized as a bare string, like "rotate_90".
+// If a Node also implements Validate() error, it is called when the node is added or parsed.
+type Node interface {
+	Kind() string
+	Payload() interface{}
+}
+
+// CustomNode is a Node with a fixed kind and payload
+type CustomNode struct {
+	Name   string
+	Params interface{}
+}
+
+// Kind returns the name of the node
+func (node CustomNode) Kind() string {
+	return node.Name
+}
+
+// Payload returns the parameters of the node
+func (node CustomNode) Payload() interface{} {
+	return node.Params
+}
+
+// nodeStep adapts a Node to a step
+type nodeStep struct {
+	node Node
+}
+
+// toStep is used to convert a Node to step
+func (step nodeStep) toStep() interface{} {
+	payload := step.node.Payload()
+	if payload == nil {
+		return step.node.Kind()
+	}
+	return singleMap(step.node.Kind(), payload)
+}
+
+type validator interface {
+	Validate() error
+}
+
+// Add appends node to the graph with the current node as its input
+func (steps *Steps) Add(node Node) *Steps {
+	if err := validateNode(node); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	steps.input(nodeStep{node: node}.toStep())
+	return steps
+}
+
+// AddCanvas appends node to the graph with the current node as its input and the result of f as its canvas
+func (steps *Steps) AddCanvas(f func(steps *Steps), node Node) *Steps {
+	if err := validateNode(node); err != nil {
+		steps.fail(err)
+		return steps
+	}
+	return steps.canvas(f, nodeStep{node: node})
+}
+
+func validateNode(node Node) error {
+	if node.Kind() == "" {
+		return fmt.Errorf("imageflow: node kind is empty")
+	}
+	if v, ok := node.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("imageflow: invalid %s node: %w", node.Kind(), err)
+		}
+	}
+	return nil
+}
+
+// builtinNodes are the node kinds understood by libimageflow without registration
+var builtinNodes = map[string]bool{
+	"decode":              true,
+	"encode":              true,
+	"constrain":           true,
+	"region":              true,
+	"region_percent":      true,
+	"crop":                true,
+	"crop_whitespace":     true,
+	"rotate_90":           true,
+	"rotate_180":          true,
+	"rotate_270":          true,
+	"flip_h":              true,
+	"flip_v":              true,
+	"transpose":           true,
+	"apply_orientation":   true,
+	"fill_rect":           true,
+	"expand_canvas":       true,
+	"create_canvas":       true,
+	"round_image_corners": true,
+	"watermark":           true,
+	"copy_rect_to_canvas": true,
+	"draw_image_exact":    true,
+	"command_string":      true,
+	"color_filter_srgb":   true,
+	"color_matrix_srgb":   true,
+	"white_balance_histogram_area_threshold_srgb": true,
+}
+
+var registry = struct {
+	sync.RWMutex
+	factories map[string]func() Node
+}{factories: map[string]func() Node{}}
+
+// RegisterNode makes a node kind known to ParseNode and FromJSON
+// factory must return a pointer, the payload of parsed nodes is unmarshaled into it.
+func RegisterNode(kind string, factory func() Node) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.factories[kind] = factory
+}
+
+// ParseNode parses a single node in libimageflow's JSON form
+// Registered kinds are returned as the type created by their factory, built-in kinds as CustomNode.
+func ParseNode(data []byte) (Node, error) {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		return newNode(name, nil)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("imageflow: node must be a string or an object: %w", err)
+	}
+	if len(object) != 1 {
+		return nil, fmt.Errorf("imageflow: node must have exactly one kind, got %d", len(object))
+	}
+	for kind, payload := range object {
+		return newNode(kind, payload)
+	}
+	return nil, nil
+}
+
+func newNode(kind string, payload json.RawMessage) (Node, error) {
+	registry.RLock()
+	factory, registered := registry.factories[kind]
+	registry.RUnlock()
+
+	var node Node
+	switch {
+	case registered:
+		node = factory()
+		if payload != nil {
+			if err := json.Unmarshal(payload, node); err != nil {
+				return nil, fmt.Errorf("imageflow: invalid %s node: %w", kind, err)
+			}
+		}
+	case builtinNodes[kind]:
+		custom := CustomNode{Name: kind}
+		if payload != nil {
+			custom.Params = payload
+		}
+		node = custom
+	default:
+		return nil, fmt.Errorf("imageflow: unknown node kind %q", kind)
+	}
+	if err := validateNode(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// FromJSON parses a job in the form produced by ToJSON
+// Both framewise graphs and framewise steps are accepted. The io_id of decode and encode nodes
+// are kept, use BindInput and BindOutput to attach data to them before calling Execute.
+func FromJSON(data []byte) (Steps, error) {
+	var job struct {
+		Framewise struct {
+			Graph *struct {
+				Nodes map[string]json.RawMessage `json:"nodes"`
+				Edges []edge                     `json:"edges"`
+			} `json:"graph"`
+			Steps []json.RawMessage `json:"steps"`
+		} `json:"framewise"`
+		GraphRecording *GraphRecording `json:"graph_recording"`
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Steps{}, err
+	}
+	steps := NewStep()
+	steps.recording = job.GraphRecording
+
+	var nodes []json.RawMessage
+	if job.Framewise.Graph != nil {
+		nodes = make([]json.RawMessage, len(job.Framewise.Graph.Nodes))
+		for key, node := range job.Framewise.Graph.Nodes {
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(nodes) {
+				return Steps{}, fmt.Errorf("imageflow: invalid node key %q", key)
+			}
+			nodes[index] = node
+		}
+	} else {
+		nodes = job.Framewise.Steps
+	}
+
+	for i, raw := range nodes {
+		node, err := ParseNode(raw)
+		if err != nil {
+			return Steps{}, fmt.Errorf("node %d: %w", i, err)
+		}
+		steps.vertex = append(steps.vertex, nodeStep{node: node}.toStep())
+		if id, ok := nodeIoID(raw); ok && id >= steps.ioID {
+			steps.ioID = id + 1
+		}
+		if job.Framewise.Graph == nil && i > 0 {
+			steps.innerGraph.AddEdge(uint(i-1), uint(i), string(EdgeInput))
+		}
+	}
+	if job.Framewise.Graph != nil {
+		for _, e := range job.Framewise.Graph.Edges {
+			steps.Connect(NodeRef(e.From), NodeRef(e.To), EdgeKind(e.Kind))
+		}
+	}
+	if steps.err != nil {
+		return Steps{}, steps.err
+	}
+	if len(steps.vertex) > 0 {
+		steps.last = uint(len(steps.vertex) - 1)
+	}
+	return steps, nil
+}
+
+// nodeIoID returns the io_id referenced by a node, if any
+func nodeIoID(raw json.RawMessage) (int, bool) {
+	var object map[string]struct {
+		IoID *int `json:"io_id"`
+	}
+	if json.Unmarshal(raw, &object) != nil {
+		return 0, false
+	}
+	for _, payload := range object {
+		if payload.IoID != nil {
+			return *payload.IoID, true
+		}
+	}
+	return 0, false
+}
+
+// BindInput attaches data to the decode or watermark node using ioID
+func (steps *Steps) BindInput(ioID int, task ioOperation) *Steps {
+	task.setIo(uint(ioID))
+	steps.inputs = append(steps.inputs, task)
+	return steps
+}
+
+// BindOutput attaches a destination to the encode node using ioID
+func (steps *Steps) BindOutput(ioID int, task ioOperation) *Steps {
+	task.setIo(uint(ioID))
+	steps.outputs = append(steps.outputs, task)
+	return steps
+}
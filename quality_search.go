@@ -0,0 +1,306 @@
+package imageflow
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// qualityPreset is implemented by presets with a quality that can be searched
+type qualityPreset interface {
+	presetInterface
+	withQuality(quality int) presetInterface
+	qualityRange() (int, int)
+}
+
+// withQuality returns the preset with quality
+func (preset MozJPEG) withQuality(quality int) presetInterface {
+	preset.Quality = uint(quality)
+	return preset
+}
+
+// qualityRange returns the lowest and highest quality of the preset
+func (preset MozJPEG) qualityRange() (int, int) {
+	return 1, 100
+}
+
+// withQuality returns the preset with quality
+func (preset LibJPEGTurbo) withQuality(quality int) presetInterface {
+	preset.Quality = quality
+	return preset
+}
+
+// qualityRange returns the lowest and highest quality of the preset
+func (preset LibJPEGTurbo) qualityRange() (int, int) {
+	return 1, 100
+}
+
+// withQuality returns the preset with quality
+func (preset WebP) withQuality(quality int) presetInterface {
+	preset.Quality = quality
+	return preset
+}
+
+// qualityRange returns the lowest and highest quality of the preset
+func (preset WebP) qualityRange() (int, int) {
+	return 1, 100
+}
+
+// withQuality returns the preset with quality, the minimum quality is lowered so pngquant doesn't give up
+func (preset LossyPNG) withQuality(quality int) presetInterface {
+	preset.Quality = quality
+	if preset.MinimumQuality > quality {
+		preset.MinimumQuality = 0
+	}
+	return preset
+}
+
+// qualityRange returns the lowest and highest quality of the preset
+func (preset LossyPNG) qualityRange() (int, int) {
+	return 1, 100
+}
+
+// QualityCandidate is an encode tried while searching for a quality
+// SSIM is only computed by EncodeToQuality.
+type QualityCandidate struct {
+	Quality int
+	Bytes   int
+	SSIM    float64
+}
+
+// QualityResult is the outcome of EncodeToSize and EncodeToQuality
+// Result holds all outputs of the graph, including the chosen encode.
+// Quality, Bytes and SSIM describe the chosen encode, Candidates every encode that was tried.
+type QualityResult struct {
+	*Result
+	Quality    int
+	Bytes      int
+	SSIM       float64
+	Candidates []QualityCandidate
+}
+
+// SizeBudgetError is returned by EncodeToSize if the image is larger than the budget even at the lowest quality
+type SizeBudgetError struct {
+	MaxBytes   int
+	MinQuality int
+	Bytes      int
+}
+
+func (err *SizeBudgetError) Error() string {
+	return fmt.Sprintf("imageflow: %d bytes at quality %d exceeds the budget of %d bytes", err.Bytes, err.MinQuality, err.MaxBytes)
+}
+
+// EncodeToSize encodes with the highest quality of preset that fits in maxBytes
+// preset must be MozJPEG, LibJPEGTurbo, WebP or LossyPNG, its quality is searched by bisection.
+// The graph is executed once and the frame is kept losslessly, so every further attempt only encodes.
+// Other outputs of the graph are produced as with ExecuteWithResult. A *SizeBudgetError is returned
+// if even the lowest quality is too large.
+func (steps *Steps) EncodeToSize(sink ioOperation, preset presetInterface, maxBytes int) (*QualityResult, error) {
+	tunable, ok := preset.(qualityPreset)
+	if !ok {
+		return nil, fmt.Errorf("imageflow: preset %T has no quality to search", preset)
+	}
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("imageflow: invalid byte budget %d", maxBytes)
+	}
+	search, err := steps.newQualitySearch(tunable)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := tunable.qualityRange()
+	quality, found, err := bisectQuality(lo, hi, false, func(quality int) (bool, error) {
+		candidate, err := search.try(quality)
+		if err != nil {
+			return false, err
+		}
+		return candidate.Bytes <= maxBytes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &SizeBudgetError{MaxBytes: maxBytes, MinQuality: lo, Bytes: search.candidates[lo].Bytes}
+	}
+	return search.finish(sink, quality)
+}
+
+// SimilarityError is returned by EncodeToQuality if the image is less similar than required even at the highest quality
+type SimilarityError struct {
+	MinSSIM    float64
+	MaxQuality int
+	SSIM       float64
+}
+
+func (err *SimilarityError) Error() string {
+	return fmt.Sprintf("imageflow: ssim %.5f at quality %d is below the required %.5f", err.SSIM, err.MaxQuality, err.MinSSIM)
+}
+
+// EncodeToQuality encodes with the lowest quality of preset that keeps at least minSSIM similarity to the frame
+// preset must be MozJPEG, LibJPEGTurbo, WebP or LossyPNG, its quality is searched by bisection.
+// Each candidate is decoded again and scored with SSIM against the frame before encoding.
+// The score and size of every candidate are reported in Candidates. A *SimilarityError is returned
+// if even the highest quality is not similar enough.
+func (steps *Steps) EncodeToQuality(sink ioOperation, preset presetInterface, minSSIM float64) (*QualityResult, error) {
+	tunable, ok := preset.(qualityPreset)
+	if !ok {
+		return nil, fmt.Errorf("imageflow: preset %T has no quality to search", preset)
+	}
+	if minSSIM <= 0 || minSSIM > 1 {
+		return nil, fmt.Errorf("imageflow: invalid ssim target %v", minSSIM)
+	}
+	search, err := steps.newQualitySearch(tunable)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := tunable.qualityRange()
+	quality, found, err := bisectQuality(lo, hi, true, func(quality int) (bool, error) {
+		candidate, err := search.score(quality)
+		if err != nil {
+			return false, err
+		}
+		return candidate.SSIM >= minSSIM, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &SimilarityError{MinSSIM: minSSIM, MaxQuality: hi, SSIM: search.candidates[hi].SSIM}
+	}
+	return search.finish(sink, quality)
+}
+
+// qualitySearch encodes a cached frame at different qualities
+type qualitySearch struct {
+	result      *Result
+	referenceIo int
+	reference   []byte
+	frame       image.Image
+	preset      qualityPreset
+	candidates  map[int]QualityCandidate
+	encodes     map[int]EncodeResult
+	data        map[int][]byte
+	tried       []int
+}
+
+// newQualitySearch executes a copy of the graph, keeping the current frame losslessly as the reference
+// steps is left as it was, so it can be searched or executed again.
+func (steps *Steps) newQualitySearch(preset qualityPreset) (*qualitySearch, error) {
+	reference := &capture{}
+	result, err := steps.clone().Encode(reference, LosslessPNG{}).ExecuteWithResult()
+	if err != nil {
+		return nil, err
+	}
+	return &qualitySearch{
+		result:      result,
+		referenceIo: int(reference.getIo()),
+		reference:   reference.data,
+		preset:      preset,
+		candidates:  make(map[int]QualityCandidate),
+		encodes:     make(map[int]EncodeResult),
+		data:        make(map[int][]byte),
+	}, nil
+}
+
+// try encodes the reference at quality
+func (search *qualitySearch) try(quality int) (QualityCandidate, error) {
+	if candidate, ok := search.candidates[quality]; ok {
+		return candidate, nil
+	}
+	out := &capture{}
+	step := NewStep()
+	result, err := step.Decode(NewBuffer(search.reference)).
+		Encode(out, search.preset.withQuality(quality)).
+		ExecuteWithResult()
+	if err != nil {
+		return QualityCandidate{}, err
+	}
+	candidate := QualityCandidate{Quality: quality, Bytes: len(out.data)}
+	search.candidates[quality] = candidate
+	search.data[quality] = out.data
+	if len(result.Encodes) > 0 {
+		search.encodes[quality] = result.Encodes[0]
+	}
+	search.tried = append(search.tried, quality)
+	return candidate, nil
+}
+
+// score encodes the reference at quality and compares it to the reference
+func (search *qualitySearch) score(quality int) (QualityCandidate, error) {
+	candidate, err := search.try(quality)
+	if err != nil || candidate.SSIM != 0 {
+		return candidate, err
+	}
+	if search.frame == nil {
+		search.frame, err = png.Decode(bytes.NewReader(search.reference))
+		if err != nil {
+			return candidate, err
+		}
+	}
+	decoded, err := DecodeFrame(search.data[quality])
+	if err != nil {
+		return candidate, err
+	}
+	candidate.SSIM, err = SSIM(search.frame, decoded)
+	if err != nil {
+		return candidate, err
+	}
+	search.candidates[quality] = candidate
+	return candidate, nil
+}
+
+// finish writes the encode at quality to sink and replaces the reference in the result with it
+func (search *qualitySearch) finish(sink ioOperation, quality int) (*QualityResult, error) {
+	result := search.result
+	outputs, err := sink.toOutput(search.data[quality], result.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	result.Outputs = outputs
+
+	encode := search.encodes[quality]
+	encode.IoID = search.referenceIo
+	encode.Key = ioKey(sink)
+	encode.Bytes = len(search.data[quality])
+	for i := range result.Encodes {
+		if result.Encodes[i].IoID == search.referenceIo {
+			result.Encodes[i] = encode
+		}
+	}
+
+	candidates := make([]QualityCandidate, 0, len(search.tried))
+	for _, tried := range search.tried {
+		candidates = append(candidates, search.candidates[tried])
+	}
+	return &QualityResult{
+		Result:     result,
+		Quality:    quality,
+		Bytes:      encode.Bytes,
+		SSIM:       search.candidates[quality].SSIM,
+		Candidates: candidates,
+	}, nil
+}
+
+// bisectQuality finds the boundary of a predicate which is monotonic over [lo, hi]
+// If ascending, pass holds from the boundary up and the lowest passing quality is returned,
+// otherwise pass holds from the boundary down and the highest passing quality is returned.
+// found is false if no quality passes.
+func bisectQuality(lo int, hi int, ascending bool, pass func(quality int) (bool, error)) (int, bool, error) {
+	best, found := 0, false
+	for lo <= hi {
+		mid := lo + (hi-lo)/2
+		ok, err := pass(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			best, found = mid, true
+		}
+		if ok == ascending {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	return best, found, nil
+}
@@ -0,0 +1,246 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RenditionOptions describes a responsive image set
+// Widths The widths to render, in pixels. Widths larger than the source are skipped.
+// BaseWidth and Densities Alternatively, render BaseWidth at each pixel density, like 1, 1.5 and 2.
+// Formats The presets every width is encoded with. The last one is the fallback used by the img element.
+// Sizes The sizes attribute, like "(max-width: 600px) 100vw, 600px".
+// Hint Resampling hints for the downscaling.
+type RenditionOptions struct {
+	Widths    []int
+	BaseWidth int
+	Densities []float64
+	Formats   []Preset
+	Sizes     string
+	Hint      ConstraintHint
+}
+
+// Rendition is one image of a RenditionSet
+// Density is set when the set was rendered from densities instead of widths.
+type Rendition struct {
+	Key      string      `json:"key"`
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	Density  float64     `json:"density,omitempty"`
+	Format   ImageFormat `json:"format"`
+	MimeType string      `json:"mime_type"`
+	Bytes    int         `json:"bytes"`
+	Data     []byte      `json:"-"`
+}
+
+// RenditionSet is the result of Renditions
+// Source has the size of the decoded frame, after EXIF rotation.
+type RenditionSet struct {
+	Source     ImageInfo   `json:"source"`
+	Sizes      string      `json:"sizes,omitempty"`
+	Renditions []Rendition `json:"renditions"`
+}
+
+type renditionTarget struct {
+	width   int
+	density float64
+}
+
+// Renditions renders a responsive image set from source
+// The source is decoded once and every width and format is a branch of the same graph.
+// When several presets encode the same format, only the first of them is kept for each width.
+func Renditions(source ioOperation, options RenditionOptions) (*RenditionSet, error) {
+	if len(options.Formats) == 0 {
+		return nil, fmt.Errorf("imageflow: renditions need at least one format")
+	}
+	if err := options.Hint.validate(); err != nil {
+		return nil, err
+	}
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, err
+	}
+	info, err := orientedImageInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := renditionTargets(options, info.Width)
+	if err != nil {
+		return nil, err
+	}
+
+	step := NewStep()
+	step.Decode(NewBuffer(data))
+	for _, target := range targets {
+		// the height never binds, it only keeps the aspect ratio of the constraint
+		height := math.Ceil(float64(target.width) * float64(info.Height) / float64(info.Width))
+		constraint := Constrain{Mode: ModeWithin, W: float64(target.width), H: height, Hint: options.Hint}
+		step.Branch(func(step *Steps) {
+			step.Constrain(constraint)
+			for i, preset := range options.Formats {
+				step.Branch(func(step *Steps) {
+					step.Encode(GetBuffer(renditionKey(target.width, i)), preset)
+				})
+			}
+		})
+	}
+	result, err := step.ExecuteWithResult()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &RenditionSet{Source: *info, Sizes: options.Sizes}
+	for _, target := range targets {
+		seen := make(map[ImageFormat]bool)
+		for i := range options.Formats {
+			key := renditionKey(target.width, i)
+			encode, _ := result.Encode(key)
+			if seen[encode.Format()] {
+				continue
+			}
+			seen[encode.Format()] = true
+			set.Renditions = append(set.Renditions, Rendition{
+				Key:      key,
+				Width:    encode.W,
+				Height:   encode.H,
+				Density:  target.density,
+				Format:   encode.Format(),
+				MimeType: encode.PreferredMimeType,
+				Bytes:    len(result.Outputs[key]),
+				Data:     result.Outputs[key],
+			})
+		}
+	}
+	return set, nil
+}
+
+// renditionTargets returns the widths to render, skipping the ones larger than the source
+// If every width is too large, the source width is used.
+func renditionTargets(options RenditionOptions, sourceWidth int) ([]renditionTarget, error) {
+	var targets []renditionTarget
+	if len(options.Densities) > 0 {
+		if options.BaseWidth <= 0 {
+			return nil, fmt.Errorf("imageflow: densities need a base width")
+		}
+		for _, density := range options.Densities {
+			if density <= 0 {
+				return nil, fmt.Errorf("imageflow: invalid density %v", density)
+			}
+			targets = append(targets, renditionTarget{width: int(math.Round(float64(options.BaseWidth) * density)), density: density})
+		}
+	} else {
+		for _, width := range options.Widths {
+			if width <= 0 {
+				return nil, fmt.Errorf("imageflow: invalid width %d", width)
+			}
+			targets = append(targets, renditionTarget{width: width})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("imageflow: renditions need widths or densities")
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].width < targets[j].width })
+	kept := targets[:0]
+	for _, target := range targets {
+		if target.width > sourceWidth {
+			continue
+		}
+		if len(kept) > 0 && kept[len(kept)-1].width == target.width {
+			continue
+		}
+		kept = append(kept, target)
+	}
+	if len(kept) == 0 {
+		kept = append(kept, renditionTarget{width: sourceWidth, density: targets[0].density})
+	}
+	return kept, nil
+}
+
+// renditionKey returns the buffer key of a width and format
+func renditionKey(width int, format int) string {
+	return fmt.Sprintf("%dw-%d", width, format)
+}
+
+// Formats returns the formats of the set in the order of the presets
+func (set *RenditionSet) Formats() []ImageFormat {
+	var formats []ImageFormat
+	seen := make(map[ImageFormat]bool)
+	for _, rendition := range set.Renditions {
+		if !seen[rendition.Format] {
+			seen[rendition.Format] = true
+			formats = append(formats, rendition.Format)
+		}
+	}
+	return formats
+}
+
+// SrcSet returns the srcset attribute for the renditions of format
+// url returns the address a rendition is served from.
+func (set *RenditionSet) SrcSet(format ImageFormat, url func(Rendition) string) string {
+	var candidates []string
+	for _, rendition := range set.Renditions {
+		if rendition.Format != format {
+			continue
+		}
+		descriptor := strconv.Itoa(rendition.Width) + "w"
+		if rendition.Density != 0 {
+			descriptor = strconv.FormatFloat(rendition.Density, 'f', -1, 64) + "x"
+		}
+		candidates = append(candidates, url(rendition)+" "+descriptor)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Picture returns a picture element with a source for every format and an img for the fallback format
+// The img uses the largest rendition of the fallback format as src, width and height.
+// Sizes is left out for sets rendered from densities, as it only applies to width descriptors.
+func (set *RenditionSet) Picture(url func(Rendition) string, alt string) string {
+	formats := set.Formats()
+	if len(formats) == 0 {
+		return ""
+	}
+	fallback := formats[len(formats)-1]
+	sizes := ""
+	if set.Sizes != "" && !set.hasDensities() {
+		sizes = fmt.Sprintf(` sizes="%s"`, html.EscapeString(set.Sizes))
+	}
+
+	var builder strings.Builder
+	builder.WriteString("<picture>\n")
+	for _, format := range formats[:len(formats)-1] {
+		fmt.Fprintf(&builder, "  <source type=\"%s\" srcset=\"%s\"%s>\n",
+			html.EscapeString(format.MimeType()), html.EscapeString(set.SrcSet(format, url)), sizes)
+	}
+	var largest Rendition
+	for _, rendition := range set.Renditions {
+		if rendition.Format == fallback && rendition.Width >= largest.Width {
+			largest = rendition
+		}
+	}
+	fmt.Fprintf(&builder, "  <img src=\"%s\" srcset=\"%s\"%s width=\"%d\" height=\"%d\" alt=\"%s\">\n",
+		html.EscapeString(url(largest)), html.EscapeString(set.SrcSet(fallback, url)), sizes,
+		largest.Width, largest.Height, html.EscapeString(alt))
+	builder.WriteString("</picture>")
+	return builder.String()
+}
+
+// hasDensities reports whether the renditions use density descriptors instead of widths
+func (set *RenditionSet) hasDensities() bool {
+	for _, rendition := range set.Renditions {
+		if rendition.Density != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Manifest returns the set as JSON, without the image data
+func (set *RenditionSet) Manifest() ([]byte, error) {
+	return json.MarshalIndent(set, "", "  ")
+}
@@ -0,0 +1,180 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRenditions(t *testing.T) {
+	data := loadTestImage(t)
+	info, err := GetImageInfo(NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := Renditions(NewBuffer(data), RenditionOptions{
+		Widths:  []int{320, 160, info.Width + 100},
+		Formats: []Preset{WebP{Quality: 80}, MozJPEG{Quality: 80}},
+		Sizes:   "100vw",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Renditions) != 4 {
+		t.Fatalf("expected 2 widths in 2 formats, got %+v", set.Renditions)
+	}
+	for i, width := range []int{160, 160, 320, 320} {
+		rendition := set.Renditions[i]
+		if rendition.Width != width || rendition.Bytes == 0 || rendition.Bytes != len(rendition.Data) {
+			t.Errorf("unexpected rendition %+v", rendition)
+		}
+		if rendition.Height != width*info.Height/info.Width && rendition.Height != width*info.Height/info.Width+1 {
+			t.Errorf("rendition %s is %dx%d, the aspect ratio changed", rendition.Key, rendition.Width, rendition.Height)
+		}
+	}
+	if set.Renditions[0].Format != FormatWebP || set.Renditions[1].Format != FormatJPEG {
+		t.Errorf("unexpected formats %v", set.Formats())
+	}
+}
+
+func TestRenditionsSameFormat(t *testing.T) {
+	data := loadTestImage(t)
+	set, err := Renditions(NewBuffer(data), RenditionOptions{
+		Widths:  []int{100, 200},
+		Formats: []Preset{MozJPEG{Quality: 80}, LibJPEGTurbo{Quality: 80}, LosslessPNG{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Renditions) != 4 {
+		t.Fatalf("expected one rendition per width and format, got %+v", set.Renditions)
+	}
+	if srcset := set.SrcSet(FormatJPEG, renditionURL); strings.Count(srcset, "w,") != 1 {
+		t.Errorf("expected 2 jpeg candidates, got %q", srcset)
+	}
+}
+
+func TestRenditionsOrientation(t *testing.T) {
+	set, err := Renditions(NewBuffer(rotatedJPEG(t, 200, 100)), RenditionOptions{Widths: []int{50}, Formats: []Preset{LosslessPNG{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Source.Width != 100 || set.Source.Height != 200 || set.Renditions[0].Width != 50 || set.Renditions[0].Height != 100 {
+		t.Errorf("expected the rotated size, got %+v %+v", set.Source, set.Renditions[0])
+	}
+}
+
+func TestRenditionTargets(t *testing.T) {
+	targets, err := renditionTargets(RenditionOptions{Widths: []int{800, 400, 2000, 400}}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].width != 400 || targets[1].width != 800 {
+		t.Errorf("unexpected targets %+v", targets)
+	}
+
+	targets, _ = renditionTargets(RenditionOptions{Widths: []int{2000, 3000}}, 1000)
+	if len(targets) != 1 || targets[0].width != 1000 {
+		t.Errorf("expected the source width, got %+v", targets)
+	}
+
+	targets, _ = renditionTargets(RenditionOptions{BaseWidth: 300, Densities: []float64{1, 1.5, 2, 4}}, 1000)
+	if len(targets) != 3 || targets[1].width != 450 || targets[1].density != 1.5 {
+		t.Errorf("unexpected density targets %+v", targets)
+	}
+
+	if _, err := renditionTargets(RenditionOptions{Densities: []float64{1}}, 1000); err == nil {
+		t.Error("expected error for densities without a base width")
+	}
+	if _, err := renditionTargets(RenditionOptions{Widths: []int{0}}, 1000); err == nil {
+		t.Error("expected error for an invalid width")
+	}
+	if _, err := renditionTargets(RenditionOptions{}, 1000); err == nil {
+		t.Error("expected error without widths")
+	}
+}
+
+func testRenditionSet() *RenditionSet {
+	return &RenditionSet{
+		Sizes: "(max-width: 600px) 100vw, 600px",
+		Renditions: []Rendition{
+			{Key: "300w-0", Width: 300, Height: 200, Format: FormatWebP, MimeType: "image/webp"},
+			{Key: "300w-1", Width: 300, Height: 200, Format: FormatJPEG, MimeType: "image/jpeg"},
+			{Key: "600w-0", Width: 600, Height: 400, Format: FormatWebP, MimeType: "image/webp"},
+			{Key: "600w-1", Width: 600, Height: 400, Format: FormatJPEG, MimeType: "image/jpeg"},
+		},
+	}
+}
+
+func renditionURL(rendition Rendition) string {
+	return "/img/photo-" + rendition.Key + "." + rendition.Format.Extension()
+}
+
+func TestSrcSet(t *testing.T) {
+	set := testRenditionSet()
+	expected := "/img/photo-300w-0.webp 300w, /img/photo-600w-0.webp 600w"
+	if srcset := set.SrcSet(FormatWebP, renditionURL); srcset != expected {
+		t.Errorf("expected %q, got %q", expected, srcset)
+	}
+
+	set.Renditions = []Rendition{{Width: 300, Density: 1, Format: FormatPNG}, {Width: 450, Density: 1.5, Format: FormatPNG}}
+	expected = "a 1x, a 1.5x"
+	if srcset := set.SrcSet(FormatPNG, func(Rendition) string { return "a" }); srcset != expected {
+		t.Errorf("expected %q, got %q", expected, srcset)
+	}
+}
+
+func TestPicture(t *testing.T) {
+	markup := testRenditionSet().Picture(renditionURL, `A "photo"`)
+	expected := `<picture>
+  <source type="image/webp" srcset="/img/photo-300w-0.webp 300w, /img/photo-600w-0.webp 600w" sizes="(max-width: 600px) 100vw, 600px">
+  <img src="/img/photo-600w-1.jpg" srcset="/img/photo-300w-1.jpg 300w, /img/photo-600w-1.jpg 600w" sizes="(max-width: 600px) 100vw, 600px" width="600" height="400" alt="A &#34;photo&#34;">
+</picture>`
+	if markup != expected {
+		t.Errorf("unexpected markup\n%s", markup)
+	}
+	densities := &RenditionSet{Sizes: "100vw", Renditions: []Rendition{
+		{Key: "300w-0", Width: 300, Height: 200, Density: 1, Format: FormatJPEG},
+		{Key: "600w-0", Width: 600, Height: 400, Density: 2, Format: FormatJPEG},
+	}}
+	if markup := densities.Picture(renditionURL, ""); strings.Contains(markup, "sizes=") {
+		t.Errorf("expected no sizes with density descriptors\n%s", markup)
+	}
+	if (&RenditionSet{}).Picture(renditionURL, "") != "" {
+		t.Error("expected no markup for an empty set")
+	}
+}
+
+func TestRenditionManifest(t *testing.T) {
+	set := testRenditionSet()
+	set.Renditions[0].Data = []byte("data")
+	manifest, err := set.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(manifest), "ZGF0YQ") {
+		t.Error("manifest should not contain the image data")
+	}
+	var parsed RenditionSet
+	if err := json.Unmarshal(manifest, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Renditions) != 4 || parsed.Renditions[2].Format != FormatWebP || parsed.Renditions[2].Width != 600 {
+		t.Errorf("unexpected manifest %s", manifest)
+	}
+}
+
+func TestParseImageInfo(t *testing.T) {
+	info, err := parseImageInfo([]byte(`{"success":true,"code":200,"message":"OK","data":{"image_info":{
+		"preferred_mime_type":"image/png","preferred_extension":"png","lossless":true,"multiple_frames":false,
+		"image_width":640,"image_height":480,"frame_decodes_into":"bgra_32"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 640 || info.Height != 480 || info.Format() != FormatPNG || !info.HasAlpha() || !info.Lossless {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if _, err := parseImageInfo([]byte(`{"success":false,"message":"unsupported format"}`)); err == nil {
+		t.Error("expected error for a failed response")
+	}
+}
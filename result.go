@@ -0,0 +1,96 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Result is the outcome of executing a graph
+// Outputs holds the data of GetBuffer outputs by key, Encodes describes every encode node.
+type Result struct {
+	Outputs map[string][]byte
+	Encodes []EncodeResult
+}
+
+// EncodeResult describes an image produced by an encode node
+// Key is the key of a GetBuffer output or the name of a NewFile output.
+// Preset is the encoder libimageflow used, for Auto it is the encoder it chose.
+type EncodeResult struct {
+	IoID               int    `json:"io_id"`
+	Key                string `json:"-"`
+	W                  int    `json:"w"`
+	H                  int    `json:"h"`
+	Bytes              int    `json:"-"`
+	Preset             string `json:"preset"`
+	PreferredMimeType  string `json:"preferred_mime_type"`
+	PreferredExtension string `json:"preferred_extension"`
+}
+
+// Format returns the format of the encoded image
+func (encode EncodeResult) Format() ImageFormat {
+	return formatFromMimeType(encode.PreferredMimeType)
+}
+
+// Encode returns the EncodeResult for key
+func (result *Result) Encode(key string) (EncodeResult, bool) {
+	for _, encode := range result.Encodes {
+		if encode.Key == key {
+			return encode, true
+		}
+	}
+	return EncodeResult{}, false
+}
+
+// responseError reports a response of an endpoint with a status other than 200
+// The message of the JSON response is used when there is one.
+func responseError(method string, status int, response []byte) error {
+	var parsed struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(response, &parsed); err != nil || parsed.Message == "" {
+		parsed.Message = string(response)
+	}
+	return fmt.Errorf("imageflow: %s returned status %d: %s", method, status, parsed.Message)
+}
+
+// parseEncodes reads the encodes of a v1/execute response
+func parseEncodes(response []byte, outputs []ioOperation, sizes map[int]int) ([]EncodeResult, error) {
+	var parsed struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+		Data    struct {
+			JobResult struct {
+				Encodes []EncodeResult `json:"encodes"`
+			} `json:"job_result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &parsed); err != nil {
+		return nil, fmt.Errorf("imageflow: invalid response: %w", err)
+	}
+	if !parsed.Success {
+		return nil, fmt.Errorf("imageflow: %s", parsed.Message)
+	}
+	encodes := parsed.Data.JobResult.Encodes
+	for i := range encodes {
+		encodes[i].Bytes = sizes[encodes[i].IoID]
+		for _, output := range outputs {
+			if int(output.getIo()) == encodes[i].IoID {
+				encodes[i].Key = ioKey(output)
+			}
+		}
+	}
+	return encodes, nil
+}
+
+// ioKey returns the key or name of an io operation
+func ioKey(operation ioOperation) string {
+	switch operation := operation.(type) {
+	case *Buffer:
+		return operation.key
+	case *File:
+		return operation.filename
+	case *URL:
+		return operation.url
+	}
+	return ""
+}
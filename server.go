@@ -0,0 +1,240 @@
+package imageflow
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes of a ServerError
+const (
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInvalidCommand   = "invalid_command"
+	CodeTooLarge         = "too_large"
+	CodeNotFound         = "not_found"
+	CodeNotAnImage       = "not_an_image"
+	CodeSourceFailed     = "source_failed"
+	CodeProcessingFailed = "processing_failed"
+)
+
+// ServerError is a request the Server could not serve
+// It is written as JSON, {"code": Code, "message": Message}, with status Status.
+type ServerError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *ServerError) Error() string {
+	return fmt.Sprintf("imageflow: %d %s: %s", err.Status, err.Code, err.Message)
+}
+
+// Server is a http.Handler resizing originals from Source with the command string in the query
+// Mount it with http.StripPrefix so the request path is the path of the original.
+// AllowedKeys limits the command string keys, nil is PublicCommandKeys.
+// MaxWidth and MaxHeight reject commands which ask for or would produce a larger image, 0 is unlimited.
+// CacheControl is sent with every image, "public, max-age=31536000" if empty.
+// OnError, if set, is called with every error before it is written.
+// Signer, if set, rejects requests without a valid signature with 403, see URLSigner.
+type Server struct {
+	Source       Source
+	Signer       *URLSigner
+	AllowedKeys  []string
+	MaxWidth     int
+	MaxHeight    int
+	CacheControl string
+	OnError      func(r *http.Request, err error)
+}
+
+// ServeHTTP serves GET and HEAD requests, originals are passed through when the query is empty
+// Only originals libimageflow can decode are passed through, other files are a 415.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := server.serve(w, r); err != nil {
+		server.writeError(w, r, err)
+	}
+}
+
+// serve is used to handle a request and return the error to write
+func (server *Server) serve(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return &ServerError{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Message: r.Method + " is not allowed"}
+	}
+	query := r.URL.RawQuery
+	var expiry time.Time
+	if server.Signer != nil {
+		var err error
+		if query, expiry, err = server.Signer.Verify(requestPath(r), query); err != nil {
+			return err
+		}
+	}
+	cmd, err := server.command(query)
+	if err != nil {
+		return err
+	}
+
+	original, err := server.Source.Open(r.Context(), r.URL.Path)
+	if errors.Is(err, ErrSourceNotFound) {
+		return &ServerError{Status: http.StatusNotFound, Code: CodeNotFound, Message: r.URL.Path + " was not found"}
+	}
+	if err != nil {
+		return &ServerError{Status: http.StatusBadGateway, Code: CodeSourceFailed, Message: err.Error()}
+	}
+	etag := server.etag(original, cmd)
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == "*" || strings.Contains(match, etag)) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	data, mime := original.Data, ""
+	if len(cmd.Keys()) == 0 {
+		// only images are passed through, other files could be served as html from this origin
+		info, err := imageInfo(original.Data)
+		if err != nil || info.PreferredMimeType == "" {
+			return &ServerError{Status: http.StatusUnsupportedMediaType, Code: CodeNotAnImage, Message: r.URL.Path + " is not an image"}
+		}
+		mime = info.PreferredMimeType
+	} else {
+		if err := server.checkOutputSize(original.Data, cmd); err != nil {
+			return err
+		}
+		step := NewStep()
+		result, err := step.CommandWithIO(NewBuffer(original.Data), GetBuffer("image"), cmd.String()).ExecuteWithResult()
+		if err != nil {
+			return &ServerError{Status: http.StatusInternalServerError, Code: CodeProcessingFailed, Message: err.Error()}
+		}
+		data, mime = result.Outputs["image"], http.DetectContentType(result.Outputs["image"])
+		if encode, ok := result.Encode("image"); ok && encode.PreferredMimeType != "" {
+			mime = encode.PreferredMimeType
+		}
+	}
+
+	cacheControl := server.CacheControl
+	if cacheControl == "" {
+		cacheControl = "public, max-age=31536000"
+	}
+	if !expiry.IsZero() {
+		cacheControl = capMaxAge(cacheControl, int64(expiry.Sub(server.Signer.now()).Seconds()))
+	}
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", original.ModTime, bytes.NewReader(data))
+	return nil
+}
+
+var maxAgeDirective = regexp.MustCompile(`(?i)\b(s-maxage|max-age)=(\d+)`)
+
+// capMaxAge lowers the max-age and s-maxage of cacheControl to seconds, so caches drop signed URLs when they expire
+func capMaxAge(cacheControl string, seconds int64) string {
+	seconds = max(seconds, 0)
+	capped := maxAgeDirective.ReplaceAllStringFunc(cacheControl, func(directive string) string {
+		name, value, _ := strings.Cut(directive, "=")
+		if age, err := strconv.ParseInt(value, 10, 64); err == nil && age <= seconds {
+			return directive
+		}
+		return name + "=" + strconv.FormatInt(seconds, 10)
+	})
+	if !maxAgeDirective.MatchString(capped) {
+		capped += ", max-age=" + strconv.FormatInt(seconds, 10)
+	}
+	return capped
+}
+
+// requestPath returns the path the client requested, before any http.StripPrefix
+func requestPath(r *http.Request) string {
+	if parsed, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return parsed.Path
+	}
+	return r.URL.Path
+}
+
+// command parses and limits the command string of a query
+func (server *Server) command(query string) (*CommandString, error) {
+	allowed := server.AllowedKeys
+	if allowed == nil {
+		allowed = PublicCommandKeys
+	}
+	cmd, err := ParseCommandStringAllowed(query, allowed)
+	if err != nil {
+		return nil, &ServerError{Status: http.StatusBadRequest, Code: CodeInvalidCommand, Message: err.Error()}
+	}
+	zoom := cmd.Zoom
+	if zoom == 0 {
+		zoom = 1
+	}
+	for _, limit := range []struct{ value, max int }{
+		{cmd.Width, server.MaxWidth}, {cmd.MaxWidth, server.MaxWidth},
+		{cmd.Height, server.MaxHeight}, {cmd.MaxHeight, server.MaxHeight},
+	} {
+		if limit.max > 0 && float64(limit.value)*zoom > float64(limit.max) {
+			return nil, &ServerError{Status: http.StatusBadRequest, Code: CodeTooLarge,
+				Message: fmt.Sprintf("%s is larger than %dx%d", cmd.String(), server.MaxWidth, server.MaxHeight)}
+		}
+	}
+	return cmd, nil
+}
+
+// checkOutputSize rejects commands which would produce an image larger than MaxWidth x MaxHeight
+// A height alone can still give a huge width for a narrow original, so the size of the original is needed.
+func (server *Server) checkOutputSize(data []byte, cmd *CommandString) error {
+	if server.MaxWidth <= 0 && server.MaxHeight <= 0 {
+		return nil
+	}
+	info, err := imageInfo(data)
+	if err != nil {
+		return &ServerError{Status: http.StatusInternalServerError, Code: CodeProcessingFailed, Message: err.Error()}
+	}
+	width, height := info.Width, info.Height
+	if (cmd.Autorotate == nil || *cmd.Autorotate) && jpegOrientation(data) >= 5 {
+		width, height = height, width
+	}
+	w, h := cmd.outputSize(width, height)
+	if (server.MaxWidth > 0 && w > server.MaxWidth) || (server.MaxHeight > 0 && h > server.MaxHeight) {
+		return &ServerError{Status: http.StatusBadRequest, Code: CodeTooLarge,
+			Message: fmt.Sprintf("%s would produce %dx%d, larger than %dx%d", cmd.String(), w, h, server.MaxWidth, server.MaxHeight)}
+	}
+	return nil
+}
+
+// etag identifies the original and the canonical command string
+func (server *Server) etag(original *Original, cmd *CommandString) string {
+	hash := sha256.New()
+	if original.ETag != "" {
+		hash.Write([]byte(original.ETag))
+	} else {
+		hash.Write(original.Data)
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(cmd.String()))
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// writeError writes err as JSON, errors which are not a *ServerError are a 500
+func (server *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if server.OnError != nil {
+		server.OnError(r, err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		serverErr = &ServerError{Status: http.StatusInternalServerError, Code: CodeProcessingFailed, Message: err.Error()}
+	}
+	body, _ := json.Marshal(serverErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("ETag")
+	w.WriteHeader(serverErr.Status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
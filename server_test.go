@@ -0,0 +1,174 @@
+package imageflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// newTestServer returns a Server for a directory holding cat.jpg with content data
+func newTestServer(t *testing.T, data []byte) *Server {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cat.jpg"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{Source: DirectorySource(dir), MaxWidth: 2000, MaxHeight: 2000}
+}
+
+// testPNG returns a small PNG any decoder reads
+func testPNG(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestServer(t *testing.T) {
+	server := newTestServer(t, loadTestImage(t))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cat.jpg?width=100&format=png", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder.Header().Get("Content-Type") != "image/png" ||
+		recorder.Header().Get("Content-Length") != strconv.Itoa(recorder.Body.Len()) {
+		t.Errorf("unexpected headers %v", recorder.Header())
+	}
+	frame, err := DecodeFrame(recorder.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 100 {
+		t.Errorf("expected a width of 100, got %v", frame.Bounds())
+	}
+}
+
+func TestServerPassthrough(t *testing.T) {
+	data := testPNG(t)
+	server := newTestServer(t, data)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cat.jpg", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != string(data) {
+		t.Fatalf("unexpected response %d %q", recorder.Code, recorder.Body)
+	}
+	header := recorder.Header()
+	if header.Get("Content-Type") != "image/png" || header.Get("Content-Length") != strconv.Itoa(len(data)) ||
+		header.Get("Cache-Control") != "public, max-age=31536000" || header.Get("ETag") == "" || header.Get("Last-Modified") == "" {
+		t.Errorf("unexpected headers %v", header)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/cat.jpg", nil)
+	request.Header.Set("If-None-Match", header.Get("ETag"))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("expected 304, got %d", recorder.Code)
+	}
+
+	original := &Original{Data: data}
+	if server.etag(original, &CommandString{}) != header.Get("ETag") ||
+		server.etag(original, &CommandString{Width: 100}) == header.Get("ETag") {
+		t.Error("expected the etag to depend on the command string")
+	}
+}
+
+func TestServerPassthroughNotAnImage(t *testing.T) {
+	for _, data := range []string{"<html><script>alert(1)</script></html>", `<svg xmlns="http://www.w3.org/2000/svg"/>`} {
+		server := newTestServer(t, []byte(data))
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cat.jpg", nil))
+		var body ServerError
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		if recorder.Code != http.StatusUnsupportedMediaType || body.Code != CodeNotAnImage ||
+			recorder.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected a 415 for %q, got %d %s", data, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	server := newTestServer(t, []byte("image"))
+	for _, test := range []struct {
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{http.MethodPost, "/cat.jpg", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/cat.jpg?widht=100", http.StatusBadRequest, CodeInvalidCommand},
+		{http.MethodGet, "/cat.jpg?webp.quality=5", http.StatusBadRequest, CodeInvalidCommand},
+		{http.MethodGet, "/cat.jpg?width=3000", http.StatusBadRequest, CodeTooLarge},
+		{http.MethodGet, "/cat.jpg?width=1500&zoom=2", http.StatusBadRequest, CodeTooLarge},
+		{http.MethodGet, "/dog.jpg", http.StatusNotFound, CodeNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+		var body ServerError
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: %v", test.method, test.target, err)
+		}
+		if recorder.Code != test.status || body.Code != test.code || recorder.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: expected %d %s, got %d %s", test.method, test.target, test.status, test.code, recorder.Code, recorder.Body)
+		}
+	}
+
+	var logged error
+	server = &Server{Source: HTTPSource{BaseURL: "http://127.0.0.1:0"}, OnError: func(r *http.Request, err error) { logged = err }}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cat.jpg", nil))
+	if recorder.Code != http.StatusBadGateway || logged == nil {
+		t.Errorf("expected a 502 for an unreachable origin, got %d", recorder.Code)
+	}
+}
+
+func TestServerOutputTooLarge(t *testing.T) {
+	var wide bytes.Buffer
+	if err := png.Encode(&wide, image.NewGray(image.Rect(0, 0, 1000, 10))); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, wide.Bytes())
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cat.jpg?height=100&scale=both", nil))
+	var body ServerError
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if recorder.Code != http.StatusBadRequest || body.Code != CodeTooLarge {
+		t.Errorf("expected a 400 for a 10000x100 output, got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	exif := func(order string, orientation byte) []byte {
+		tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+		tiff[18] = orientation
+		if order == "MM" {
+			tiff = []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+			tiff[19] = orientation
+		}
+		segment := append([]byte("Exif\x00\x00"), tiff...)
+		jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00, 0xFF, 0xE1, 0x00, byte(len(segment) + 2)}
+		return append(append(jpeg, segment...), 0xFF, 0xDA)
+	}
+	for _, test := range []struct {
+		data     []byte
+		expected int
+	}{
+		{exif("II", 6), 6},
+		{exif("MM", 8), 8},
+		{exif("II", 9), 1},
+		{exif("MM", 3)[:20], 1},
+		{[]byte{0xFF, 0xD8, 0xFF, 0xDA}, 1},
+		{[]byte("\x89PNG"), 1},
+	} {
+		if orientation := jpegOrientation(test.data); orientation != test.expected {
+			t.Errorf("expected orientation %d, got %d for % x", test.expected, orientation, test.data)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package imageflow
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Error codes of a ServerError for signed URLs
+const (
+	CodeInvalidSignature = "invalid_signature"
+	CodeExpired          = "expired"
+)
+
+// URLSigner signs image URLs with HMAC-SHA256 over the path and the normalized query
+// Sign uses the first of Keys and Verify accepts any of them, so a new key can be put
+// first and the old one removed once the URLs signed with it are gone.
+// Now defaults to time.Now and is used for expiry.
+type URLSigner struct {
+	Keys []string
+	Now  func() time.Time
+}
+
+// signingPayload returns the path and the query sorted by key, without signature
+func signingPayload(path string, query url.Values) string {
+	query.Del("signature")
+	if encoded := query.Encode(); encoded != "" {
+		return path + "?" + encoded
+	}
+	return path
+}
+
+// Sign returns rawURL, such as /images/cat.jpg?width=300, with a signature parameter added
+// A zero expires signs a URL which never expires, otherwise an expires parameter is added.
+// Use it as a template function to generate image URLs.
+func (signer URLSigner) Sign(rawURL string, expires time.Time) (string, error) {
+	if len(signer.Keys) == 0 || signer.Keys[0] == "" {
+		return "", fmt.Errorf("imageflow: no key to sign URLs with")
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	query.Del("expires")
+	if !expires.IsZero() {
+		query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	}
+	mac := hmacSHA256([]byte(signer.Keys[0]), signingPayload(parsed.Path, query))
+	query.Set("signature", base64.RawURLEncoding.EncodeToString(mac))
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// Verify checks the signature and expiry of a path and its raw query
+// It returns the query without the signature and expires parameters, ready for ParseCommandString,
+// and the expiry, zero for URLs which never expire. Errors are a *ServerError with status 403.
+func (signer URLSigner) Verify(path string, rawQuery string) (string, time.Time, error) {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", time.Time{}, signatureError(CodeInvalidSignature, "invalid query")
+	}
+	signature := query.Get("signature")
+	if signature == "" || len(query["signature"]) > 1 {
+		return "", time.Time{}, signatureError(CodeInvalidSignature, "missing signature")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", time.Time{}, signatureError(CodeInvalidSignature, "invalid signature")
+	}
+	payload := signingPayload(path, query)
+	valid := false
+	for _, key := range signer.Keys {
+		if key != "" && hmac.Equal(decoded, hmacSHA256([]byte(key), payload)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", time.Time{}, signatureError(CodeInvalidSignature, "invalid signature")
+	}
+
+	var expiry time.Time
+	if expires := query.Get("expires"); expires != "" {
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return "", time.Time{}, signatureError(CodeInvalidSignature, "invalid expires")
+		}
+		expiry = time.Unix(unix, 0)
+		if signer.now().Unix() > unix {
+			return "", time.Time{}, signatureError(CodeExpired, "the URL expired at "+expiry.UTC().Format(time.RFC3339))
+		}
+	}
+	query.Del("expires")
+	return query.Encode(), expiry, nil
+}
+
+// now returns the current time from Now, time.Now if unset
+func (signer URLSigner) now() time.Time {
+	if signer.Now != nil {
+		return signer.Now()
+	}
+	return time.Now()
+}
+
+func signatureError(code string, message string) error {
+	return &ServerError{Status: http.StatusForbidden, Code: code, Message: message}
+}
@@ -0,0 +1,125 @@
+package imageflow
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	signer := URLSigner{Keys: []string{"new", "old"}, Now: func() time.Time { return now }}
+	signed, err := signer.Sign("/images/cat.jpg?width=300&format=webp", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the query is sorted, so the same URL always gets the same signature
+	if !strings.HasPrefix(signed, "/images/cat.jpg?format=webp&signature=") || !strings.HasSuffix(signed, "&width=300") {
+		t.Errorf("unexpected signed URL %s", signed)
+	}
+	parsed, _ := url.Parse(signed)
+	query, expiry, err := signer.Verify(parsed.Path, parsed.RawQuery)
+	if err != nil || query != "format=webp&width=300" || !expiry.IsZero() {
+		t.Errorf("unexpected query %q, expiry %v, %v", query, expiry, err)
+	}
+
+	reordered := "width=300&signature=" + parsed.Query().Get("signature") + "&format=webp"
+	if _, _, err := signer.Verify(parsed.Path, reordered); err != nil {
+		t.Errorf("expected the order of parameters not to matter, got %v", err)
+	}
+
+	old, _ := URLSigner{Keys: []string{"old"}}.Sign("/images/cat.jpg?width=300", time.Time{})
+	parsed, _ = url.Parse(old)
+	if _, _, err := signer.Verify(parsed.Path, parsed.RawQuery); err != nil {
+		t.Errorf("expected URLs signed with an older key to be valid, got %v", err)
+	}
+	if _, _, err := (URLSigner{Keys: []string{"new"}}).Verify(parsed.Path, parsed.RawQuery); err == nil {
+		t.Error("expected URLs signed with a retired key to be rejected")
+	}
+	if _, err := (URLSigner{}).Sign("/images/cat.jpg", time.Time{}); err == nil {
+		t.Error("expected an error without keys")
+	}
+}
+
+func TestURLSignerRejects(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	signer := URLSigner{Keys: []string{"key"}, Now: func() time.Time { return now }}
+	signed, _ := signer.Sign("/cat.jpg?width=300", now.Add(time.Hour))
+	parsed, _ := url.Parse(signed)
+	if parsed.Query().Get("expires") != "1704114000" {
+		t.Errorf("unexpected expires in %s", signed)
+	}
+	for path, code := range map[string]string{
+		"/cat.jpg?width=300": CodeInvalidSignature,
+		strings.Replace(signed, "width=300", "width=3000", 1):                  CodeInvalidSignature,
+		strings.Replace(signed, "/cat.jpg", "/dog.jpg", 1):                     CodeInvalidSignature,
+		strings.Replace(signed, "expires=1704114000", "expires=1804114000", 1): CodeInvalidSignature,
+		signed + "&height=10":     CodeInvalidSignature,
+		signed + "&signature=abc": CodeInvalidSignature,
+	} {
+		parsed, _ := url.Parse(path)
+		_, _, err := signer.Verify(parsed.Path, parsed.RawQuery)
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.Status != http.StatusForbidden || serverErr.Code != code {
+			t.Errorf("%s: expected 403 %s, got %v", path, code, err)
+		}
+	}
+
+	if _, expiry, err := signer.Verify(parsed.Path, parsed.RawQuery); err != nil || !expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the URL to expire at %v, got %v, %v", now.Add(time.Hour), expiry, err)
+	}
+	signer.Now = func() time.Time { return now.Add(2 * time.Hour) }
+	_, _, err := signer.Verify(parsed.Path, parsed.RawQuery)
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != CodeExpired {
+		t.Errorf("expected the URL to expire, got %v", err)
+	}
+}
+
+func TestServerSigned(t *testing.T) {
+	server := newTestServer(t, testPNG(t))
+	now := time.Now().Truncate(time.Second)
+	server.Signer = &URLSigner{Keys: []string{"key"}, Now: func() time.Time { return now }}
+	mux := http.NewServeMux()
+	mux.Handle("/images/", http.StripPrefix("/images", server))
+
+	signed, _ := server.Signer.Sign("/images/cat.jpg", now.Add(time.Minute))
+	for target, status := range map[string]int{
+		signed:                                   http.StatusOK,
+		"/images/cat.jpg":                        http.StatusForbidden,
+		strings.Replace(signed, "cat", "dog", 1): http.StatusForbidden,
+		signed + "&width=100":                    http.StatusForbidden,
+	} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != status {
+			t.Errorf("%s: expected %d, got %d %s", target, status, recorder.Code, recorder.Body)
+		}
+		if status == http.StatusOK && recorder.Header().Get("Cache-Control") != "public, max-age=60" {
+			t.Errorf("%s: expected caching until the URL expires, got %q", target, recorder.Header().Get("Cache-Control"))
+		}
+	}
+}
+
+func TestCapMaxAge(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl string
+		expected     string
+	}{
+		{"public, max-age=31536000", "public, max-age=60"},
+		{"public, max-age=10", "public, max-age=10"},
+		{"public, max-age=31536000, s-maxage=31536000, immutable", "public, max-age=60, s-maxage=60, immutable"},
+		{"public", "public, max-age=60"},
+	} {
+		if capped := capMaxAge(test.cacheControl, 60); capped != test.expected {
+			t.Errorf("capMaxAge(%q) = %q, expected %q", test.cacheControl, capped, test.expected)
+		}
+	}
+	if capped := capMaxAge("public, max-age=600", -5); capped != "public, max-age=0" {
+		t.Errorf("expected max-age=0 for an expired URL, got %q", capped)
+	}
+}
@@ -0,0 +1,130 @@
+package imageflow
+
+import (
+	"fmt"
+)
+
+// SmallestOptions changes how EncodeSmallestWithOptions picks the output
+// LosslessRatio, if set, picks the smallest lossless candidate whenever it is at most LosslessRatio
+// times the size of the smallest lossy candidate. 1.2 prefers lossless output unless it is more than 20% larger.
+type SmallestOptions struct {
+	LosslessRatio float64
+}
+
+// losslessPreset is implemented by presets which can encode without loss
+type losslessPreset interface {
+	lossless() bool
+}
+
+func (preset LosslessPNG) lossless() bool {
+	return true
+}
+
+func (preset LibPNG) lossless() bool {
+	return true
+}
+
+func (preset WebPLossless) lossless() bool {
+	return true
+}
+
+func (preset FormatProfile) lossless() bool {
+	return preset.Lossless == LosslessAlways || preset.QualityProfile == QualityLossless
+}
+
+func isLossless(preset presetInterface) bool {
+	if preset, ok := preset.(losslessPreset); ok {
+		return preset.lossless()
+	}
+	return false
+}
+
+// smallestGroup is the set of candidates of one EncodeSmallest
+type smallestGroup struct {
+	sink       ioOperation
+	candidates []*capture
+	lossless   []bool
+	options    SmallestOptions
+}
+
+// EncodeSmallest encodes the current frame with every preset in the same job and keeps only the smallest output
+// Use ExecuteWithResult to find out the format and MIME type of the output that was kept.
+func (steps *Steps) EncodeSmallest(sink ioOperation, presets ...presetInterface) *Steps {
+	return steps.EncodeSmallestWithOptions(sink, SmallestOptions{}, presets...)
+}
+
+// EncodeSmallestWithOptions is EncodeSmallest with options for preferring lossless output
+func (steps *Steps) EncodeSmallestWithOptions(sink ioOperation, options SmallestOptions, presets ...presetInterface) *Steps {
+	if len(presets) == 0 {
+		steps.fail(fmt.Errorf("imageflow: EncodeSmallest needs at least one preset"))
+		return steps
+	}
+	if options.LosslessRatio < 0 {
+		steps.fail(fmt.Errorf("imageflow: invalid lossless ratio %v", options.LosslessRatio))
+		return steps
+	}
+	group := smallestGroup{sink: sink, options: options}
+	last := steps.last
+	for _, preset := range presets {
+		candidate := &capture{}
+		steps.last = last
+		steps.Encode(candidate, preset)
+		group.candidates = append(group.candidates, candidate)
+		group.lossless = append(group.lossless, isLossless(preset))
+	}
+	steps.smallest = append(steps.smallest, group)
+	return steps
+}
+
+// pick returns the index of the candidate to keep
+func (group smallestGroup) pick() int {
+	smallest, smallestLossy, smallestLossless := -1, -1, -1
+	for i, candidate := range group.candidates {
+		size := len(candidate.data)
+		if smallest < 0 || size < len(group.candidates[smallest].data) {
+			smallest = i
+		}
+		if group.lossless[i] {
+			if smallestLossless < 0 || size < len(group.candidates[smallestLossless].data) {
+				smallestLossless = i
+			}
+		} else if smallestLossy < 0 || size < len(group.candidates[smallestLossy].data) {
+			smallestLossy = i
+		}
+	}
+	if group.options.LosslessRatio == 0 || smallestLossless < 0 || smallestLossy < 0 {
+		return smallest
+	}
+	if float64(len(group.candidates[smallestLossless].data)) <= group.options.LosslessRatio*float64(len(group.candidates[smallestLossy].data)) {
+		return smallestLossless
+	}
+	return smallestLossy
+}
+
+// resolve writes the chosen candidate to the sink and drops the other candidates from the result
+func (group smallestGroup) resolve(result *Result) error {
+	chosen := group.candidates[group.pick()]
+	outputs, err := group.sink.toOutput(chosen.data, result.Outputs)
+	if err != nil {
+		return err
+	}
+	result.Outputs = outputs
+
+	encodes := result.Encodes[:0]
+	for _, encode := range result.Encodes {
+		keep := true
+		for _, candidate := range group.candidates {
+			if encode.IoID == int(candidate.getIo()) {
+				keep = candidate == chosen
+			}
+		}
+		if keep {
+			if encode.IoID == int(chosen.getIo()) {
+				encode.Key = ioKey(group.sink)
+			}
+			encodes = append(encodes, encode)
+		}
+	}
+	result.Encodes = encodes
+	return nil
+}
@@ -0,0 +1,234 @@
+package imageflow
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSourceNotFound is returned by a Source when there is no original for a path
+var ErrSourceNotFound = errors.New("imageflow: source not found")
+
+// DefaultMaxSourceBytes is the largest original HTTPSource and S3Source read when MaxSourceBytes is 0
+const DefaultMaxSourceBytes = 64 << 20
+
+// Original is an image loaded by a Source
+// ModTime and ETag are optional and used for caching headers.
+type Original struct {
+	Data    []byte
+	ModTime time.Time
+	ETag    string
+}
+
+// Source is used to load the original for a request path such as /photos/cat.jpg
+type Source interface {
+	Open(ctx context.Context, path string) (*Original, error)
+}
+
+// DirectorySource loads originals from a directory, paths can't leave it
+type DirectorySource string
+
+// Open reads the file at path below the directory
+func (dir DirectorySource) Open(ctx context.Context, name string) (*Original, error) {
+	file := filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.IsDir()) {
+		return nil, ErrSourceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Original{Data: data, ModTime: info.ModTime()}, nil
+}
+
+// HTTPSource loads originals from an origin server, the request path is appended to BaseURL
+// Client defaults to http.DefaultClient and Header is added to every request.
+// Larger originals than MaxSourceBytes fail, 0 is DefaultMaxSourceBytes.
+type HTTPSource struct {
+	BaseURL        string
+	Client         *http.Client
+	Header         http.Header
+	MaxSourceBytes int64
+}
+
+// Open fetches BaseURL + path, 404 and 410 are ErrSourceNotFound
+func (source HTTPSource) Open(ctx context.Context, name string) (*Original, error) {
+	target := strings.TrimSuffix(source.BaseURL, "/") + (&url.URL{Path: path.Clean("/" + name)}).EscapedPath()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range source.Header {
+		request.Header[key] = values
+	}
+	return fetchOriginal(source.Client, request, source.MaxSourceBytes)
+}
+
+// fetchOriginal is used to run request and read the original from the response, up to limit bytes
+func fetchOriginal(client *http.Client, request *http.Request, limit int64) (*Original, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if limit <= 0 {
+		limit = DefaultMaxSourceBytes
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return nil, ErrSourceNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("imageflow: %s returned %s", request.URL.Redacted(), response.Status)
+	}
+	tooLarge := fmt.Errorf("imageflow: %s is larger than %d bytes", request.URL.Redacted(), limit)
+	if response.ContentLength > limit {
+		return nil, tooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, tooLarge
+	}
+	original := &Original{Data: data, ETag: response.Header.Get("ETag")}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		original.ModTime = modified
+	}
+	return original, nil
+}
+
+// S3Source loads originals from an S3 compatible bucket, the request path is the object key
+// Endpoint defaults to https://s3.{Region}.amazonaws.com. PathStyle puts the bucket in the path
+// instead of the host name, which most S3 compatible servers need. Requests are signed with
+// AWS Signature Version 4 unless AccessKeyID is empty. Larger objects than MaxSourceBytes fail,
+// 0 is DefaultMaxSourceBytes.
+type S3Source struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	PathStyle       bool
+	Client          *http.Client
+	MaxSourceBytes  int64
+}
+
+// emptySHA256 is the hash of an empty payload
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Open gets the object, a missing object is ErrSourceNotFound
+func (source S3Source) Open(ctx context.Context, name string) (*Original, error) {
+	endpoint := source.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + source.Region + ".amazonaws.com"
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("imageflow: invalid S3 endpoint: %w", err)
+	}
+	key := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if source.PathStyle {
+		target.Path = "/" + source.Bucket + "/" + key
+	} else {
+		target.Host = source.Bucket + "." + target.Host
+		target.Path = "/" + key
+	}
+	target.RawPath = awsEscapePath(target.Path)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if source.AccessKeyID != "" {
+		source.sign(request, time.Now())
+	}
+	return fetchOriginal(source.Client, request, source.MaxSourceBytes)
+}
+
+// sign adds the AWS Signature Version 4 headers, it signs the host, range and x-amz-* headers
+func (source S3Source) sign(request *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if source.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", source.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		key = strings.ToLower(key)
+		if key == "range" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + source.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + source.SecretAccessKey)
+	for _, part := range []string{date, source.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		source.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath escapes everything but unreserved characters and slashes, as Signature Version 4 requires
+func awsEscapePath(p string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(p) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,242 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Sprite is an image to pack into a sprite sheet
+// Name identifies the sprite in the manifest and its CSS class, it must be unique, also once
+// the characters CSS does not allow in a class are replaced.
+// Width and Height, if set, scale the image to fit within them, keeping the aspect ratio.
+type Sprite struct {
+	Name   string
+	Source IO
+	Width  int
+	Height int
+}
+
+// SpriteSheetOptions changes how sprites are packed
+// Padding The space between sprites and around the sheet, in pixels, to keep neighbours from bleeding in when scaled
+// MaxWidth The widest the sheet may be, 0 picks a roughly square sheet
+// Background See Color. The color between sprites, nil is transparent.
+// ClassPrefix The prefix of the CSS classes, default "sprite"
+type SpriteSheetOptions struct {
+	Padding     int
+	MaxWidth    int
+	Background  Color
+	ClassPrefix string
+}
+
+// SpriteFrame is the position of a sprite in the sheet
+type SpriteFrame struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// SpriteSheet is the result of BuildSpriteSheet
+// Frames are in the order of the sprites passed in.
+type SpriteSheet struct {
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	MimeType    string        `json:"mime_type"`
+	Frames      []SpriteFrame `json:"frames"`
+	Data        []byte        `json:"-"`
+	classPrefix string
+}
+
+// BuildSpriteSheet packs sprites into one image encoded with preset
+// The sprites are packed onto shelves by decreasing height, then drawn onto a single canvas in one job.
+// Sprites that keep their size and have alpha are copied exactly onto a transparent background,
+// the others are drawn at their scaled size. Names which give the same CSS class are rejected.
+func BuildSpriteSheet(sprites []Sprite, options SpriteSheetOptions, preset presetInterface) (*SpriteSheet, error) {
+	if len(sprites) == 0 {
+		return nil, fmt.Errorf("imageflow: a sprite sheet needs at least one sprite")
+	}
+	if options.Padding < 0 || options.MaxWidth < 0 {
+		return nil, fmt.Errorf("imageflow: invalid sprite padding %d or width %d", options.Padding, options.MaxWidth)
+	}
+
+	sheet := &SpriteSheet{classPrefix: options.ClassPrefix}
+	classes := make(map[string]string)
+	data := make([][]byte, len(sprites))
+	infos := make([]*ImageInfo, len(sprites))
+	frames := make([]SpriteFrame, len(sprites))
+	for i, sprite := range sprites {
+		if sprite.Name == "" {
+			return nil, fmt.Errorf("imageflow: sprite names must not be empty")
+		}
+		class := sheet.cssClass(sprite.Name)
+		if other, ok := classes[class]; ok {
+			return nil, fmt.Errorf("imageflow: sprites %q and %q have the same CSS class %q", other, sprite.Name, class)
+		}
+		if class == sheet.prefix()+"-" {
+			return nil, fmt.Errorf("imageflow: sprite name %q has no valid CSS class characters", sprite.Name)
+		}
+		classes[class] = sprite.Name
+		if sprite.Width < 0 || sprite.Height < 0 {
+			return nil, fmt.Errorf("imageflow: invalid size %dx%d for sprite %q", sprite.Width, sprite.Height, sprite.Name)
+		}
+		if sprite.Source == nil {
+			return nil, fmt.Errorf("imageflow: sprite %q has no source", sprite.Name)
+		}
+		var err error
+		if data[i], err = sprite.Source.toBuffer(); err != nil {
+			return nil, err
+		}
+		if infos[i], err = imageInfo(data[i]); err != nil {
+			return nil, fmt.Errorf("imageflow: sprite %q: %w", sprite.Name, err)
+		}
+		frames[i] = SpriteFrame{Name: sprite.Name}
+		frames[i].Width, frames[i].Height = spriteSize(infos[i].Width, infos[i].Height, sprite.Width, sprite.Height)
+	}
+	width, height := packShelves(frames, options.Padding, options.MaxWidth)
+
+	step := NewStep()
+	step.CreateCanvas(width, height, PixelBGRA32, options.Background)
+	canvas := step.Ref()
+	for i, frame := range frames {
+		step.Decode(NewBuffer(data[i]))
+		// copy_rect replaces the pixels below it, which only keeps a transparent background intact
+		if options.Background == nil && frame.Width == infos[i].Width && frame.Height == infos[i].Height && infos[i].HasAlpha() {
+			step.CopyRectangleOnto(canvas, RectangleToCanvas{
+				W: float32(frame.Width), H: float32(frame.Height), X: float32(frame.X), Y: float32(frame.Y),
+			})
+		} else {
+			step.DrawExactOnto(canvas, DrawExact{
+				W: float32(frame.Width), H: float32(frame.Height), X: float32(frame.X), Y: float32(frame.Y), Blend: "compose",
+			})
+		}
+		canvas = step.Ref()
+	}
+	out := &capture{}
+	result, err := step.Encode(out, preset).ExecuteWithResult()
+	if err != nil {
+		return nil, err
+	}
+	mimeType := ""
+	if len(result.Encodes) > 0 {
+		mimeType = result.Encodes[0].PreferredMimeType
+	}
+	sheet.Width, sheet.Height = width, height
+	sheet.MimeType = mimeType
+	sheet.Frames = frames
+	sheet.Data = out.data
+	return sheet, nil
+}
+
+// spriteSize returns the size of a w x h image scaled to fit within maxW x maxH, 0 means unlimited
+// Sprites are never scaled up.
+func spriteSize(w int, h int, maxW int, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 {
+		scale = math.Min(scale, float64(maxW)/float64(w))
+	}
+	if maxH > 0 {
+		scale = math.Min(scale, float64(maxH)/float64(h))
+	}
+	if scale == 1 {
+		return w, h
+	}
+	return max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
+}
+
+// packShelves places frames on shelves, tallest first, and returns the size of the sheet
+// Every shelf is as wide as maxWidth, or the side of a square holding all frames if maxWidth is 0,
+// but never narrower than the widest frame.
+func packShelves(frames []SpriteFrame, padding int, maxWidth int) (int, int) {
+	order := make([]int, len(frames))
+	area, widest := 0, 0
+	for i, frame := range frames {
+		order[i] = i
+		area += (frame.Width + padding) * (frame.Height + padding)
+		widest = max(widest, frame.Width)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return frames[order[a]].Height > frames[order[b]].Height
+	})
+
+	limit := maxWidth
+	if limit == 0 {
+		limit = int(math.Ceil(math.Sqrt(float64(area)))) + padding
+	}
+	limit = max(limit, widest+2*padding)
+
+	x, y, shelf, width := padding, padding, 0, 0
+	for _, i := range order {
+		frame := &frames[i]
+		if x > padding && x+frame.Width+padding > limit {
+			x, y = padding, y+shelf+padding
+			shelf = 0
+		}
+		frame.X, frame.Y = x, y
+		x += frame.Width + padding
+		shelf = max(shelf, frame.Height)
+		width = max(width, x)
+	}
+	return width, y + shelf + padding
+}
+
+var cssInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// prefix returns the CSS class shared by all sprites
+func (sheet *SpriteSheet) prefix() string {
+	if sheet.classPrefix == "" {
+		return "sprite"
+	}
+	return sheet.classPrefix
+}
+
+// cssClass returns the class of a sprite, replacing characters which are not allowed in CSS identifiers
+func (sheet *SpriteSheet) cssClass(name string) string {
+	return sheet.prefix() + "-" + strings.Trim(cssInvalid.ReplaceAllString(name, "-"), "-")
+}
+
+// CSS returns a stylesheet with a class per sprite, url is the address the sheet is served from
+// Use both classes on an element, like class="sprite sprite-home".
+func (sheet *SpriteSheet) CSS(url string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, ".%s {\n  background-image: url(%s);\n  background-repeat: no-repeat;\n  display: inline-block;\n}\n", sheet.prefix(), cssString(url))
+	for _, frame := range sheet.Frames {
+		fmt.Fprintf(&builder, ".%s {\n  background-position: %s %s;\n  width: %dpx;\n  height: %dpx;\n}\n",
+			sheet.cssClass(frame.Name), cssOffset(frame.X), cssOffset(frame.Y), frame.Width, frame.Height)
+	}
+	return builder.String()
+}
+
+var cssEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\a `)
+
+// cssString quotes s as a CSS string
+func cssString(s string) string {
+	return `"` + cssEscaper.Replace(s) + `"`
+}
+
+// cssOffset returns the background position of a sprite at value
+func cssOffset(value int) string {
+	if value == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("-%dpx", value)
+}
+
+// JSON returns the manifest of the sheet, without the image data
+func (sheet *SpriteSheet) JSON() ([]byte, error) {
+	return json.MarshalIndent(sheet, "", "  ")
+}
+
+// Frame returns the position of the sprite called name
+func (sheet *SpriteSheet) Frame(name string) (SpriteFrame, bool) {
+	for _, frame := range sheet.Frames {
+		if frame.Name == name {
+			return frame, true
+		}
+	}
+	return SpriteFrame{}, false
+}
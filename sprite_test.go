@@ -0,0 +1,164 @@
+package imageflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestBuildSpriteSheet(t *testing.T) {
+	data := loadTestImage(t)
+	sheet, err := BuildSpriteSheet([]Sprite{
+		{Name: "large", Source: NewBuffer(data), Width: 64, Height: 64},
+		{Name: "small", Source: NewBuffer(data), Width: 32, Height: 32},
+		{Name: "wide", Source: NewBuffer(data), Width: 96},
+	}, SpriteSheetOptions{Padding: 2}, LosslessPNG{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := DecodeFrame(sheet.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != sheet.Width || frame.Bounds().Dy() != sheet.Height {
+		t.Errorf("manifest says %dx%d, sheet is %v", sheet.Width, sheet.Height, frame.Bounds())
+	}
+	if wide, _ := sheet.Frame("wide"); wide.Width != 96 {
+		t.Errorf("expected the wide sprite to be 96 pixels wide, got %+v", wide)
+	}
+	if sheet.MimeType != "image/png" {
+		t.Errorf("unexpected mime type %q", sheet.MimeType)
+	}
+}
+
+func TestBuildSpriteSheetBackground(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	transparent.Set(0, 0, color.NRGBA{B: 255, A: 255})
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, transparent); err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := BuildSpriteSheet([]Sprite{{Name: "icon", Source: NewBuffer(buffer.Bytes())}},
+		SpriteSheetOptions{Padding: 1, Background: SRGB{R: 255, A: 255}}, LosslessPNG{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := DecodeFrame(sheet.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	icon, _ := sheet.Frame("icon")
+	if r, g, b, a := frame.At(icon.X+4, icon.Y+4).RGBA(); r>>8 != 255 || g != 0 || b != 0 || a>>8 != 255 {
+		t.Errorf("expected the background below transparent pixels, got %d %d %d %d", r>>8, g>>8, b>>8, a>>8)
+	}
+	if r, _, b, _ := frame.At(icon.X, icon.Y).RGBA(); r != 0 || b>>8 != 255 {
+		t.Errorf("expected the opaque sprite pixel, got %d %d", r>>8, b>>8)
+	}
+}
+
+func TestBuildSpriteSheetInvalid(t *testing.T) {
+	if _, err := BuildSpriteSheet(nil, SpriteSheetOptions{}, LosslessPNG{}); err == nil {
+		t.Error("expected error without sprites")
+	}
+	sprites := []Sprite{{Name: "a", Source: NewBuffer(nil)}, {Name: "a", Source: NewBuffer(nil)}}
+	if _, err := BuildSpriteSheet(sprites, SpriteSheetOptions{}, LosslessPNG{}); err == nil {
+		t.Error("expected error for duplicate names")
+	}
+	colliding := []Sprite{{Name: "icons/home", Source: NewBuffer(nil)}, {Name: "icons-home", Source: NewBuffer(nil)}}
+	if _, err := BuildSpriteSheet(colliding, SpriteSheetOptions{}, LosslessPNG{}); err == nil {
+		t.Error("expected error for names with the same CSS class")
+	}
+	if _, err := BuildSpriteSheet(sprites[:1], SpriteSheetOptions{Padding: -1}, LosslessPNG{}); err == nil {
+		t.Error("expected error for negative padding")
+	}
+	_, err := BuildSpriteSheet([]Sprite{{Name: "home"}}, SpriteSheetOptions{}, LosslessPNG{})
+	if err == nil || !strings.Contains(err.Error(), `"home"`) {
+		t.Errorf("expected an error naming the sprite without a source, got %v", err)
+	}
+}
+
+func TestSpriteSize(t *testing.T) {
+	for _, test := range []struct{ w, h, maxW, maxH, expectedW, expectedH int }{
+		{100, 50, 0, 0, 100, 50},
+		{100, 50, 50, 0, 50, 25},
+		{100, 50, 50, 10, 20, 10},
+		{100, 50, 200, 200, 100, 50},
+		{1000, 1, 10, 0, 10, 1},
+	} {
+		w, h := spriteSize(test.w, test.h, test.maxW, test.maxH)
+		if w != test.expectedW || h != test.expectedH {
+			t.Errorf("spriteSize(%d, %d, %d, %d) = %dx%d, expected %dx%d",
+				test.w, test.h, test.maxW, test.maxH, w, h, test.expectedW, test.expectedH)
+		}
+	}
+}
+
+func TestPackShelves(t *testing.T) {
+	sizes := [][2]int{{16, 16}, {32, 32}, {24, 8}, {64, 16}, {8, 40}, {16, 16}, {48, 24}}
+	for _, maxWidth := range []int{0, 70, 1000} {
+		frames := make([]SpriteFrame, len(sizes))
+		for i, size := range sizes {
+			frames[i] = SpriteFrame{Width: size[0], Height: size[1]}
+		}
+		width, height := packShelves(frames, 2, maxWidth)
+		if maxWidth >= 68 && width > maxWidth {
+			t.Errorf("sheet of %d pixels is wider than %d", width, maxWidth)
+		}
+		for i, a := range frames {
+			if a.X < 2 || a.Y < 2 || a.X+a.Width+2 > width || a.Y+a.Height+2 > height {
+				t.Errorf("frame %+v is outside the %dx%d sheet", a, width, height)
+			}
+			for _, b := range frames[i+1:] {
+				if a.X < b.X+b.Width+2 && b.X < a.X+a.Width+2 && a.Y < b.Y+b.Height+2 && b.Y < a.Y+a.Height+2 {
+					t.Errorf("frames %+v and %+v overlap", a, b)
+				}
+			}
+		}
+	}
+}
+
+func TestSpriteSheetCSS(t *testing.T) {
+	sheet := &SpriteSheet{Width: 40, Height: 20, Frames: []SpriteFrame{
+		{Name: "home", X: 0, Y: 0, Width: 20, Height: 20},
+		{Name: "icons/search.png", X: 20, Y: 4, Width: 16, Height: 16},
+	}, classPrefix: "icon"}
+	expected := `.icon {
+  background-image: url("/static/sprites.png");
+  background-repeat: no-repeat;
+  display: inline-block;
+}
+.icon-home {
+  background-position: 0 0;
+  width: 20px;
+  height: 20px;
+}
+.icon-icons-search-png {
+  background-position: -20px -4px;
+  width: 16px;
+  height: 16px;
+}
+`
+	if css := sheet.CSS("/static/sprites.png"); css != expected {
+		t.Errorf("unexpected css\n%s", css)
+	}
+}
+
+func TestSpriteSheetJSON(t *testing.T) {
+	sheet := &SpriteSheet{Width: 40, Height: 20, MimeType: "image/png", Data: []byte("png"),
+		Frames: []SpriteFrame{{Name: "home", X: 2, Y: 3, Width: 20, Height: 10}}}
+	data, err := sheet.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed SpriteSheet
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Width != 40 || len(parsed.Frames) != 1 || parsed.Frames[0] != sheet.Frames[0] || parsed.Data != nil {
+		t.Errorf("unexpected manifest %s", data)
+	}
+}
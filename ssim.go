@@ -0,0 +1,130 @@
+package imageflow
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+)
+
+const (
+	ssimWindow = 8
+	ssimStride = 4
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// SSIM returns the structural similarity of two images of the same size, 1 means identical
+// It is the mean SSIM of 8x8 windows, taken every 4 pixels, of the luma of both images.
+// Transparent pixels are compared as if composed onto black. Only the rows of one band of
+// windows are kept in memory, so large frames can be compared.
+func SSIM(a image.Image, b image.Image) (float64, error) {
+	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
+		return 0, fmt.Errorf("imageflow: cannot compare a %dx%d image to a %dx%d image",
+			a.Bounds().Dx(), a.Bounds().Dy(), b.Bounds().Dx(), b.Bounds().Dy())
+	}
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return 0, fmt.Errorf("imageflow: cannot compare empty images")
+	}
+	windowW, windowH := min(ssimWindow, width), min(ssimWindow, height)
+	n := float64(windowW * windowH)
+
+	// the luma of the last windowH rows of both images, row y is kept at y % windowH
+	rowsX, rowsY := make([][]float64, windowH), make([][]float64, windowH)
+	for i := range rowsX {
+		rowsX[i], rowsY[i] = make([]float64, width), make([]float64, width)
+	}
+	// the sums of x, y, x², y² and xy of every column over the rows of a band
+	columns := make([][5]float64, width)
+	next, total, count := 0, 0.0, 0
+	for top := 0; top+windowH <= height; top += ssimStride {
+		for ; next < top+windowH; next++ {
+			lumaRow(a, next, rowsX[next%windowH])
+			lumaRow(b, next, rowsY[next%windowH])
+		}
+		clear(columns)
+		for row := top; row < top+windowH; row++ {
+			x, y := rowsX[row%windowH], rowsY[row%windowH]
+			for col, vx := range x {
+				vy := y[col]
+				column := &columns[col]
+				column[0] += vx
+				column[1] += vy
+				column[2] += vx * vx
+				column[3] += vy * vy
+				column[4] += vx * vy
+			}
+		}
+
+		for left := 0; left+windowW <= width; left += ssimStride {
+			var s [5]float64
+			for _, column := range columns[left : left+windowW] {
+				for i := range s {
+					s[i] += column[i]
+				}
+			}
+			meanX, meanY := s[0]/n, s[1]/n
+			varX := s[2]/n - meanX*meanX
+			varY := s[3]/n - meanY*meanY
+			covariance := s[4]/n - meanX*meanY
+			total += ((2*meanX*meanY + ssimC1) * (2*covariance + ssimC2)) /
+				((meanX*meanX + meanY*meanY + ssimC1) * (varX + varY + ssimC2))
+			count++
+		}
+	}
+	return total / float64(count), nil
+}
+
+// DSSIM returns the structural dissimilarity 1/SSIM - 1 of two images of the same size, 0 means identical
+func DSSIM(a image.Image, b image.Image) (float64, error) {
+	ssim, err := SSIM(a, b)
+	if err != nil {
+		return 0, err
+	}
+	if ssim <= 0 {
+		return math.Inf(1), nil
+	}
+	return 1/ssim - 1, nil
+}
+
+// lumaRow writes the Rec. 601 luma in 0..255 of row y, counted from the top of img, to values
+// RGBA and NRGBA images are read directly, other images through At.
+func lumaRow(img image.Image, y int, values []float64) {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.RGBA:
+		pix := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := range values {
+			p := pix[x*4 : x*4+3]
+			values[x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	case *image.NRGBA:
+		pix := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := range values {
+			p := pix[x*4 : x*4+4]
+			// premultiplied like color.NRGBA.RGBA, so transparent pixels are composed onto black
+			alpha := uint32(p[3])
+			r := float64(uint32(p[0])*0x101*alpha/0xff) / 257
+			g := float64(uint32(p[1])*0x101*alpha/0xff) / 257
+			b := float64(uint32(p[2])*0x101*alpha/0xff) / 257
+			values[x] = 0.299*r + 0.587*g + 0.114*b
+		}
+	default:
+		for x := range values {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			values[x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+}
+
+// DecodeFrame decodes the first frame of an image in any format libimageflow can read
+func DecodeFrame(data []byte) (image.Image, error) {
+	out := &capture{}
+	step := NewStep()
+	if _, err := step.Decode(NewBuffer(data)).Encode(out, LosslessPNG{}).Execute(); err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out.data))
+}
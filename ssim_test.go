@@ -0,0 +1,105 @@
+package imageflow
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func testPattern(width int, height int, noise int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := (x*7 + y*13) % 256
+			if noise > 0 && (x*31+y*17)%5 == 0 {
+				v = (v + noise) % 256
+			}
+			img.Set(x, y, color.NRGBA{R: uint8(v), G: uint8(255 - v), B: uint8(v / 2), A: 255})
+		}
+	}
+	return img
+}
+
+func TestSSIMIdentical(t *testing.T) {
+	img := testPattern(64, 48, 0)
+	ssim, err := SSIM(img, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(ssim-1) > 1e-9 {
+		t.Errorf("expected ssim 1 for identical images, got %v", ssim)
+	}
+	dssim, err := DSSIM(img, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(dssim) > 1e-9 {
+		t.Errorf("expected dssim 0 for identical images, got %v", dssim)
+	}
+}
+
+func TestSSIMOrdering(t *testing.T) {
+	reference := testPattern(64, 48, 0)
+	slight, err := SSIM(reference, testPattern(64, 48, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	heavy, err := SSIM(reference, testPattern(64, 48, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(1 > slight && slight > heavy) {
+		t.Errorf("expected 1 > %v > %v", slight, heavy)
+	}
+	reversed, _ := SSIM(testPattern(64, 48, 120), reference)
+	if math.Abs(reversed-heavy) > 1e-9 {
+		t.Errorf("ssim is not symmetric: %v != %v", reversed, heavy)
+	}
+}
+
+func TestSSIMSmallAndOffsetImages(t *testing.T) {
+	small := testPattern(3, 5, 0)
+	if ssim, err := SSIM(small, small); err != nil || math.Abs(ssim-1) > 1e-9 {
+		t.Errorf("unexpected ssim %v, %v for small image", ssim, err)
+	}
+	offset := testPattern(40, 40, 0).SubImage(image.Rect(10, 10, 30, 30))
+	if ssim, err := SSIM(offset, testPattern(20, 20, 0)); err != nil || ssim >= 1 {
+		t.Errorf("unexpected ssim %v, %v for different content", ssim, err)
+	}
+}
+
+func TestSSIMSizeMismatch(t *testing.T) {
+	if _, err := SSIM(testPattern(10, 10, 0), testPattern(10, 11, 0)); err == nil {
+		t.Error("expected error for images of different size")
+	}
+	if _, err := SSIM(image.NewNRGBA(image.Rect(0, 0, 0, 0)), image.NewNRGBA(image.Rect(0, 0, 0, 0))); err == nil {
+		t.Error("expected error for empty images")
+	}
+}
+
+// opaqueImage hides the concrete type of an image, so SSIM reads it through At
+type opaqueImage struct{ image.Image }
+
+func TestSSIMFastPaths(t *testing.T) {
+	nrgba := testPattern(50, 37, 0)
+	nrgba.Set(3, 4, color.NRGBA{R: 200, G: 10, B: 90, A: 70})
+	noisy := testPattern(50, 37, 40)
+	rgba := image.NewRGBA(image.Rect(5, 5, 55, 42))
+	for y := 0; y < 37; y++ {
+		for x := 0; x < 50; x++ {
+			rgba.Set(5+x, 5+y, noisy.At(x, y))
+		}
+	}
+	fast, err := SSIM(nrgba, rgba)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := SSIM(opaqueImage{nrgba}, opaqueImage{rgba})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(fast-slow) > 1e-9 {
+		t.Errorf("fast path ssim %v differs from %v", fast, slow)
+	}
+}
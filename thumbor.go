@@ -0,0 +1,586 @@
+package imageflow
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ThumborError is a Thumbor URL which cannot be served
+// Status is 400 for invalid URLs and 403 for missing or wrong signatures.
+type ThumborError struct {
+	Status  int
+	Message string
+}
+
+func (err *ThumborError) Error() string {
+	return fmt.Sprintf("imageflow: thumbor %d: %s", err.Status, err.Message)
+}
+
+func thumborBadRequest(format string, args ...interface{}) error {
+	return &ThumborError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func thumborForbidden(format string, args ...interface{}) error {
+	return &ThumborError{Status: http.StatusForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// ThumborFilter is one filter of the filters: segment, such as quality(80)
+type ThumborFilter struct {
+	Name string
+	Args []string
+}
+
+// ThumborRequest is a parsed Thumbor URL
+// Crop is the AxB:CxD segment and empty without one. Width and Height are 0 when omitted,
+// OrigWidth and OrigHeight are set for orig. A negative size in the URL sets FlipH or FlipV.
+// Unsupported lists the parts of the URL which have no Steps equivalent and are ignored.
+type ThumborRequest struct {
+	Unsafe      bool
+	Signature   string
+	Crop        image.Rectangle
+	FitIn       bool
+	Adaptive    bool
+	Full        bool
+	Width       int
+	Height      int
+	OrigWidth   bool
+	OrigHeight  bool
+	FlipH       bool
+	FlipV       bool
+	HAlign      string
+	VAlign      string
+	Smart       bool
+	Filters     []ThumborFilter
+	Image       string
+	Unsupported []string
+}
+
+// ThumborOptions configures the translation of Thumbor URLs
+// Key is the security key signatures are checked with, AllowUnsafe accepts /unsafe/ URLs.
+// Quality is the default quality, 80 if 0. Presets replaces the encoder of a format and
+// ignores quality() for it, the defaults are MozJPEG, LosslessPNG, GIF and WebP.
+// Watermark opens the image of a watermark() filter, without it watermarks are unsupported.
+type ThumborOptions struct {
+	Key         string
+	AllowUnsafe bool
+	Quality     int
+	Presets     map[ImageFormat]Preset
+	Watermark   func(url string) (IO, error)
+}
+
+var (
+	thumborCropPattern     = regexp.MustCompile(`^(\d+)x(\d+):(\d+)x(\d+)$`)
+	thumborSizePattern     = regexp.MustCompile(`^(-?)(\d*|orig)x(-?)(\d*|orig)$`)
+	thumborPositionPattern = regexp.MustCompile(`^(center|repeat|-?\d+(\.\d+)?p?)$`)
+	thumborFilterPattern   = regexp.MustCompile(`^[a-z_]+$`)
+)
+
+var thumborFormats = map[string]ImageFormat{"jpeg": FormatJPEG, "jpg": FormatJPEG, "png": FormatPNG, "gif": FormatGIF, "webp": FormatWebP}
+
+// SignThumborURL returns path, the part of a Thumbor URL after the signature, signed with key
+func SignThumborURL(key string, path string) string {
+	path = strings.TrimPrefix(path, "/")
+	return "/" + thumborSignature(key, path) + "/" + path
+}
+
+// thumborSignature is the url safe base64 HMAC-SHA1 Thumbor signs URLs with
+func thumborSignature(key string, path string) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(path))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// thumborSegment splits the next segment off path, slashes inside parentheses belong to the segment
+func thumborSegment(path string) (string, string) {
+	depth := 0
+	for i, c := range path {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case '/':
+			if depth == 0 {
+				return path[:i], path[i+1:]
+			}
+		}
+	}
+	return path, ""
+}
+
+// ParseThumborURL parses a Thumbor URL path such as /unsafe/fit-in/300x200/filters:quality(80)/photo.jpg
+// and checks its signature. Errors are *ThumborError.
+func ParseThumborURL(path string, options ThumborOptions) (*ThumborRequest, error) {
+	request := &ThumborRequest{}
+	first, rest := thumborSegment(strings.TrimPrefix(path, "/"))
+	switch {
+	case first == "unsafe":
+		if !options.AllowUnsafe {
+			return nil, thumborForbidden("unsafe URLs are not allowed")
+		}
+		request.Unsafe = true
+	case len(first) == 28:
+		if options.Key == "" {
+			return nil, thumborForbidden("no key to verify the signature")
+		}
+		if !hmac.Equal([]byte(first), []byte(thumborSignature(options.Key, rest))) {
+			return nil, thumborForbidden("invalid signature")
+		}
+		request.Signature = first
+	default:
+		return nil, thumborForbidden("missing signature")
+	}
+
+	segment, next := thumborSegment(rest)
+	advance := func() {
+		rest = next
+		segment, next = thumborSegment(rest)
+	}
+	if segment == "meta" {
+		request.Unsupported = append(request.Unsupported, "meta")
+		advance()
+	}
+	if segment == "trim" || strings.HasPrefix(segment, "trim:") {
+		request.Unsupported = append(request.Unsupported, "trim")
+		advance()
+	}
+	if match := thumborCropPattern.FindStringSubmatch(segment); match != nil {
+		var values [4]int
+		for i := range values {
+			values[i], _ = strconv.Atoi(match[i+1])
+		}
+		request.Crop = image.Rect(values[0], values[1], values[2], values[3])
+		advance()
+	}
+	if strings.HasSuffix(segment, "fit-in") {
+		switch segment {
+		case "fit-in":
+		case "adaptive-fit-in":
+			request.Adaptive = true
+		case "full-fit-in":
+			request.Full = true
+		case "adaptive-full-fit-in":
+			request.Adaptive = true
+			request.Full = true
+		default:
+			return nil, thumborBadRequest("invalid fit-in %q", segment)
+		}
+		request.FitIn = true
+		advance()
+	}
+	if match := thumborSizePattern.FindStringSubmatch(segment); match != nil {
+		request.FlipH = match[1] == "-"
+		request.FlipV = match[3] == "-"
+		request.OrigWidth = match[2] == "orig"
+		request.OrigHeight = match[4] == "orig"
+		request.Width, _ = strconv.Atoi(match[2])
+		request.Height, _ = strconv.Atoi(match[4])
+		advance()
+	}
+	if segment == "left" || segment == "center" || segment == "right" {
+		request.HAlign = segment
+		advance()
+	}
+	if segment == "top" || segment == "middle" || segment == "bottom" {
+		request.VAlign = segment
+		advance()
+	}
+	if segment == "smart" {
+		request.Smart = true
+		request.Unsupported = append(request.Unsupported, "smart")
+		advance()
+	}
+	if strings.HasPrefix(segment, "filters:") {
+		filters, err := parseThumborFilters(strings.TrimPrefix(segment, "filters:"))
+		if err != nil {
+			return nil, err
+		}
+		request.Filters = filters
+		advance()
+	}
+	imagePath, err := url.PathUnescape(rest)
+	if err != nil || imagePath == "" {
+		return nil, thumborBadRequest("missing or invalid image %q", rest)
+	}
+	request.Image = imagePath
+
+	for _, filter := range request.Filters {
+		if unsupported, err := filter.check(options); err != nil {
+			return nil, err
+		} else if unsupported != "" {
+			request.Unsupported = append(request.Unsupported, unsupported)
+		}
+	}
+	return request, nil
+}
+
+// parseThumborFilters parses name(args):name(args), arguments may contain parentheses and colons
+func parseThumborFilters(s string) ([]ThumborFilter, error) {
+	var filters []ThumborFilter
+	for s != "" {
+		open := strings.IndexByte(s, '(')
+		if open < 0 || !thumborFilterPattern.MatchString(s[:open]) {
+			return nil, thumborBadRequest("invalid filter %q", s)
+		}
+		depth, end := 0, -1
+		for i := open; i < len(s) && end < 0; i++ {
+			switch s[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, thumborBadRequest("unclosed filter %q", s)
+		}
+		filter := ThumborFilter{Name: s[:open]}
+		if args := s[open+1 : end]; args != "" {
+			filter.Args = strings.Split(args, ",")
+		}
+		filters = append(filters, filter)
+		s = s[end+1:]
+		if s != "" && !strings.HasPrefix(s, ":") {
+			return nil, thumborBadRequest("expected : after filter %s", filter.Name)
+		}
+		s = strings.TrimPrefix(s, ":")
+	}
+	return filters, nil
+}
+
+// check validates the arguments of the filter and returns a description if it is unsupported
+func (filter ThumborFilter) check(options ThumborOptions) (string, error) {
+	switch filter.Name {
+	case "format":
+		if len(filter.Args) != 1 {
+			return "", thumborBadRequest("format() takes one argument")
+		}
+		if _, ok := thumborFormats[filter.Args[0]]; ok {
+			return "", nil
+		}
+		if filter.Args[0] == "avif" || filter.Args[0] == "heic" {
+			return "format(" + filter.Args[0] + ")", nil
+		}
+		return "", thumborBadRequest("invalid format %q", filter.Args[0])
+	case "quality":
+		if len(filter.Args) != 1 {
+			return "", thumborBadRequest("quality() takes one argument")
+		}
+		if quality, err := strconv.Atoi(filter.Args[0]); err != nil || quality < 0 || quality > 100 {
+			return "", thumborBadRequest("invalid quality %q", filter.Args[0])
+		}
+	case "fill":
+		if len(filter.Args) < 1 || len(filter.Args) > 2 {
+			return "", thumborBadRequest("fill() takes one or two arguments")
+		}
+		if filter.Args[0] == "auto" || filter.Args[0] == "blur" {
+			return "fill(" + filter.Args[0] + ")", nil
+		}
+		if _, err := ParseColor(filter.Args[0]); err != nil {
+			return "", thumborBadRequest("invalid fill color %q", filter.Args[0])
+		}
+	case "grayscale", "upscale":
+		if len(filter.Args) != 0 {
+			return "", thumborBadRequest("%s() takes no arguments", filter.Name)
+		}
+	case "watermark":
+		mark, err := parseThumborWatermark(filter.Args)
+		if err != nil {
+			return "", err
+		}
+		if mark.x == "repeat" || mark.y == "repeat" {
+			return "watermark(repeat)", nil
+		}
+		if options.Watermark == nil {
+			return "watermark", nil
+		}
+	default:
+		return "filters:" + filter.Name, nil
+	}
+	return "", nil
+}
+
+// thumborWatermark is the arguments of watermark(url,x,y,alpha[,w_ratio,h_ratio])
+// alpha is the transparency from 0 to 100, the ratios are percentages of the image and 0 for none.
+type thumborWatermark struct {
+	url    string
+	x      string
+	y      string
+	alpha  float64
+	wRatio float64
+	hRatio float64
+}
+
+// parseThumborWatermark validates the arguments of a watermark filter
+func parseThumborWatermark(args []string) (thumborWatermark, error) {
+	if len(args) < 4 || len(args) > 6 {
+		return thumborWatermark{}, thumborBadRequest("watermark() takes four to six arguments")
+	}
+	mark := thumborWatermark{url: args[0], x: args[1], y: args[2]}
+	if !thumborPositionPattern.MatchString(mark.x) || !thumborPositionPattern.MatchString(mark.y) {
+		return mark, thumborBadRequest("invalid watermark position %s,%s", mark.x, mark.y)
+	}
+	values := []*float64{&mark.alpha, &mark.wRatio, &mark.hRatio}
+	for i, arg := range args[3:] {
+		if arg == "none" && i > 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil || !(value >= 0 && value <= 100) {
+			return mark, thumborBadRequest("invalid watermark argument %q", arg)
+		}
+		*values[i] = value
+	}
+	return mark, nil
+}
+
+// thumborWatermarkSpan returns the fit box from start to end percent and the gravity of one axis
+// position is center, pixels or a percentage ending in p, negative values are from the far edge.
+func thumborWatermarkSpan(position string, ratio float64, size int) (float64, float64, float64) {
+	if position == "center" {
+		if ratio > 0 {
+			return 50 - ratio/2, 50 + ratio/2, 50
+		}
+		return 0, 100, 50
+	}
+	offset, _ := strconv.ParseFloat(strings.TrimSuffix(position, "p"), 64)
+	if !strings.HasSuffix(position, "p") {
+		offset = offset * 100 / float64(size)
+	}
+	if strings.HasPrefix(position, "-") {
+		end := 100 + offset
+		if ratio > 0 {
+			return math.Max(end-ratio, 0), end, 100
+		}
+		return 0, end, 100
+	}
+	if ratio > 0 {
+		return offset, math.Min(offset+ratio, 100), 0
+	}
+	return offset, 100, 0
+}
+
+// filter returns the last filter named name
+func (request *ThumborRequest) filter(name string) (ThumborFilter, bool) {
+	for i := len(request.Filters) - 1; i >= 0; i-- {
+		if request.Filters[i].Name == name {
+			return request.Filters[i], true
+		}
+	}
+	return ThumborFilter{}, false
+}
+
+// Format returns the format of the response, format() or else the source format if it can be encoded
+func (request *ThumborRequest) Format(source ImageFormat) ImageFormat {
+	if filter, ok := request.filter("format"); ok {
+		if format, ok := thumborFormats[filter.Args[0]]; ok {
+			return format
+		}
+	}
+	switch source {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+		return source
+	}
+	return FormatJPEG
+}
+
+// preset returns the encoder of format
+func (request *ThumborRequest) preset(format ImageFormat, options ThumborOptions) Preset {
+	if preset, ok := options.Presets[format]; ok {
+		return preset
+	}
+	quality := options.Quality
+	if filter, ok := request.filter("quality"); ok {
+		quality, _ = strconv.Atoi(filter.Args[0])
+	}
+	if quality <= 0 {
+		quality = 80
+	}
+	switch format {
+	case FormatPNG:
+		return LosslessPNG{}
+	case FormatGIF:
+		return GIF{}
+	case FormatWebP:
+		return WebP{Quality: quality}
+	}
+	return MozJPEG{Quality: uint(quality)}
+}
+
+// gravity returns the alignment as a ConstraintGravity, center by default
+func (request *ThumborRequest) gravity() ConstraintGravity {
+	gravity := ConstraintGravity{X: 50, Y: 50}
+	switch request.HAlign {
+	case "left":
+		gravity.X = 0
+	case "right":
+		gravity.X = 100
+	}
+	switch request.VAlign {
+	case "top":
+		gravity.Y = 0
+	case "bottom":
+		gravity.Y = 100
+	}
+	return gravity
+}
+
+// targetSize returns the requested size for an image of w x h, orig is w or h
+func (request *ThumborRequest) targetSize(w int, h int) (int, int) {
+	width, height := request.Width, request.Height
+	if request.OrigWidth {
+		width = w
+	}
+	if request.OrigHeight {
+		height = h
+	}
+	return width, height
+}
+
+// Build returns the steps serving the request from source into sink
+// Unsupported features are skipped. Errors are *ThumborError.
+// info must have the size of the decoded frame, after EXIF rotation.
+func (request *ThumborRequest) Build(info ImageInfo, source IO, sink IO, options ThumborOptions) (Steps, error) {
+	crop := image.Rect(0, 0, info.Width, info.Height)
+	if !request.Crop.Empty() {
+		crop = request.Crop.Intersect(crop)
+		if crop.Empty() {
+			return Steps{}, thumborBadRequest("crop %v is outside the %dx%d image", request.Crop, info.Width, info.Height)
+		}
+	}
+	w, h := crop.Dx(), crop.Dy()
+
+	step := NewStep()
+	step.Decode(source)
+	if crop.Dx() != info.Width || crop.Dy() != info.Height {
+		step.Region(Region{
+			X1: float64(crop.Min.X), Y1: float64(crop.Min.Y), X2: float64(crop.Max.X), Y2: float64(crop.Max.Y),
+			BackgroundColor: Transparent(""),
+		})
+	}
+
+	width, height := request.targetSize(w, h)
+	if request.FitIn {
+		if request.Adaptive && width > 0 && height > 0 && (width > height) != (w > h) {
+			width, height = height, width
+		}
+		outW, outH := w, h
+		if width > 0 || height > 0 {
+			scaleW, scaleH := float64(width)/float64(w), float64(height)/float64(h)
+			var scale float64
+			switch {
+			case width == 0:
+				scale = scaleH
+			case height == 0:
+				scale = scaleW
+			case request.Full:
+				scale = math.Max(scaleW, scaleH)
+			default:
+				scale = math.Min(scaleW, scaleH)
+			}
+			if _, upscale := request.filter("upscale"); !upscale {
+				scale = math.Min(scale, 1)
+			}
+			outW = int(math.Max(math.Round(float64(w)*scale), 1))
+			outH = int(math.Max(math.Round(float64(h)*scale), 1))
+		}
+		if outW != w || outH != h {
+			step.Constrain(Constrain{Mode: ModeDistort, W: float64(outW), H: float64(outH)})
+		}
+		w, h = outW, outH
+		if filter, ok := request.filter("fill"); ok && width > 0 && height > 0 && !request.Full {
+			if color, err := ParseColor(filter.Args[0]); err == nil && (width > w || height > h) {
+				gravity := request.gravity()
+				padW, padH := float64(width-w), float64(height-h)
+				step.ExpandCanvas(ExpandCanvas{
+					Left:   math.Round(padW * gravity.X / 100),
+					Right:  padW - math.Round(padW*gravity.X/100),
+					Top:    math.Round(padH * gravity.Y / 100),
+					Bottom: padH - math.Round(padH*gravity.Y/100),
+					Color:  color,
+				})
+				w, h = width, height
+			}
+		}
+	} else if width > 0 || height > 0 {
+		if width == 0 {
+			width = int(math.Max(math.Round(float64(height)*float64(w)/float64(h)), 1))
+		}
+		if height == 0 {
+			height = int(math.Max(math.Round(float64(width)*float64(h)/float64(w)), 1))
+		}
+		if width != w || height != h {
+			step.Constrain(Constrain{Mode: ModeFitCrop, W: float64(width), H: float64(height), Gravity: request.gravity()})
+		}
+		w, h = width, height
+	}
+	if request.FlipH {
+		step.FlipH()
+	}
+	if request.FlipV {
+		step.FlipV()
+	}
+
+	for _, filter := range request.Filters {
+		switch filter.Name {
+		case "grayscale":
+			step.GrayscaleNTSC()
+		case "watermark":
+			mark, err := parseThumborWatermark(filter.Args)
+			if err != nil {
+				return Steps{}, err
+			}
+			if mark.x == "repeat" || mark.y == "repeat" || mark.alpha == 100 || options.Watermark == nil {
+				continue
+			}
+			data, err := options.Watermark(mark.url)
+			if err != nil {
+				return Steps{}, err
+			}
+			x1, x2, gravityX := thumborWatermarkSpan(mark.x, mark.wRatio, w)
+			y1, y2, gravityY := thumborWatermarkSpan(mark.y, mark.hRatio, h)
+			if !(x1 < x2 && y1 < y2 && x1 >= 0 && y1 >= 0 && x2 <= 100 && y2 <= 100) {
+				return Steps{}, thumborBadRequest("watermark at %s,%s is outside the image", mark.x, mark.y)
+			}
+			step.Watermark(data, ConstraintGravity{X: gravityX, Y: gravityY}, "within",
+				PercentageFitBox{X1: x1, Y1: y1, X2: x2, Y2: y2}, float32(1-mark.alpha/100), nil)
+		}
+	}
+	step.Encode(sink, request.preset(request.Format(info.Format()), options))
+	return step, nil
+}
+
+// Execute serves the request from source and returns the encoded image and its MIME type
+func (request *ThumborRequest) Execute(source IO, options ThumborOptions) ([]byte, string, error) {
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := orientedImageInfo(data)
+	if err != nil {
+		return nil, "", err
+	}
+	out := &capture{}
+	step, err := request.Build(*info, NewBuffer(data), out, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := step.Execute(); err != nil {
+		return nil, "", err
+	}
+	return out.data, request.Format(info.Format()).MimeType(), nil
+}
@@ -0,0 +1,203 @@
+package imageflow
+
+import (
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestThumborExecute(t *testing.T) {
+	data := loadTestImage(t)
+	request, err := ParseThumborURL("/unsafe/fit-in/120x120/filters:format(png):fill(red)/photo.jpg", ThumborOptions{AllowUnsafe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, mime, err := request.Execute(NewBuffer(data), ThumborOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/png" {
+		t.Errorf("unexpected mime type %q", mime)
+	}
+	frame, err := DecodeFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 120 || frame.Bounds().Dy() != 120 {
+		t.Errorf("expected 120x120, got %v", frame.Bounds())
+	}
+}
+
+func TestThumborExecuteOrientation(t *testing.T) {
+	data := rotatedJPEG(t, 200, 100)
+	for path, expected := range map[string]image.Point{
+		"/unsafe/fit-in/50x50/filters:format(png)/photo.jpg":  {X: 25, Y: 50},
+		"/unsafe/0x100:100x200/filters:format(png)/photo.jpg": {X: 100, Y: 100},
+	} {
+		request, err := ParseThumborURL(path, ThumborOptions{AllowUnsafe: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _, err := request.Execute(NewBuffer(data), ThumborOptions{})
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		frame, err := DecodeFrame(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Bounds().Size() != expected {
+			t.Errorf("%s: expected %v, got %v", path, expected, frame.Bounds().Size())
+		}
+	}
+}
+
+func TestParseThumborURL(t *testing.T) {
+	request, err := ParseThumborURL("/unsafe/meta/10x20:310x220/adaptive-fit-in/-300x0/right/bottom/smart/"+
+		"filters:quality(70):watermark(http://cdn/logo.png,-10,5p,20,none,10):blur(3)/s3.example.org%2Fa%20b.jpg",
+		ThumborOptions{AllowUnsafe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ThumborRequest{
+		Unsafe: true, Crop: image.Rect(10, 20, 310, 220), FitIn: true, Adaptive: true,
+		Width: 300, FlipH: true, HAlign: "right", VAlign: "bottom", Smart: true,
+		Filters: []ThumborFilter{
+			{Name: "quality", Args: []string{"70"}},
+			{Name: "watermark", Args: []string{"http://cdn/logo.png", "-10", "5p", "20", "none", "10"}},
+			{Name: "blur", Args: []string{"3"}},
+		},
+		Image:       "s3.example.org/a b.jpg",
+		Unsupported: []string{"meta", "smart", "watermark", "filters:blur"},
+	}
+	if !reflect.DeepEqual(request, expected) {
+		t.Errorf("expected %+v, got %+v", expected, request)
+	}
+
+	request, err = ParseThumborURL("unsafe/origx-/http://example.org/photo.jpg", ThumborOptions{AllowUnsafe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !request.OrigWidth || !request.FlipV || request.Image != "http://example.org/photo.jpg" {
+		t.Errorf("unexpected %+v", request)
+	}
+}
+
+func TestParseThumborURLErrors(t *testing.T) {
+	options := ThumborOptions{AllowUnsafe: true}
+	for path, status := range map[string]int{
+		"/unsafe/300x200/":                               400,
+		"/unsafe/wide-fit-in/300x200/a.jpg":              400,
+		"/unsafe/filters:quality(101)/a.jpg":             400,
+		"/unsafe/filters:quality(80/a.jpg":               400,
+		"/unsafe/filters:format(bmp)/a.jpg":              400,
+		"/unsafe/filters:fill(nope)/a.jpg":               400,
+		"/unsafe/filters:grayscale()quality(5)/a.jpg":    400,
+		"/unsafe/filters:watermark(a.png,1,x,0)/a.jpg":   400,
+		"/unsafe/filters:watermark(a.png,1,1,101)/a.jpg": 400,
+		"/300x200/a.jpg":                                 403,
+		"/" + strings.Repeat("a", 28) + "/300x200/a.jpg": 403,
+	} {
+		_, err := ParseThumborURL(path, options)
+		var thumborErr *ThumborError
+		if !errors.As(err, &thumborErr) || thumborErr.Status != status {
+			t.Errorf("%s: expected status %d, got %v", path, status, err)
+		}
+	}
+	_, err := ParseThumborURL("/unsafe/300x200/a.jpg", ThumborOptions{})
+	var thumborErr *ThumborError
+	if !errors.As(err, &thumborErr) || thumborErr.Status != 403 {
+		t.Errorf("expected unsafe URLs to be rejected by default, got %v", err)
+	}
+}
+
+func TestThumborSignature(t *testing.T) {
+	// base64.urlsafe_b64encode(hmac.new(key, path, hashlib.sha1).digest()), as in thumbor
+	signed := SignThumborURL("MY_SECURE_KEY", "300x200/smart/my.server.com/some/path/to/image.jpg")
+	if signed != "/OHHMqHwGrH1gubkMMveC8Ireg7A=/300x200/smart/my.server.com/some/path/to/image.jpg" {
+		t.Errorf("unexpected signed URL %s", signed)
+	}
+	request, err := ParseThumborURL(signed, ThumborOptions{Key: "MY_SECURE_KEY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Signature != "OHHMqHwGrH1gubkMMveC8Ireg7A=" || request.Width != 300 {
+		t.Errorf("unexpected %+v", request)
+	}
+	for _, path := range []string{
+		strings.Replace(signed, "300x200", "301x200", 1),
+		signed + "?width=5000",
+	} {
+		_, err := ParseThumborURL(path, ThumborOptions{Key: "MY_SECURE_KEY"})
+		var thumborErr *ThumborError
+		if !errors.As(err, &thumborErr) || thumborErr.Status != 403 {
+			t.Errorf("%s: expected status 403, got %v", path, err)
+		}
+	}
+	if _, err := ParseThumborURL(signed, ThumborOptions{Key: "OTHER"}); err == nil {
+		t.Error("expected a signature made with another key to be rejected")
+	}
+}
+
+func TestThumborBuild(t *testing.T) {
+	info := ImageInfo{Width: 1000, Height: 600, PreferredMimeType: "image/jpeg"}
+	watermark := func(url string) (IO, error) { return NewBuffer(nil), nil }
+	options := ThumborOptions{AllowUnsafe: true, Watermark: watermark}
+	for path, expected := range map[string][]string{
+		"/unsafe/300x300/left/top/a.jpg": {
+			`"constrain":{"mode":"fit_crop","w":300,"h":300`,
+			`"gravity":{"percentage":{"x":0,"y":0}}`,
+			`"mozjpeg":{"quality":80`,
+		},
+		"/unsafe/100x100:600x400/250x0/filters:format(webp):quality(60)/a.jpg": {
+			`"region":{"x1":100,"y1":100,"x2":600,"y2":400`,
+			`"constrain":{"mode":"fit_crop","w":250,"h":150`,
+			`"webplossy":{"quality":60}`,
+		},
+		"/unsafe/fit-in/500x500/filters:fill(white):grayscale()/a.jpg": {
+			`"constrain":{"mode":"distort","w":500,"h":300`,
+			`"expand_canvas":{"left":0,"right":0,"top":100,"bottom":100`,
+			`"color_filter_srgb":"grayscale_ntsc"`,
+		},
+		"/unsafe/full-fit-in/500x500/a.jpg": {
+			`"constrain":{"mode":"distort","w":833,"h":500`,
+		},
+		"/unsafe/adaptive-fit-in/-300x-500/a.jpg": {
+			`"constrain":{"mode":"distort","w":500,"h":300`,
+			`"flip_h"`,
+			`"flip_v"`,
+		},
+		"/unsafe/500x300/filters:watermark(logo.png,-50,center,30,20)/a.jpg": {
+			`"watermark":{"io_id":1,"gravity":{"percentage":{"x":100,"y":50}},"fit_mode":"within",` +
+				`"fit_box":{"image_percentage":{"x1":70,"y1":0,"x2":90,"y2":100}},"opacity":0.7`,
+		},
+	} {
+		request, err := ParseThumborURL(path, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, err := request.Build(info, NewBuffer(nil), GetBuffer("out"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := step.toJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range expected {
+			if !strings.Contains(string(data), s) {
+				t.Errorf("%s: expected %s in %s", path, s, data)
+			}
+		}
+	}
+
+	request, _ := ParseThumborURL("/unsafe/2000x2000:3000x3000/a.jpg", options)
+	_, err := request.Build(info, NewBuffer(nil), GetBuffer("out"), options)
+	var thumborErr *ThumborError
+	if !errors.As(err, &thumborErr) || thumborErr.Status != 400 {
+		t.Errorf("expected a crop outside the image to fail, got %v", err)
+	}
+}
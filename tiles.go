@@ -0,0 +1,347 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// TileStyle is the layout of a tile pyramid
+type TileStyle string
+
+const (
+	// TileDZI is the Deep Zoom layout, name.dzi and name_files/level/column_row.ext
+	TileDZI TileStyle = "dzi"
+	// TileZoomify is the Zoomify layout, name/ImageProperties.xml and name/TileGroupN/tier-column-row.ext
+	TileZoomify TileStyle = "zoomify"
+)
+
+var tileStyles = []string{"dzi", "zoomify"}
+
+// zoomifyGroupSize is the number of tiles in a Zoomify TileGroup directory
+const zoomifyGroupSize = 256
+
+// TileSink receives the tiles and descriptor of a tile pyramid
+// path uses forward slashes and is relative to the root of the pyramid.
+type TileSink interface {
+	WriteTile(path string, data []byte) error
+}
+
+// DirectorySink writes tiles below a directory, creating subdirectories as needed
+type DirectorySink string
+
+// WriteTile implements TileSink
+func (dir DirectorySink) WriteTile(path string, data []byte) error {
+	full := filepath.Join(string(dir), filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(full, data, 0644)
+}
+
+// MemorySink keeps tiles in memory, keyed by path
+type MemorySink map[string][]byte
+
+// WriteTile implements TileSink
+func (sink MemorySink) WriteTile(path string, data []byte) error {
+	sink[path] = data
+	return nil
+}
+
+// TilePyramidOptions describes a tile pyramid
+// Name The base name of the descriptor and the tile directory, default "image"
+// Style TileDZI (default) or TileZoomify
+// TileSize The size of the tiles without overlap, default 254 for Deep Zoom and 256 for Zoomify
+// Overlap The pixels tiles share with their neighbours, Deep Zoom only
+// Preset The encoder of the tiles, default MozJPEG. It must encode to a fixed format.
+// TilesPerJob The most tiles encoded by one native job, default 256. Every job decodes the source again.
+// Hint Resampling hints for the lower levels.
+type TilePyramidOptions struct {
+	Name        string
+	Style       TileStyle
+	TileSize    int
+	Overlap     int
+	Preset      presetInterface
+	TilesPerJob int
+	Hint        ConstraintHint
+}
+
+// TileLevel is one zoom level of a pyramid
+// Level is the Deep Zoom level or Zoomify tier, the full size image has the highest level.
+type TileLevel struct {
+	Level   int
+	Width   int
+	Height  int
+	Columns int
+	Rows    int
+}
+
+// Tile is the region of a level stored in one file
+type Tile struct {
+	Level  int
+	Column int
+	Row    int
+	X      int
+	Y      int
+	Width  int
+	Height int
+	Path   string
+}
+
+// TilePyramid is the plan of a tile pyramid, levels go from the smallest to the full size image
+type TilePyramid struct {
+	Name     string
+	Style    TileStyle
+	Width    int
+	Height   int
+	TileSize int
+	Overlap  int
+	Format   ImageFormat
+	Levels   []TileLevel
+}
+
+// withDefaults fills in the defaults and validates the options
+func (options TilePyramidOptions) withDefaults() (TilePyramidOptions, error) {
+	if options.Name == "" {
+		options.Name = "image"
+	}
+	if options.Style == "" {
+		options.Style = TileDZI
+	}
+	if _, err := parseEnum("tile style", tileStyles, string(options.Style)); err != nil {
+		return options, err
+	}
+	if options.TileSize == 0 {
+		options.TileSize = 254
+		if options.Style == TileZoomify {
+			options.TileSize = 256
+		}
+	}
+	if options.Preset == nil {
+		options.Preset = MozJPEG{}
+	}
+	if options.TilesPerJob == 0 {
+		options.TilesPerJob = 256
+	}
+	if options.TileSize < 1 || options.Overlap < 0 || options.TilesPerJob < 1 {
+		return options, fmt.Errorf("imageflow: invalid tile size %d, overlap %d or tiles per job %d",
+			options.TileSize, options.Overlap, options.TilesPerJob)
+	}
+	if options.Style == TileZoomify && options.Overlap != 0 {
+		return options, fmt.Errorf("imageflow: zoomify tiles cannot overlap")
+	}
+	return options, options.Hint.validate()
+}
+
+// PlanTilePyramid computes the levels of a pyramid for a width x height image without touching the image
+func PlanTilePyramid(width int, height int, options TilePyramidOptions) (*TilePyramid, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if width < 1 || height < 1 {
+		return nil, fmt.Errorf("imageflow: invalid image size %dx%d", width, height)
+	}
+	format, ok := presetFormat(options.Preset)
+	if !ok {
+		return nil, fmt.Errorf("imageflow: tiles need a preset with a fixed format, got %T", options.Preset)
+	}
+	pyramid := &TilePyramid{
+		Name:     options.Name,
+		Style:    options.Style,
+		Width:    width,
+		Height:   height,
+		TileSize: options.TileSize,
+		Overlap:  options.Overlap,
+		Format:   format,
+	}
+
+	// sizes from the full image down to the smallest level
+	var sizes [][2]int
+	if options.Style == TileDZI {
+		// Deep Zoom halves the image down to 1x1
+		top := int(math.Ceil(math.Log2(float64(max(width, height)))))
+		for level := top; level >= 0; level-- {
+			scale := math.Exp2(float64(top - level))
+			sizes = append(sizes, [2]int{int(math.Ceil(float64(width) / scale)), int(math.Ceil(float64(height) / scale))})
+		}
+	} else {
+		// Zoomify halves the image until it fits in one tile
+		w, h := width, height
+		sizes = append(sizes, [2]int{w, h})
+		for w > options.TileSize || h > options.TileSize {
+			w, h = (w+1)/2, (h+1)/2
+			sizes = append(sizes, [2]int{w, h})
+		}
+	}
+	for i := len(sizes) - 1; i >= 0; i-- {
+		w, h := sizes[i][0], sizes[i][1]
+		pyramid.Levels = append(pyramid.Levels, TileLevel{
+			Level:   len(pyramid.Levels),
+			Width:   w,
+			Height:  h,
+			Columns: (w + options.TileSize - 1) / options.TileSize,
+			Rows:    (h + options.TileSize - 1) / options.TileSize,
+		})
+	}
+	return pyramid, nil
+}
+
+// Tiles returns every tile of the pyramid, from the smallest level up and row by row
+func (pyramid *TilePyramid) Tiles() []Tile {
+	var tiles []Tile
+	for _, level := range pyramid.Levels {
+		for row := 0; row < level.Rows; row++ {
+			for column := 0; column < level.Columns; column++ {
+				x, w := pyramid.span(column, level.Width)
+				y, h := pyramid.span(row, level.Height)
+				tile := Tile{Level: level.Level, Column: column, Row: row, X: x, Y: y, Width: w, Height: h}
+				tile.Path = pyramid.tilePath(tile, len(tiles))
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles
+}
+
+// span returns the offset and length of tile i along a side of length size, including the overlap
+func (pyramid *TilePyramid) span(i int, size int) (int, int) {
+	start := i * pyramid.TileSize
+	end := start + pyramid.TileSize + pyramid.Overlap
+	if i > 0 {
+		start -= pyramid.Overlap
+	}
+	return start, min(end, size) - start
+}
+
+// tilePath returns the path of a tile, index is the position of the tile in Tiles
+func (pyramid *TilePyramid) tilePath(tile Tile, index int) string {
+	extension := pyramid.Format.Extension()
+	if pyramid.Style == TileZoomify {
+		return fmt.Sprintf("%s/TileGroup%d/%d-%d-%d.%s", pyramid.Name, index/zoomifyGroupSize, tile.Level, tile.Column, tile.Row, extension)
+	}
+	return fmt.Sprintf("%s_files/%d/%d_%d.%s", pyramid.Name, tile.Level, tile.Column, tile.Row, extension)
+}
+
+// tileCount returns the number of tiles of all levels
+func (pyramid *TilePyramid) tileCount() int {
+	count := 0
+	for _, level := range pyramid.Levels {
+		count += level.Columns * level.Rows
+	}
+	return count
+}
+
+// Descriptor returns the path and content of the XML descriptor, name.dzi or name/ImageProperties.xml
+func (pyramid *TilePyramid) Descriptor() (string, []byte) {
+	if pyramid.Style == TileZoomify {
+		return pyramid.Name + "/ImageProperties.xml", []byte(fmt.Sprintf(
+			`<IMAGE_PROPERTIES WIDTH="%d" HEIGHT="%d" NUMTILES="%d" NUMIMAGES="1" VERSION="1.8" TILESIZE="%d" />`,
+			pyramid.Width, pyramid.Height, pyramid.tileCount(), pyramid.TileSize))
+	}
+	return pyramid.Name + ".dzi", []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, pyramid.Format.Extension(), pyramid.Overlap, pyramid.TileSize, pyramid.Width, pyramid.Height))
+}
+
+// DescriptorJSON returns the descriptor as JSON in the form OpenSeadragon accepts as a tile source
+// tilesURL is where the tile directory is served from, like "/tiles/image_files/".
+func (pyramid *TilePyramid) DescriptorJSON(tilesURL string) ([]byte, error) {
+	if pyramid.Style == TileZoomify {
+		return json.Marshal(map[string]interface{}{
+			"type":     "zoomifytileservice",
+			"width":    pyramid.Width,
+			"height":   pyramid.Height,
+			"tileSize": pyramid.TileSize,
+			"tilesUrl": tilesURL,
+		})
+	}
+	return json.Marshal(map[string]interface{}{"Image": map[string]interface{}{
+		"xmlns":    "http://schemas.microsoft.com/deepzoom/2008",
+		"Url":      tilesURL,
+		"Format":   pyramid.Format.Extension(),
+		"Overlap":  fmt.Sprint(pyramid.Overlap),
+		"TileSize": fmt.Sprint(pyramid.TileSize),
+		"Size": map[string]string{
+			"Width":  fmt.Sprint(pyramid.Width),
+			"Height": fmt.Sprint(pyramid.Height),
+		},
+	}})
+}
+
+// GenerateTilePyramid cuts source into a tile pyramid and writes the tiles and the XML descriptor to sink
+// Tiles are encoded in batches of TilesPerJob. Every batch decodes the source once, scales it once per
+// level and crops each tile with Region, so a batch is a single native job.
+// The pyramid has the size of the decoded frame, after EXIF rotation.
+func GenerateTilePyramid(source IO, sink TileSink, options TilePyramidOptions) (*TilePyramid, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	data, err := source.toBuffer()
+	if err != nil {
+		return nil, err
+	}
+	info, err := orientedImageInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	pyramid, err := PlanTilePyramid(info.Width, info.Height, options)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := pyramid.Tiles()
+	for start := 0; start < len(tiles); start += options.TilesPerJob {
+		batch := tiles[start:min(start+options.TilesPerJob, len(tiles))]
+		if err := pyramid.renderTiles(data, batch, options, sink); err != nil {
+			return nil, err
+		}
+	}
+	path, descriptor := pyramid.Descriptor()
+	if err := sink.WriteTile(path, descriptor); err != nil {
+		return nil, err
+	}
+	return pyramid, nil
+}
+
+// renderTiles encodes a batch of tiles in one job and writes them to sink
+func (pyramid *TilePyramid) renderTiles(data []byte, tiles []Tile, options TilePyramidOptions, sink TileSink) error {
+	step := NewStep()
+	step.Decode(NewBuffer(data))
+	decoded := step.Ref()
+	var scaled NodeRef
+	current := -1
+	for _, tile := range tiles {
+		if tile.Level != current {
+			current = tile.Level
+			level := pyramid.Levels[tile.Level]
+			step.From(decoded)
+			if level.Width != pyramid.Width || level.Height != pyramid.Height {
+				step.Constrain(Constrain{Mode: ModeDistort, W: float64(level.Width), H: float64(level.Height), Hint: options.Hint})
+			}
+			scaled = step.Ref()
+		}
+		step.From(scaled).
+			Region(Region{
+				X1: float64(tile.X), Y1: float64(tile.Y),
+				X2: float64(tile.X + tile.Width), Y2: float64(tile.Y + tile.Height),
+				BackgroundColor: Transparent(""),
+			}).
+			Encode(GetBuffer(tile.Path), options.Preset)
+	}
+	outputs, err := step.Execute()
+	if err != nil {
+		return err
+	}
+	for _, tile := range tiles {
+		if err := sink.WriteTile(tile.Path, outputs[tile.Path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
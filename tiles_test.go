@@ -0,0 +1,188 @@
+package imageflow
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTilePyramid(t *testing.T) {
+	data := loadTestImage(t)
+	sink := MemorySink{}
+	pyramid, err := GenerateTilePyramid(NewBuffer(data), sink, TilePyramidOptions{
+		Name: "scan", TileSize: 128, Overlap: 1, Preset: MozJPEG{Quality: 80}, TilesPerJob: 7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := pyramid.Tiles()
+	if len(sink) != len(tiles)+1 {
+		t.Errorf("expected %d tiles and a descriptor, got %d files", len(tiles), len(sink))
+	}
+	if _, ok := sink["scan.dzi"]; !ok {
+		t.Error("missing descriptor")
+	}
+	last := tiles[len(tiles)-1]
+	frame, err := DecodeFrame(sink[last.Path])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != last.Width || frame.Bounds().Dy() != last.Height {
+		t.Errorf("tile %s is %v, expected %dx%d", last.Path, frame.Bounds(), last.Width, last.Height)
+	}
+}
+
+func TestGenerateTilePyramidOrientation(t *testing.T) {
+	sink := MemorySink{}
+	pyramid, err := GenerateTilePyramid(NewBuffer(rotatedJPEG(t, 200, 100)), sink, TilePyramidOptions{
+		Name: "scan", TileSize: 256, Preset: LosslessPNG{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pyramid.Width != 100 || pyramid.Height != 200 {
+		t.Fatalf("expected a 100x200 pyramid, got %dx%d", pyramid.Width, pyramid.Height)
+	}
+	tiles := pyramid.Tiles()
+	last := tiles[len(tiles)-1]
+	frame, err := DecodeFrame(sink[last.Path])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Bounds().Dx() != 100 || frame.Bounds().Dy() != 200 {
+		t.Errorf("tile %s is %v, expected 100x200", last.Path, frame.Bounds())
+	}
+}
+
+func TestPlanTilePyramidDZI(t *testing.T) {
+	pyramid, err := PlanTilePyramid(1000, 600, TilePyramidOptions{TileSize: 254, Overlap: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pyramid.Levels) != 11 {
+		t.Fatalf("expected levels 0 to 10, got %d", len(pyramid.Levels))
+	}
+	top := pyramid.Levels[10]
+	if top.Width != 1000 || top.Height != 600 || top.Columns != 4 || top.Rows != 3 {
+		t.Errorf("unexpected top level %+v", top)
+	}
+	if level := pyramid.Levels[9]; level.Width != 500 || level.Height != 300 || level.Columns != 2 || level.Rows != 2 {
+		t.Errorf("unexpected level 9 %+v", level)
+	}
+	if level := pyramid.Levels[0]; level.Width != 1 || level.Height != 1 {
+		t.Errorf("unexpected level 0 %+v", level)
+	}
+
+	var topTiles []Tile
+	for _, tile := range pyramid.Tiles() {
+		if tile.Level == 10 {
+			topTiles = append(topTiles, tile)
+		}
+	}
+	expected := []Tile{
+		{Level: 10, Column: 0, Row: 0, X: 0, Y: 0, Width: 255, Height: 255, Path: "image_files/10/0_0.jpg"},
+		{Level: 10, Column: 1, Row: 0, X: 253, Y: 0, Width: 256, Height: 255, Path: "image_files/10/1_0.jpg"},
+		{Level: 10, Column: 3, Row: 0, X: 761, Y: 0, Width: 239, Height: 255, Path: "image_files/10/3_0.jpg"},
+		{Level: 10, Column: 3, Row: 2, X: 761, Y: 507, Width: 239, Height: 93, Path: "image_files/10/3_2.jpg"},
+	}
+	for i, index := range []int{0, 1, 3, 11} {
+		if topTiles[index] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], topTiles[index])
+		}
+	}
+}
+
+func TestPlanTilePyramidZoomify(t *testing.T) {
+	pyramid, err := PlanTilePyramid(1000, 600, TilePyramidOptions{Name: "scan", Style: TileZoomify, Preset: WebP{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := [][2]int{{250, 150}, {500, 300}, {1000, 600}}
+	if len(pyramid.Levels) != len(sizes) {
+		t.Fatalf("expected %d tiers, got %+v", len(sizes), pyramid.Levels)
+	}
+	for i, size := range sizes {
+		if pyramid.Levels[i].Width != size[0] || pyramid.Levels[i].Height != size[1] {
+			t.Errorf("unexpected tier %+v", pyramid.Levels[i])
+		}
+	}
+	tiles := pyramid.Tiles()
+	if len(tiles) != 1+2*2+4*3 {
+		t.Errorf("unexpected tile count %d", len(tiles))
+	}
+	if tiles[0].Path != "scan/TileGroup0/0-0-0.webp" || tiles[16].Path != "scan/TileGroup0/2-3-2.webp" {
+		t.Errorf("unexpected paths %s and %s", tiles[0].Path, tiles[16].Path)
+	}
+
+	large, _ := PlanTilePyramid(5000, 3000, TilePyramidOptions{Style: TileZoomify})
+	tiles = large.Tiles()
+	if !strings.HasPrefix(tiles[255].Path, "image/TileGroup0/") || !strings.HasPrefix(tiles[256].Path, "image/TileGroup1/") {
+		t.Errorf("expected 256 tiles per group, got %s and %s", tiles[255].Path, tiles[256].Path)
+	}
+}
+
+func TestPlanTilePyramidInvalid(t *testing.T) {
+	for _, options := range []TilePyramidOptions{
+		{Style: "iiif"},
+		{TileSize: -1},
+		{Overlap: -1},
+		{Style: TileZoomify, Overlap: 1},
+		{Preset: Auto{}},
+	} {
+		if _, err := PlanTilePyramid(100, 100, options); err == nil {
+			t.Errorf("expected error for %+v", options)
+		}
+	}
+	if _, err := PlanTilePyramid(0, 100, TilePyramidOptions{}); err == nil {
+		t.Error("expected error for an empty image")
+	}
+}
+
+func TestTilePyramidDescriptor(t *testing.T) {
+	pyramid, _ := PlanTilePyramid(1000, 600, TilePyramidOptions{Name: "scan", Overlap: 1, Preset: LosslessPNG{}})
+	path, xml := pyramid.Descriptor()
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="png" Overlap="1" TileSize="254">
+  <Size Width="1000" Height="600"/>
+</Image>
+`
+	if path != "scan.dzi" || string(xml) != expected {
+		t.Errorf("unexpected descriptor %s\n%s", path, xml)
+	}
+	data, err := pyramid.DescriptorJSON("/tiles/scan_files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Image struct {
+			URL  string `json:"Url"`
+			Size struct{ Width string }
+		}
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Image.URL != "/tiles/scan_files/" || parsed.Image.Size.Width != "1000" {
+		t.Errorf("unexpected json descriptor %s", data)
+	}
+
+	pyramid, _ = PlanTilePyramid(1000, 600, TilePyramidOptions{Name: "scan", Style: TileZoomify})
+	path, xml = pyramid.Descriptor()
+	expected = `<IMAGE_PROPERTIES WIDTH="1000" HEIGHT="600" NUMTILES="17" NUMIMAGES="1" VERSION="1.8" TILESIZE="256" />`
+	if path != "scan/ImageProperties.xml" || string(xml) != expected {
+		t.Errorf("unexpected descriptor %s\n%s", path, xml)
+	}
+}
+
+func TestDirectorySink(t *testing.T) {
+	dir := t.TempDir()
+	if err := DirectorySink(dir).WriteTile("image_files/3/0_1.jpg", []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "image_files", "3", "0_1.jpg"))
+	if err != nil || string(data) != "tile" {
+		t.Errorf("unexpected tile %q, %v", data, err)
+	}
+}